@@ -0,0 +1,517 @@
+package apibillme
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/gjson"
+)
+
+// alert types
+const (
+	AlertQuota = "quota.threshold"
+	AlertSpend = "spend.threshold"
+)
+
+// alert delivery statuses
+const (
+	AlertPending = "pending"
+	// AlertSending - a sender holds the delivery while it posts it (until LeaseUntil)
+	AlertSending   = "sending"
+	AlertDelivered = "delivered"
+	AlertFailed    = "failed"
+)
+
+// webhook headers
+const (
+	alertEventHeader     = "X-Apibillme-Event"
+	alertDeliveryHeader  = "X-Apibillme-Delivery"
+	alertSignatureHeader = "X-Apibillme-Signature"
+	// default attempts of a delivery (alert_webhook_retries ENV VAR)
+	alertRetries = 5
+	// how long a sender holds a delivery while it posts it (longer than the HTTP client timeout - a crashed sender's delivery is retried after it)
+	alertLease = time.Minute
+)
+
+// errAlertInFlight - another sender holds the delivery (e.g. RetryAlerts while the call retries it)
+var errAlertInFlight = errors.New("alert delivery is in flight")
+
+// for stubbing
+var alertBackoff = time.Second
+var goAlert = func(deliver func()) { go deliver() }
+
+// Alerts - usage threshold alerts of a plan (in the catalog) or a customer (in buntdb)
+type Alerts struct {
+	// Thresholds - percents of the quota or spend cap (e.g. 50, 80 and 100) - each is sent at most once per period
+	Thresholds []int64 `json:"thresholds"`
+	// SpendCap - the units a customer expects to be charged in a period (alerts on the charged units)
+	SpendCap int64 `json:"spendCap,omitempty"`
+	// Period - the period of the spend cap - day, week or month (defaults to month)
+	Period string `json:"period,omitempty"`
+	// Anchor - the start of a spend cap period in RFC 3339 (like quota anchors)
+	Anchor string `json:"anchor,omitempty"`
+	// URL - the webhook endpoint (defaults to alert_webhook_url)
+	URL string `json:"url,omitempty"`
+}
+
+// CustomerAlerts - the alerts of a customer (override the alerts of the plan)
+type CustomerAlerts struct {
+	Alerts
+	// Secret - the signing secret of the customer's endpoint (defaults to alert_webhook_secret)
+	Secret string `json:"secret,omitempty"`
+}
+
+// AlertEvent - the body of a threshold webhook
+type AlertEvent struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	CustomerID string `json:"customerID,omitempty"`
+	// Subject - the caller (when there is no billing customer)
+	Subject string `json:"subject,omitempty"`
+	Plan    string `json:"plan"`
+	// Scope - the scope of the quota (* for the quota of the plan and the spend cap)
+	Scope string `json:"scope"`
+	// Threshold - the percent of the limit that was crossed
+	Threshold   int64     `json:"threshold"`
+	Used        int64     `json:"used"`
+	Limit       int64     `json:"limit"`
+	PeriodStart time.Time `json:"periodStart"`
+	PeriodEnd   time.Time `json:"periodEnd"`
+	Time        time.Time `json:"time"`
+}
+
+// AlertDelivery - the delivery state of an alert
+type AlertDelivery struct {
+	Event AlertEvent `json:"event"`
+	URL   string     `json:"url"`
+	// Customer - the alert is of the customer's alerts (signed with the customer's secret)
+	Customer bool `json:"customer,omitempty"`
+	// Status - pending, sending, delivered or failed (all attempts failed)
+	Status string `json:"status"`
+	// LeaseUntil - the end of the lease of the sender posting the delivery
+	LeaseUntil  time.Time `json:"leaseUntil,omitempty"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"lastError,omitempty"`
+	LastAttempt time.Time `json:"lastAttempt,omitempty"`
+	Delivered   time.Time `json:"delivered,omitempty"`
+}
+
+func customerAlertsKey(customerID string) string {
+	return "apibillme:alerts:" + customerID
+}
+
+// alertKey - the delivery of a threshold of an owner (customer:<id> or sub:<subject>) in a period
+func alertKey(owner string, event AlertEvent) string {
+	return "apibillme:alert:delivery:" + owner + ":" + event.Type + ":" + event.Scope + ":" +
+		strconv.FormatInt(event.Threshold, 10) + ":" + strconv.FormatInt(event.PeriodStart.Unix(), 10)
+}
+
+// spendKey - the units charged to a customer in the period
+func spendKey(customerID string, start time.Time) string {
+	return "apibillme:spend:" + customerID + ":" + strconv.FormatInt(start.Unix(), 10)
+}
+
+// SetCustomerAlerts - set the alerts of a billing customer (e.g. their own endpoint and thresholds)
+func SetCustomerAlerts(db *buntdb.DB, customerID string, alerts CustomerAlerts) error {
+	if customerID == "" {
+		return errors.New("customer ID is required")
+	}
+	for _, threshold := range alerts.Thresholds {
+		if threshold <= 0 {
+			return errors.New("alert thresholds must be positive percents")
+		}
+	}
+	if _, _, err := (&Quota{Period: alerts.Period, Anchor: alerts.Anchor}).period(time.Now()); err != nil {
+		return err
+	}
+	jsonBytes, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(customerAlertsKey(customerID), string(jsonBytes), nil)
+		return err
+	})
+}
+
+// GetCustomerAlerts - get the alerts of a billing customer
+func GetCustomerAlerts(db *buntdb.DB, customerID string) (*CustomerAlerts, error) {
+	var alerts CustomerAlerts
+	err := db.View(func(tx *buntdb.Tx) error {
+		val, err := tx.Get(customerAlertsKey(customerID))
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal([]byte(val), &alerts)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &alerts, nil
+}
+
+// DeleteCustomerAlerts - move a billing customer back to the alerts of their plan
+func DeleteCustomerAlerts(db *buntdb.DB, customerID string) error {
+	return db.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete(customerAlertsKey(customerID))
+		return err
+	})
+}
+
+// alerts - the alerts of the plan (nil if it has none)
+func (c *Catalog) alerts(plan string) *Alerts {
+	if plan == "" {
+		plan = defaultPlan
+	}
+	return c.Plans[plan].Alerts
+}
+
+// alertConfig - the alerts of the customer or else of the plan (and whether they are the customer's)
+func (d *decision) alertConfig() (*Alerts, bool) {
+	if d.identity.CustomerID != "" {
+		alerts, err := GetCustomerAlerts(d.db, d.identity.CustomerID)
+		if err == nil {
+			return &alerts.Alerts, true
+		}
+	}
+	return d.planAlerts, false
+}
+
+// alertQuota - send the alerts of the quota thresholds crossed by the call
+func (d *decision) alertQuota(quota *Quota, result quotaResult) {
+	alerts, customer := d.alertConfig()
+	if alerts == nil {
+		return
+	}
+	d.sendAlerts(alerts, customer, AlertEvent{
+		Type:        AlertQuota,
+		Scope:       quota.scope(d.serverMethod, d.serverBaseURL),
+		Used:        result.used,
+		Limit:       result.limit,
+		PeriodStart: result.periodStart,
+		PeriodEnd:   result.periodEnd,
+	})
+}
+
+// alertSpend - count the charged units on the spend cap and send the alerts of the thresholds crossed by the call
+func (d *decision) alertSpend(units int64) {
+	alerts, customer := d.alertConfig()
+	if alerts == nil || alerts.SpendCap <= 0 || d.identity.CustomerID == "" {
+		return
+	}
+	now := time.Now()
+	start, end, err := (&Quota{Period: alerts.Period, Anchor: alerts.Anchor}).period(now)
+	if err != nil {
+		return
+	}
+	var spent int64
+	err = d.db.Update(func(tx *buntdb.Tx) error {
+		key := spendKey(d.identity.CustomerID, start)
+		val, _ := tx.Get(key)
+		spent = cast.ToInt64(val) + units
+		// counters are kept a day after the period for reporting
+		_, _, err := tx.Set(key, strconv.FormatInt(spent, 10), &buntdb.SetOptions{Expires: true, TTL: end.Sub(now) + 24*time.Hour})
+		return err
+	})
+	if err != nil {
+		return
+	}
+	d.sendAlerts(alerts, customer, AlertEvent{
+		Type:        AlertSpend,
+		Scope:       "*",
+		Used:        spent,
+		Limit:       alerts.SpendCap,
+		PeriodStart: start,
+		PeriodEnd:   end,
+	})
+}
+
+// sendAlerts - claim the deliveries of the thresholds that were crossed (once per period) and deliver them in the background
+func (d *decision) sendAlerts(alerts *Alerts, customer bool, event AlertEvent) {
+	url := alerts.URL
+	if url == "" {
+		url = cast.ToString(viper.Get("alert_webhook_url"))
+	}
+	if url == "" || event.Limit <= 0 {
+		return
+	}
+	owner := "sub:" + d.identity.Subject
+	if d.identity.CustomerID != "" {
+		owner = "customer:" + d.identity.CustomerID
+	}
+	event.CustomerID = d.identity.CustomerID
+	if event.CustomerID == "" {
+		event.Subject = d.identity.Subject
+	}
+	event.Plan = d.identity.Plan
+	if event.Plan == "" {
+		event.Plan = defaultPlan
+	}
+	now := time.Now()
+	event.Time = now.UTC()
+
+	keys := []string{}
+	d.db.Update(func(tx *buntdb.Tx) error {
+		for _, threshold := range alerts.Thresholds {
+			if threshold <= 0 || event.Used*100 < threshold*event.Limit {
+				continue
+			}
+			event.Threshold = threshold
+			key := alertKey(owner, event)
+			if _, err := tx.Get(key); err == nil {
+				continue
+			}
+			id, err := randomHex(12)
+			if err != nil {
+				return err
+			}
+			event.ID = "evt_" + id
+			jsonBytes, err := json.Marshal(AlertDelivery{Event: event, URL: url, Customer: customer, Status: AlertPending})
+			if err != nil {
+				return err
+			}
+			// the delivery state is kept a day after the period (a threshold is sent once per period)
+			_, _, err = tx.Set(key, string(jsonBytes), &buntdb.SetOptions{Expires: true, TTL: event.PeriodEnd.Sub(now) + 24*time.Hour})
+			if err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	db := d.db
+	for _, key := range keys {
+		key := key
+		goAlert(func() { deliverAlert(db, key, alertAttempts()) })
+	}
+}
+
+// alertAttempts - the attempts of a delivery (alert_webhook_retries ENV VAR)
+func alertAttempts() int {
+	attempts := cast.ToInt(viper.Get("alert_webhook_retries"))
+	if attempts <= 0 {
+		attempts = alertRetries
+	}
+	return attempts
+}
+
+// alertSecret - the signing secret of the delivery (the customer's or else alert_webhook_secret)
+func alertSecret(db *buntdb.DB, delivery *AlertDelivery) string {
+	if delivery.Customer {
+		alerts, err := GetCustomerAlerts(db, delivery.Event.CustomerID)
+		if err == nil && alerts.Secret != "" {
+			return alerts.Secret
+		}
+	}
+	return cast.ToString(viper.Get("alert_webhook_secret"))
+}
+
+// deliverAlert - post the alert until it is delivered or the attempts are used up (with exponential backoff)
+func deliverAlert(db *buntdb.DB, key string, attempts int) error {
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(alertBackoff << uint(attempt-1))
+		}
+		var delivery *AlertDelivery
+		delivery, err = claimAlert(db, key)
+		if err == errAlertInFlight {
+			// the other sender saves the outcome - it is checked again on the next attempt
+			continue
+		}
+		if err != nil || delivery == nil {
+			return err
+		}
+		err = postAlert(delivery.URL, alertSecret(db, delivery), delivery.Event)
+		delivery.Attempts++
+		delivery.LastAttempt = time.Now().UTC()
+		delivery.LeaseUntil = time.Time{}
+		delivery.Status = AlertDelivered
+		delivery.LastError = ""
+		if err != nil {
+			delivery.Status = AlertPending
+			delivery.LastError = err.Error()
+			if attempt == attempts-1 {
+				delivery.Status = AlertFailed
+			}
+		} else {
+			delivery.Delivered = delivery.LastAttempt
+		}
+		saveErr := db.Update(func(tx *buntdb.Tx) error {
+			return saveAlert(tx, key, delivery)
+		})
+		if saveErr != nil {
+			return saveErr
+		}
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// claimAlert - lease the delivery to this sender before it is posted (nil when it is delivered - errAlertInFlight when another sender holds it)
+func claimAlert(db *buntdb.DB, key string) (*AlertDelivery, error) {
+	var delivery *AlertDelivery
+	err := db.Update(func(tx *buntdb.Tx) error {
+		val, err := tx.Get(key)
+		if err != nil {
+			return err
+		}
+		var stored AlertDelivery
+		err = json.Unmarshal([]byte(val), &stored)
+		if err != nil || stored.Status == AlertDelivered {
+			return err
+		}
+		now := time.Now().UTC()
+		if stored.Status == AlertSending && now.Before(stored.LeaseUntil) {
+			return errAlertInFlight
+		}
+		stored.Status = AlertSending
+		stored.LeaseUntil = now.Add(alertLease)
+		delivery = &stored
+		return saveAlert(tx, key, delivery)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+// saveAlert - save the delivery state (keeping its expiry)
+func saveAlert(tx *buntdb.Tx, key string, delivery *AlertDelivery) error {
+	ttl, err := tx.TTL(key)
+	if err != nil {
+		return err
+	}
+	jsonBytes, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	opts := &buntdb.SetOptions{Expires: ttl > 0, TTL: ttl}
+	_, _, err = tx.Set(key, string(jsonBytes), opts)
+	return err
+}
+
+// signWebhook - the signature header of a webhook body - t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">
+func signWebhook(secret string, body []byte, now time.Time) string {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook - verify the X-Apibillme-Signature header of a webhook body (signed at most tolerance ago)
+func VerifyWebhook(secret string, header string, body []byte, tolerance time.Duration) error {
+	fields := map[string]string{}
+	for _, part := range strings.Split(header, ",") {
+		pair := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(pair) == 2 {
+			fields[pair[0]] = pair[1]
+		}
+	}
+	timestamp, err := strconv.ParseInt(fields["t"], 10, 64)
+	if err != nil || fields["v1"] == "" {
+		return errors.New("invalid webhook signature header")
+	}
+	signedAt := time.Unix(timestamp, 0)
+	if time.Since(signedAt) > tolerance || time.Until(signedAt) > tolerance {
+		return errors.New("webhook signature is outside the tolerance")
+	}
+	expected := signWebhook(secret, body, signedAt)
+	if !hmac.Equal([]byte(expected), []byte("t="+fields["t"]+",v1="+fields["v1"])) {
+		return errors.New("invalid webhook signature")
+	}
+	return nil
+}
+
+// postAlert - post the signed alert to the endpoint (any 2xx is delivered)
+func postAlert(url string, secret string, event AlertEvent) error {
+	if secret == "" {
+		return errors.New("alert_webhook_secret is required to sign alerts")
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(alertEventHeader, event.Type)
+	req.Header.Set(alertDeliveryHeader, event.ID)
+	req.Header.Set(alertSignatureHeader, signWebhook(secret, body, time.Now()))
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return errors.New("alert webhook failed (status " + res.Status + ")")
+	}
+	return nil
+}
+
+// AlertDeliveries - the alert deliveries of a customer (all deliveries when customerID is empty) by time
+func AlertDeliveries(db *buntdb.DB, customerID string) ([]AlertDelivery, error) {
+	pattern := "apibillme:alert:delivery:*"
+	if customerID != "" {
+		pattern = "apibillme:alert:delivery:customer:" + customerID + ":*"
+	}
+	deliveries := []AlertDelivery{}
+	err := db.View(func(tx *buntdb.Tx) error {
+		var err error
+		tx.AscendKeys(pattern, func(key, val string) bool {
+			var delivery AlertDelivery
+			err = json.Unmarshal([]byte(val), &delivery)
+			if err != nil {
+				return false
+			}
+			deliveries = append(deliveries, delivery)
+			return true
+		})
+		return err
+	})
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].Event.Time.Before(deliveries[j].Event.Time)
+	})
+	return deliveries, err
+}
+
+// RetryAlerts - make one more attempt at the alerts that are not delivered (e.g. on start or on a schedule) - the number delivered
+// a delivery that is being sent (e.g. retried after the call) is skipped - the event ID is kept across attempts for receivers to dedupe on
+func RetryAlerts(db *buntdb.DB) (int, error) {
+	keys := []string{}
+	err := db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendKeys("apibillme:alert:delivery:*", func(key, val string) bool {
+			if gjson.Get(val, "status").String() != AlertDelivered {
+				keys = append(keys, key)
+			}
+			return true
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	delivered := 0
+	for _, key := range keys {
+		if deliverAlert(db, key, 1) == nil {
+			delivered++
+		}
+	}
+	return delivered, nil
+}
@@ -0,0 +1,346 @@
+package apibillme
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apibillme/stubby"
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+)
+
+// webhookReceiver - records the alerts posted to it (failing the first failures)
+type webhookReceiver struct {
+	secret   string
+	failures int
+	calls    int
+	events   []AlertEvent
+	errs     []error
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.calls++
+	if r.calls <= r.failures {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	r.errs = append(r.errs, VerifyWebhook(r.secret, req.Header.Get("X-Apibillme-Signature"), body, time.Minute))
+	var event AlertEvent
+	json.Unmarshal(body, &event)
+	r.events = append(r.events, event)
+}
+
+func TestAlerts(t *testing.T) {
+
+	Convey("VerifyWebhook", t, func() {
+		body := []byte(`{"id": "evt_1"}`)
+		header := signWebhook("secret", body, time.Now())
+
+		Convey("Success - signed with the secret", func() {
+			So(VerifyWebhook("secret", header, body, time.Minute), ShouldBeNil)
+		})
+
+		Convey("Failure - another secret or body", func() {
+			So(VerifyWebhook("foobar", header, body, time.Minute), ShouldBeError)
+			So(VerifyWebhook("secret", header, []byte(`{"id": "evt_2"}`), time.Minute), ShouldBeError)
+			So(VerifyWebhook("secret", "foobar", body, time.Minute), ShouldBeError)
+		})
+
+		Convey("Failure - signed too long ago", func() {
+			header := signWebhook("secret", body, time.Now().Add(-time.Hour))
+			So(VerifyWebhook("secret", header, body, time.Minute), ShouldBeError)
+		})
+	})
+
+	Convey("SetCustomerAlerts", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		Convey("Success", func() {
+			err := SetCustomerAlerts(db, "cus_123", CustomerAlerts{Alerts: Alerts{Thresholds: []int64{80}, URL: "https://example.com"}, Secret: "secret"})
+			So(err, ShouldBeNil)
+			alerts, err := GetCustomerAlerts(db, "cus_123")
+			So(err, ShouldBeNil)
+			So(alerts.URL, ShouldEqual, "https://example.com")
+			So(DeleteCustomerAlerts(db, "cus_123"), ShouldBeNil)
+			_, err = GetCustomerAlerts(db, "cus_123")
+			So(err, ShouldBeError)
+		})
+
+		Convey("Failure - invalid thresholds or period", func() {
+			So(SetCustomerAlerts(db, "", CustomerAlerts{}), ShouldBeError)
+			So(SetCustomerAlerts(db, "cus_123", CustomerAlerts{Alerts: Alerts{Thresholds: []int64{0}}}), ShouldBeError)
+			So(SetCustomerAlerts(db, "cus_123", CustomerAlerts{Alerts: Alerts{Period: "year"}}), ShouldBeError)
+		})
+	})
+
+	Convey("Run - quota alerts", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		receiver := &webhookReceiver{secret: "secret"}
+		server := httptest.NewServer(receiver)
+		defer server.Close()
+
+		viper.AutomaticEnv()
+		os.Setenv("ALERTS", "true")
+		os.Setenv("ALERT_WEBHOOK_URL", server.URL)
+		os.Setenv("ALERT_WEBHOOK_SECRET", "secret")
+		os.Setenv("QUOTA", "true")
+		os.Setenv("RBAC_VALIDATE", "false")
+		os.Setenv("STRIPE_VALIDATE", "false")
+		os.Setenv("STRIPE_JSON_PATH", "testdata/catalog.json")
+		defer os.Setenv("ALERTS", "")
+		defer os.Setenv("QUOTA", "")
+		defer os.Setenv("ALERT_WEBHOOK_RETRIES", "")
+
+		stub := stubby.Stub(&goAlert, func(deliver func()) { deliver() })
+		defer stub.Reset()
+		backoff := alertBackoff
+		alertBackoff = 0
+		defer func() { alertBackoff = backoff }()
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		identity := &Identity{Method: MethodAPIKey, Subject: "apikey|1", CustomerID: "cus_123"}
+		router.Use(Run(db, WithAuthenticator(&stubAuthenticator{identity: identity})))
+		router.GET("/users", func(c *gin.Context) {
+			c.String(http.StatusOK, "ok")
+		})
+		request := func() int {
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/users", nil)
+			router.ServeHTTP(recorder, req)
+			return recorder.Code
+		}
+
+		Convey("Success - the thresholds of the plan are sent once per period", func() {
+			So(request(), ShouldEqual, http.StatusOK)
+			So(receiver.events, ShouldBeEmpty)
+			So(request(), ShouldEqual, http.StatusOK)
+			So(request(), ShouldEqual, http.StatusOK)
+			So(request(), ShouldEqual, http.StatusPaymentRequired)
+
+			So(receiver.events, ShouldHaveLength, 2)
+			So(receiver.errs, ShouldResemble, []error{nil, nil})
+			So(receiver.events[0].Type, ShouldEqual, AlertQuota)
+			So(receiver.events[0].Threshold, ShouldEqual, 50)
+			So(receiver.events[0].Used, ShouldEqual, 2)
+			So(receiver.events[1].Threshold, ShouldEqual, 100)
+			So(receiver.events[1].CustomerID, ShouldEqual, "cus_123")
+			So(receiver.events[1].Plan, ShouldEqual, defaultPlan)
+			So(receiver.events[1].Scope, ShouldEqual, "*")
+
+			deliveries, err := AlertDeliveries(db, "cus_123")
+			So(err, ShouldBeNil)
+			So(deliveries, ShouldHaveLength, 2)
+			So(deliveries[0].Status, ShouldEqual, AlertDelivered)
+			So(deliveries[0].Attempts, ShouldEqual, 1)
+		})
+
+		Convey("Success - the customer's thresholds to the customer's endpoint", func() {
+			customer := &webhookReceiver{secret: "customer-secret"}
+			customerServer := httptest.NewServer(customer)
+			defer customerServer.Close()
+			err := SetCustomerAlerts(db, "cus_123", CustomerAlerts{Alerts: Alerts{Thresholds: []int64{80}, URL: customerServer.URL}, Secret: "customer-secret"})
+			So(err, ShouldBeNil)
+
+			for i := 0; i < 3; i++ {
+				So(request(), ShouldEqual, http.StatusOK)
+			}
+			So(receiver.events, ShouldBeEmpty)
+			So(customer.events, ShouldHaveLength, 1)
+			So(customer.errs, ShouldResemble, []error{nil})
+			So(customer.events[0].Threshold, ShouldEqual, 80)
+		})
+
+		Convey("Success - failed deliveries are retried", func() {
+			receiver.failures = 2
+			os.Setenv("ALERT_WEBHOOK_RETRIES", "3")
+			request()
+			request()
+			So(receiver.events, ShouldHaveLength, 1)
+			deliveries, _ := AlertDeliveries(db, "cus_123")
+			So(deliveries[0].Status, ShouldEqual, AlertDelivered)
+			So(deliveries[0].Attempts, ShouldEqual, 3)
+		})
+
+		Convey("Failure - all attempts failed (delivered later by RetryAlerts)", func() {
+			receiver.failures = 2
+			os.Setenv("ALERT_WEBHOOK_RETRIES", "2")
+			request()
+			request()
+			deliveries, _ := AlertDeliveries(db, "")
+			So(deliveries, ShouldHaveLength, 1)
+			So(deliveries[0].Status, ShouldEqual, AlertFailed)
+			So(deliveries[0].LastError, ShouldContainSubstring, "503")
+
+			delivered, err := RetryAlerts(db)
+			So(err, ShouldBeNil)
+			So(delivered, ShouldEqual, 1)
+			So(receiver.events, ShouldHaveLength, 1)
+			delivered, _ = RetryAlerts(db)
+			So(delivered, ShouldEqual, 0)
+		})
+	})
+
+	Convey("Run - alert deliveries in flight", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		// the receiver holds the first post until it is released
+		var posts int32
+		started := make(chan bool, 1)
+		release := make(chan bool)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if atomic.AddInt32(&posts, 1) == 1 {
+				started <- true
+				<-release
+			}
+		}))
+		defer server.Close()
+
+		viper.AutomaticEnv()
+		os.Setenv("ALERTS", "true")
+		os.Setenv("ALERT_WEBHOOK_URL", server.URL)
+		os.Setenv("ALERT_WEBHOOK_SECRET", "secret")
+		os.Setenv("QUOTA", "true")
+		os.Setenv("RBAC_VALIDATE", "false")
+		os.Setenv("STRIPE_VALIDATE", "false")
+		os.Setenv("STRIPE_JSON_PATH", "testdata/catalog.json")
+		defer os.Setenv("ALERTS", "")
+		defer os.Setenv("QUOTA", "")
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		identity := &Identity{Method: MethodAPIKey, Subject: "apikey|1", CustomerID: "cus_123"}
+		router.Use(Run(db, WithAuthenticator(&stubAuthenticator{identity: identity})))
+		router.GET("/users", func(c *gin.Context) {
+			c.String(http.StatusOK, "ok")
+		})
+		for i := 0; i < 2; i++ {
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/users", nil)
+			router.ServeHTTP(recorder, req)
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+		}
+		status := func() string {
+			deliveries, _ := AlertDeliveries(db, "cus_123")
+			So(deliveries, ShouldHaveLength, 1)
+			return deliveries[0].Status
+		}
+
+		Convey("Success - RetryAlerts skips the delivery sent after the call", func() {
+			<-started
+			So(status(), ShouldEqual, AlertSending)
+			delivered, err := RetryAlerts(db)
+			So(err, ShouldBeNil)
+			So(delivered, ShouldEqual, 0)
+			So(atomic.LoadInt32(&posts), ShouldEqual, 1)
+
+			close(release)
+			for i := 0; i < 100 && status() != AlertDelivered; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(status(), ShouldEqual, AlertDelivered)
+			delivered, _ = RetryAlerts(db)
+			So(delivered, ShouldEqual, 0)
+			So(atomic.LoadInt32(&posts), ShouldEqual, 1)
+		})
+
+		Convey("Success - a delivery whose lease expired is sent again", func() {
+			<-started
+			// e.g. the sender crashed while posting
+			db.Update(func(tx *buntdb.Tx) error {
+				var key, val string
+				tx.AscendKeys("apibillme:alert:delivery:*", func(k, v string) bool {
+					key, val = k, v
+					return false
+				})
+				var delivery AlertDelivery
+				json.Unmarshal([]byte(val), &delivery)
+				delivery.LeaseUntil = time.Now().Add(-time.Second)
+				return saveAlert(tx, key, &delivery)
+			})
+			delivered, err := RetryAlerts(db)
+			So(err, ShouldBeNil)
+			So(delivered, ShouldEqual, 1)
+			So(atomic.LoadInt32(&posts), ShouldEqual, 2)
+			close(release)
+		})
+	})
+
+	Convey("Run - spend cap alerts", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		receiver := &webhookReceiver{secret: "secret"}
+		server := httptest.NewServer(receiver)
+		defer server.Close()
+
+		viper.AutomaticEnv()
+		os.Setenv("ALERTS", "true")
+		os.Setenv("ALERT_WEBHOOK_SECRET", "secret")
+		os.Setenv("RBAC_VALIDATE", "false")
+		os.Setenv("STRIPE_VALIDATE", "true")
+		os.Setenv("STRIPE_JSON_PATH", "testdata/metering.json")
+		defer os.Setenv("ALERTS", "")
+
+		stub := stubby.Stub(&goAlert, func(deliver func()) { deliver() })
+		defer stub.Reset()
+		stubCharge := stubby.StubFunc(&restlyPostJSON, nil, nil)
+		defer stubCharge.Reset()
+
+		err = SetCustomerAlerts(db, "cus_123", CustomerAlerts{Alerts: Alerts{Thresholds: []int64{50, 100}, SpendCap: 20, URL: server.URL}})
+		So(err, ShouldBeNil)
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		identity := &Identity{Method: MethodAPIKey, Subject: "apikey|1", CustomerID: "cus_123"}
+		router.Use(Run(db, WithAuthenticator(&stubAuthenticator{identity: identity})))
+		router.POST("/reports", func(c *gin.Context) {
+			c.String(http.StatusOK, "ok")
+		})
+
+		Convey("Success - the charged units cross the thresholds of the spend cap", func() {
+			for i := 0; i < 3; i++ {
+				recorder := httptest.NewRecorder()
+				req, _ := http.NewRequest("POST", "/reports", nil)
+				router.ServeHTTP(recorder, req)
+				So(recorder.Code, ShouldEqual, http.StatusOK)
+			}
+			So(receiver.events, ShouldHaveLength, 2)
+			So(receiver.errs, ShouldResemble, []error{nil, nil})
+			So(receiver.events[0].Type, ShouldEqual, AlertSpend)
+			So(receiver.events[0].Used, ShouldEqual, 10)
+			So(receiver.events[1].Threshold, ShouldEqual, 100)
+			So(receiver.events[1].Limit, ShouldEqual, 20)
+		})
+	})
+}
@@ -1,14 +1,16 @@
 package apibillme
 
 import (
+	"context"
 	"errors"
-	"io/ioutil"
+	"log"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/apibillme/auth0"
-	"github.com/lestrrat-go/jwx/jwt"
-	"github.com/tidwall/gjson"
 
 	"github.com/tidwall/buntdb"
 
@@ -22,9 +24,10 @@ import (
 
 // for stubbing
 var restlyPostJSON = restly.PostJSON
-var auth0ValidateNet = auth0.ValidateNet
+var jwtValidateNet = validateNet
 var auth0GetEmail = auth0.GetEmail
 var auth0GetURLScopes = auth0.GetURLScopes
+var ledgerRecord = recordUsage
 
 func getBaseURLPath(URL string) string {
 	// only get the base url component of the URL (e.g. /[users]/12 to users)
@@ -33,9 +36,9 @@ func getBaseURLPath(URL string) string {
 	return urlPieces[0]
 }
 
-func validateRBAC(serverMethod string, serverBaseURL string, token *jwt.Token) error {
-	// extract scopes from access_token
-	scopes, err := auth0GetURLScopes(token)
+func validateRBAC(serverMethod string, serverBaseURL string, identity *Identity) error {
+	// extract scopes from access_token (or the scope set of the credentials)
+	scopes, err := urlScopes(identity)
 	if err != nil {
 		return err
 	}
@@ -55,88 +58,531 @@ func validateRBAC(serverMethod string, serverBaseURL string, token *jwt.Token) e
 	return nil
 }
 
-func searchStripeJSON(path string, serverMethod string, serverBaseURL string) (bool, error) {
-	// open stripe.json
-	jsonBytes, err := ioutil.ReadFile(path)
+// statusError - a rejection with another status than 401
+type statusError struct {
+	status  int
+	message string
+}
+
+func newStatusError(status int, message string) error {
+	return &statusError{status: status, message: message}
+}
+
+func (e *statusError) Error() string {
+	return e.message
+}
+
+// decisions (the reason codes of metrics and logs)
+const (
+	DecisionAllowed            = "allowed"
+	DecisionInvalidToken       = "invalid_token"
+	DecisionRevoked            = "revoked"
+	DecisionInsufficientScope  = "insufficient_scope"
+	DecisionRateLimited        = "rate_limited"
+	DecisionQuotaExceeded      = "quota_exceeded"
+	DecisionConcurrencyLimited = "concurrency_limited"
+	DecisionNoSubscription     = "no_subscription"
+	DecisionBadRequest         = "bad_request"
+	DecisionConfigError        = "config_error"
+	// DecisionBillingUnavailable - the billing circuit breaker is open (the call is not charged)
+	DecisionBillingUnavailable = "billing_unavailable"
+)
+
+// decision - the state of a request through the middleware stages
+type decision struct {
+	db *buntdb.DB
+	// reason - the decision (allowed or why the request was denied)
+	reason  string
+	metrics *Metrics
+	tracer  Tracer
+	// ctx - the context of the span of the request (the parent of the stage spans)
+	ctx   context.Context
+	audit *AuditLog
+	// auditErr - the last audit record of the call that could not be appended
+	auditErr error
+	// auditPruneErr - the retention of the audit log that could not be applied
+	auditPruneErr error
+	// ledgerErr - the ledger entry of the call that could not be written
+	ledgerErr error
+	// billingErr - why a served call was not charged (e.g. its units could not be metered)
+	billingErr error
+	requestID  string
+	// shadowDecisions - what the stages in shadow mode would have done
+	shadowDecisions []ShadowDecision
+	// shadowBilling - the billing stage is in shadow mode (charges are only recorded)
+	shadowBilling bool
+	// catalog - the catalog when a stage loaded it
+	catalog *Catalog
+	// entry, billing and units - the catalog entry, billing decision and units of the request (for the explanation)
+	entry         *CatalogEntry
+	billing       string
+	units         int64
+	identity      *Identity
+	serverMethod  string
+	serverBaseURL string
+	// headers - response headers set by the stages
+	headers http.Header
+	// quotaExceeded - the call is over a soft quota
+	quotaExceeded bool
+	// quota and quotaResult - the quota the call was counted on (given back if a later stage denies the call)
+	quota       *Quota
+	quotaResult *quotaResult
+	// release - give back the concurrency slot when the handler is done
+	release func()
+	// stripeKey - the key of the charges of the call
+	stripeKey string
+	// pendingCharge - the entry of a call charged when the handler is done
+	pendingCharge *CatalogEntry
+	// finish - record the decision of a call charged when the handler is done (logs, metrics, audit and explanation)
+	finish func()
+	// alerts - usage threshold alerts are on (planAlerts - the alerts of the plan of the caller)
+	alerts     bool
+	planAlerts *Alerts
+}
+
+// deny - set why the request was denied (misconfigured stages are config errors)
+func (d *decision) deny(reason string, err error) error {
+	d.reason = reason
+	if statusErr, ok := err.(*statusError); ok && statusErr.status == http.StatusInternalServerError {
+		d.reason = DecisionConfigError
+	}
+	return err
+}
+
+// startStage - start the span of a stage of the request
+func (d *decision) startStage(name string) Span {
+	_, span := startSpan(d.tracer, d.ctx, "apibillme."+name)
+	return span
+}
+
+// endStage - end the span of a stage (with the error of the stage)
+func endStage(span Span, err error) {
 	if err != nil {
-		return false, err
+		span.SetError(err)
+	}
+	span.End()
+}
+
+// charge - send the usage event of the call (and record it in the ledger if required by ENV VARS)
+func (d *decision) charge(units int64) error {
+	event := newUsageEvent(d.serverMethod, d.serverBaseURL, d.identity, units)
+	d.units = units
+	// in shadow mode the charge is only counted and recorded in the ledger
+	if d.shadowBilling {
+		d.billing = BillingShadow
+		d.shadow(ShadowBilling, ShadowCharged, units)
+		d.record(event, LedgerShadow, true)
+		return nil
+	}
+	span := d.startStage("billing")
+	span.SetAttribute(AttributeBillingBackend, "apibill.me")
+	span.SetAttribute(AttributeUnits, units)
+	header := http.Header{}
+	span.Inject(header)
+	done := d.metrics.billing(d.serverMethod, d.serverBaseURL)
+	err := charge(d.stripeKey, event, header)
+	done(err)
+	endStage(span, err)
+	status := LedgerCharged
+	if err != nil {
+		status = LedgerFailed
+	}
+	d.billing = status
+	if err == nil && d.alerts {
+		d.alertSpend(units)
 	}
+	// the call is served unless the charge failed before the handler of a scope that fails closed
+	d.record(event, status, err == nil || d.pendingCharge != nil || d.entry.FailPolicy == FailOpen)
+	d.audit.auditCharge(d, event, status)
+	return err
+}
 
-	// check if any of the baseURL(s) match with the method called
-	matched := false
-	result := gjson.ParseBytes(jsonBytes)
-	baseURLs := result.Get(`scopes.#[method=="` + serverMethod + `"]#.baseURL`)
+// record - record the usage in the ledger (with ledger on - a failed write is counted and logged with the decision)
+func (d *decision) record(event usageEvent, status string, served bool) {
+	if !cast.ToBool(viper.Get("ledger")) {
+		return
+	}
+	_, err := ledgerRecord(d.db, event, status, served, time.Now())
+	if err != nil {
+		d.metrics.add("apibillme_ledger_errors_total", 1, status)
+		d.ledgerErr = err
+	}
+}
 
-	for _, baseURL := range baseURLs.Array() {
-		if baseURL.String() == serverBaseURL {
-			matched = true
-		}
+// authorize - verify the subscription before the handler (for calls charged when the handler is done - a verified one is reused for billing_subscription_ttl)
+func (d *decision) authorize() error {
+	scope := d.serverMethod + ":" + d.serverBaseURL
+	if subscriptionVerified(d.db, d.identity.CustomerID, scope) {
+		return nil
+	}
+	span := d.startStage("authorize")
+	span.SetAttribute(AttributeBillingBackend, "apibill.me")
+	header := http.Header{}
+	span.Inject(header)
+	err := verifySubscription(d.stripeKey, newUsageEvent(d.serverMethod, d.serverBaseURL, d.identity, 0), header)
+	endStage(span, err)
+	if err == nil {
+		saveSubscription(d.db, d.identity.CustomerID, scope)
 	}
-	return matched, nil
+	return err
 }
 
-func processRequest(db *buntdb.DB, req *http.Request) error {
+// unmetered - record a served call whose units could not be metered (it is not charged)
+func (d *decision) unmetered(err error) {
+	event := newUsageEvent(d.serverMethod, d.serverBaseURL, d.identity, 0)
+	d.billing = LedgerUnmetered
+	d.billingErr = err
+	d.record(event, LedgerUnmetered, true)
+	d.audit.auditCharge(d, event, LedgerUnmetered)
+}
+
+// Option - configure the middleware
+type Option func(*options)
+
+type options struct {
+	provider       Provider
+	authenticators []Authenticator
+	tokenSources   []TokenSource
+	metrics        *Metrics
+	tracer         Tracer
+	log            decisionLog
+	audit          *AuditLog
+}
+
+// WithProvider - use an identity provider instead of the one set by ENV VARS
+func WithProvider(provider Provider) Option {
+	return func(o *options) {
+		o.provider = provider
+	}
+}
+
+// WithAuthenticator - authenticate with a custom authenticator (tried before the ones set by ENV VARS)
+func WithAuthenticator(authenticator Authenticator) Option {
+	return func(o *options) {
+		o.authenticators = append(o.authenticators, authenticator)
+	}
+}
+
+// WithTokenSources - find the access_token in these sources in order instead of the ones set by ENV VARS
+func WithTokenSources(sources ...TokenSource) Option {
+	return func(o *options) {
+		o.tokenSources = sources
+	}
+}
+
+// WithMetrics - collect metrics of the decisions, the token cache and the billing calls
+func WithMetrics(metrics *Metrics) Option {
+	return func(o *options) {
+		o.metrics = metrics
+	}
+}
+
+// WithTracer - trace the stages of the middleware as spans (e.g. an OpenTelemetry adapter)
+func WithTracer(tracer Tracer) Option {
+	return func(o *options) {
+		o.tracer = tracer
+	}
+}
+
+// WithAuditLog - append the authorization and billing events to a tamper-evident audit log
+func WithAuditLog(audit *AuditLog) Option {
+	return func(o *options) {
+		o.audit = audit
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.provider == nil {
+		o.provider = providerFromConfig()
+	}
+	if o.tokenSources == nil {
+		o.tokenSources = tokenSourcesFromConfig()
+	}
+	if o.tracer == nil {
+		o.tracer = noopTracer{}
+	}
+	logFromConfig(&o.log)
+	if cast.ToBool(viper.Get("hmac_auth")) {
+		o.authenticators = append(o.authenticators, &HMACAuthenticator{})
+	}
+	if cast.ToBool(viper.Get("api_key_auth")) {
+		o.authenticators = append(o.authenticators, &APIKeyAuthenticator{})
+	}
+	if cast.ToBool(viper.Get("mtls_auth")) {
+		o.authenticators = append(o.authenticators, &MTLSAuthenticator{})
+	}
+	if cast.ToBool(viper.Get("introspection_auth")) {
+		introspection := introspectionFromConfig()
+		introspection.Sources = o.tokenSources
+		o.authenticators = append(o.authenticators, introspection)
+	}
+	// the access_token is the default credential
+	o.authenticators = append(o.authenticators, &JWTAuthenticator{Provider: o.provider, Sources: o.tokenSources, metrics: o.metrics})
+	return o
+}
+
+func processRequest(db *buntdb.DB, req *http.Request, opts ...Option) (*decision, error) {
 	// viper auto config
 	viper.AutomaticEnv()
-	auth0JWK := cast.ToString(viper.Get("auth0_jwk"))
-	auth0Audience := cast.ToString(viper.Get("auth0_audience"))
-	auth0Issuer := cast.ToString(viper.Get("auth0_issuer"))
+	return decide(db, req, newOptions(opts))
+}
 
-	// validate JWT on Auth0 and return token
-	token, err := auth0ValidateNet(db, auth0JWK, auth0Audience, auth0Issuer, req)
+// usesCatalog - whether a stage of the scope needs the catalog (rate limits, quotas, concurrency limits or billing)
+func usesCatalog(serverMethod string, serverBaseURL string) bool {
+	return cast.ToBool(viper.Get("rate_limit")) || cast.ToBool(viper.Get("quota")) || cast.ToBool(viper.Get("concurrency_limit")) || cast.ToBool(viper.Get("stripe_validate")) || inShadow("stripe_shadow", serverMethod, serverBaseURL)
+}
 
+// decide - process the request with the options built by Run
+func decide(db *buntdb.DB, req *http.Request, o *options) (d *decision, err error) {
+	audit := o.audit
+	if audit == nil {
+		audit = auditLogFromConfig(db)
+	}
+	d = &decision{db: db, headers: http.Header{}, metrics: o.metrics, tracer: o.tracer, audit: audit, reason: DecisionAllowed}
+	// in debug mode the stages are timed for the explanation of the decision
+	debug := debugMode()
+	var stages *stageTimer
+	if debug {
+		stages = &stageTimer{Tracer: o.tracer}
+		d.tracer = stages
+	}
+	if o.log.logger != nil || audit != nil || debug {
+		d.requestID = requestID(req, d)
+	}
+	start := time.Now()
+	parent := req.Context()
+	ctx, span := startSpan(d.tracer, parent, "apibillme.request")
+	d.ctx = ctx
+	var latency time.Duration
+	finish := func() {
+		span.SetAttribute(AttributeScope, d.serverMethod+":"+d.serverBaseURL)
+		span.SetAttribute(AttributeDecision, d.reason)
+		if len(d.shadowDecisions) > 0 {
+			span.SetAttribute(AttributeShadow, d.shadowSummary())
+		}
+		span.End()
+		if d.pendingCharge != nil && err == nil {
+			audit.auditAuthorization(d)
+		}
+		o.metrics.decided(d, latency)
+		o.log.log(req, d, err, latency)
+		if debug {
+			explain(req, d, err, latency, stages)
+		}
+	}
+	defer func() {
+		// the decision is audited before the quota is settled (a call that cannot be audited is denied with audit_fail_closed)
+		// calls charged when the handler is done are audited with the charge (see finish)
+		if d.pendingCharge == nil || err != nil {
+			auditErr := audit.auditAuthorization(d)
+			if auditErr != nil && err == nil && cast.ToBool(viper.Get("audit_fail_closed")) {
+				err = d.deny(DecisionConfigError, newStatusError(http.StatusInternalServerError, "Audit log is unavailable - contact your admin"))
+			}
+		}
+		d.settleQuota(err)
+		latency = time.Since(start)
+		// calls charged when the handler is done are recorded with the result of the charge (see meter)
+		if d.pendingCharge != nil && err == nil {
+			d.finish = finish
+			// the header is sent before the handler (the explain endpoint has the charge)
+			if debug {
+				d.headers.Set("X-Apibillme-Decision", newExplanation(req, d, err, latency, stages).header())
+			}
+			return
+		}
+		finish()
+	}()
+
+	// get server URL (without the query) & Method
+	serverURL := strings.ToLower(req.URL.Path)
+	d.serverBaseURL = getBaseURLPath(serverURL)
+	d.serverMethod = strings.ToLower(req.Method)
+
+	// authenticate the caller (JWT on the identity provider by default)
+	// the authenticators see the stage span in the request context (for the trace context of discovery and introspection)
+	authCtx, authSpan := startSpan(d.tracer, ctx, "apibillme.authenticate")
+	*req = *req.WithContext(authCtx)
+	identity, err := authenticate(db, req, o.authenticators)
+	*req = *req.WithContext(parent)
+	if identity != nil {
+		authSpan.SetAttribute(AttributeAuthMethod, identity.Method)
+	}
+	endStage(authSpan, err)
+	// query parameter tokens must not reach logs or handlers
+	stripQueryTokens(req, o.tokenSources)
 	if err != nil {
-		return errors.New("Unauthorized - Invalid Token")
+		return d, d.deny(DecisionInvalidToken, err)
 	}
+	d.identity = identity
 
-	// get server URL & Method
-	serverURL := strings.ToLower(req.URL.String())
-	serverBaseURL := getBaseURLPath(serverURL)
-	serverMethod := strings.ToLower(req.Method)
+	// reject revoked tokens, subjects, emails and customers
+	// billing is resolved once here so the email and customer can be checked (its error denies billable scopes later)
+	stage := d.startStage("revocation")
+	billingErr := resolveBilling(db, identity, o.provider)
+	revoked := isRevoked(db, identity)
+	endStage(stage, nil)
+	if revoked {
+		return d, d.deny(DecisionRevoked, errors.New("Unauthorized - Access Revoked"))
+	}
 
-	// validate RBAC if required by ENV VARS
-	useRBAC := cast.ToBool(viper.Get("rbac_validate"))
+	// validate RBAC if required by ENV VARS (in shadow mode a denial is only recorded)
+	shadowRBAC := inShadow("rbac_shadow", d.serverMethod, d.serverBaseURL)
+	useRBAC := cast.ToBool(viper.Get("rbac_validate")) || shadowRBAC
 	if useRBAC {
-		err := validateRBAC(serverMethod, serverBaseURL, token)
+		stage := d.startStage("rbac")
+		err := validateRBAC(d.serverMethod, d.serverBaseURL, identity)
+		endStage(stage, err)
+		if err != nil && shadowRBAC {
+			d.shadow(ShadowRBAC, DecisionInsufficientScope, 0)
+		} else if err != nil {
+			return d, d.deny(DecisionInsufficientScope, errors.New("Unauthorized - Invalid Scope Permissions"))
+		}
+	}
+
+	// load the catalog (stripe.json) if a stage needs it
+	useRateLimit := cast.ToBool(viper.Get("rate_limit"))
+	useQuota := cast.ToBool(viper.Get("quota"))
+	useConcurrency := cast.ToBool(viper.Get("concurrency_limit"))
+	d.shadowBilling = inShadow("stripe_shadow", d.serverMethod, d.serverBaseURL)
+	useStripe := cast.ToBool(viper.Get("stripe_validate")) || d.shadowBilling
+	var catalog *Catalog
+	if usesCatalog(d.serverMethod, d.serverBaseURL) {
+		stage := d.startStage("catalog")
+		stage.SetAttribute(AttributeCatalogPath, cast.ToString(viper.Get("stripe_json_path")))
+		catalog, err = catalogFromConfig(db)
+		endStage(stage, err)
+		if err != nil {
+			return d, d.deny(DecisionConfigError, errors.New("Unauthorized - cannot find stripe.json on server - contact your admin"))
+		}
+		identity.Plan = resolvePlan(db, identity)
+		d.catalog = catalog
+		d.entry = catalog.entry(d.serverMethod, d.serverBaseURL)
+		// usage threshold alerts if required by ENV VARS
+		d.alerts = cast.ToBool(viper.Get("alerts"))
+		if d.alerts {
+			d.planAlerts = catalog.alerts(identity.Plan)
+		}
+	}
+
+	// rate limit if required by ENV VARS
+	var limits Limits
+	if catalog != nil {
+		limits = catalog.limits(identity.Plan, d.serverMethod, d.serverBaseURL)
+	}
+	if useRateLimit && limits.RateLimit != nil {
+		stage := d.startStage("rate_limit")
+		err := checkRateLimit(bucketStoreFromConfig(db), d, limits.RateLimit)
+		endStage(stage, err)
+		if err != nil {
+			return d, d.deny(DecisionRateLimited, err)
+		}
+	}
+
+	// enforce the quota of the plan if required by ENV VARS (the quota of a plan only counts the billable scopes of the catalog)
+	if useQuota && limits.Quota != nil && (limits.Quota.scoped || catalog.billable(d.serverMethod, d.serverBaseURL)) {
+		stage := d.startStage("quota")
+		err := checkQuota(db, d, limits.Quota)
+		endStage(stage, err)
 		if err != nil {
-			return errors.New("Unauthorized - Invalid Scope Permissions")
+			return d, d.deny(DecisionQuotaExceeded, err)
+		}
+	}
+
+	// limit the requests in flight if required by ENV VARS (the slot is held until the handler is done)
+	if useConcurrency && limits.Concurrency != nil {
+		stage := d.startStage("concurrency")
+		err := checkConcurrency(req, d, limits.Concurrency)
+		endStage(stage, err)
+		if err != nil {
+			return d, d.deny(DecisionConcurrencyLimited, err)
 		}
 	}
 
 	// validate Stripe if required by ENV VARS
-	useStripe := cast.ToBool(viper.Get("stripe_validate"))
-	if useStripe {
-		stripeKey := cast.ToString(viper.Get("stripe_key"))
-		stripeJSONPath := cast.ToString(viper.Get("stripe_json_path"))
-		runStripe, err := searchStripeJSON(stripeJSONPath, serverMethod, serverBaseURL)
+	d.billing = BillingOff
+	if useStripe && !catalog.billable(d.serverMethod, d.serverBaseURL) {
+		d.billing = BillingNotBillable
+	}
+	if useStripe && catalog.billable(d.serverMethod, d.serverBaseURL) {
+		d.stripeKey = cast.ToString(viper.Get("stripe_key"))
+		err := billingErr
 		if err != nil {
-			return errors.New("Unauthorized - cannot find stripe.json on server - contact your admin")
+			d.billing = DecisionNoSubscription
 		}
-		if runStripe {
-			userEmail, err := auth0GetEmail(token, auth0Audience)
-			if err != nil {
-				return errors.New("Unauthorized - cannot get email address from token")
-			}
-			body := `{"serverMethod":"` + serverMethod + `", "serverBaseURL":"` + serverBaseURL + `", "userEmail":"` + userEmail + `"}`
-			req := restly.New()
-			req.Header.Add("x-stripe-key", stripeKey)
-			_, err = restlyPostJSON(req, "https://api.apibill.me/charge", body)
-			if err != nil {
-				return errors.New("Unauthorized - No Active Subscription to this URL")
+		if err != nil && d.shadowBilling {
+			d.shadow(ShadowBilling, DecisionNoSubscription, 0)
+			return d, nil
+		} else if err != nil {
+			return d, d.deny(DecisionNoSubscription, err)
+		}
+		// units from the response or the handler are charged when the handler is done
+		entry := d.entry
+		if entry.Metering.afterHandler() {
+			d.billing = BillingAfterHandler
+			// the subscription is verified before the handler (a failed one is let through when the scope fails open)
+			if !d.shadowBilling {
+				err := d.authorize()
+				if err != nil && entry.FailPolicy != FailOpen {
+					d.billing = DecisionNoSubscription
+					return d, d.deny(DecisionNoSubscription, errors.New("Unauthorized - No Active Subscription to this URL"))
+				}
 			}
+			d.pendingCharge = entry
+			return d, nil
+		}
+		units, err := requestUnits(req, entry)
+		if err != nil {
+			d.billing = DecisionBadRequest
+		}
+		if err != nil && d.shadowBilling {
+			d.shadow(ShadowBilling, DecisionBadRequest, 0)
+			return d, nil
+		} else if err != nil {
+			return d, d.deny(DecisionBadRequest, newStatusError(http.StatusBadRequest, "Bad Request - cannot meter the request"))
+		}
+		// a failed charge is let through when the scope fails open (it is still recorded as failed)
+		err = d.charge(units)
+		// the billing backend is failing - not the subscription of the customer
+		if err == errBreakerOpen && entry.FailPolicy != FailOpen {
+			d.headers.Set("Retry-After", strconv.FormatInt(int64(math.Ceil(breakerRetryAfter(time.Now()).Seconds())), 10))
+			return d, d.deny(DecisionBillingUnavailable, newStatusError(http.StatusServiceUnavailable, "Service Unavailable - billing is unavailable"))
+		}
+		if err != nil && entry.FailPolicy != FailOpen {
+			return d, d.deny(DecisionNoSubscription, errors.New("Unauthorized - No Active Subscription to this URL"))
 		}
 	}
-	return nil
+	return d, nil
 }
 
-// Run - process apibill.me request (Auth0 and Stripe)
-func Run(db *buntdb.DB) gin.HandlerFunc {
+// Run - process apibill.me request (Auth0/OIDC and Stripe)
+func Run(db *buntdb.DB, opts ...Option) gin.HandlerFunc {
+	// debug mode must never be on in production
+	viper.AutomaticEnv()
+	if setting := productionSetting(); cast.ToBool(viper.Get("debug_mode")) && setting != "" {
+		log.Panic("apibillme: debug_mode cannot be on with " + setting)
+	}
+	// the options (e.g. the token sources) are built once
+	o := newOptions(opts)
 	return func(c *gin.Context) {
-		err := processRequest(db, c.Request)
+		d, err := decide(db, c.Request, o)
+		if d.release != nil {
+			defer d.release()
+		}
+		for key := range d.headers {
+			c.Header(key, d.headers.Get(key))
+		}
 		if err != nil {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			status := http.StatusUnauthorized
+			if statusErr, ok := err.(*statusError); ok {
+				status = statusErr.status
+			}
+			c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
 			return // have to return to stop middleware
 		}
-		c.Next()
+		d.meter(c)
 	}
 }
@@ -28,9 +28,10 @@ func TestSpec(t *testing.T) {
 		Convey("Success", func() {
 			ctx, err := http.NewRequest("GET", "/users/12", nil)
 			So(err, ShouldBeNil)
+			ctx.Header.Set("Authorization", "Bearer "+jwtTokenFull)
 			token, err := jwt.ParseString(jwtTokenFull)
 			So(err, ShouldBeNil)
-			stub1 := stubby.StubFunc(&auth0ValidateNet, token, nil)
+			stub1 := stubby.StubFunc(&jwtValidateNet, token, nil)
 			defer stub1.Reset()
 			stub2 := stubby.StubFunc(&restlyPostJSON, nil, nil)
 			defer stub2.Reset()
@@ -40,14 +41,15 @@ func TestSpec(t *testing.T) {
 			os.Setenv("STRIPE_VALIDATE", "true")
 			os.Setenv("STRIPE_JSON_PATH", "testdata/stripe.json")
 
-			err = processRequest(db, ctx)
+			_, err = processRequest(db, ctx)
 			So(err, ShouldBeNil)
 		})
 
 		Convey("Failure - cannot validate token", func() {
 			ctx, err := http.NewRequest("GET", "/users/12", nil)
 			So(err, ShouldBeNil)
-			stub1 := stubby.StubFunc(&auth0ValidateNet, nil, errors.New("foobar"))
+			ctx.Header.Set("Authorization", "Bearer "+jwtTokenFull)
+			stub1 := stubby.StubFunc(&jwtValidateNet, nil, errors.New("foobar"))
 			defer stub1.Reset()
 			stub2 := stubby.StubFunc(&restlyPostJSON, nil, nil)
 			defer stub2.Reset()
@@ -57,16 +59,17 @@ func TestSpec(t *testing.T) {
 			os.Setenv("STRIPE_VALIDATE", "true")
 			os.Setenv("STRIPE_JSON_PATH", "testdata/stripe.json")
 
-			err = processRequest(db, ctx)
+			_, err = processRequest(db, ctx)
 			So(err, ShouldBeError)
 		})
 
 		Convey("Failure - cannot get email from token", func() {
 			ctx, err := http.NewRequest("GET", "/users/12", nil)
 			So(err, ShouldBeNil)
+			ctx.Header.Set("Authorization", "Bearer "+jwtTokenFull)
 			token, err := jwt.ParseString(jwtTokenFull)
 			So(err, ShouldBeNil)
-			stub1 := stubby.StubFunc(&auth0ValidateNet, token, nil)
+			stub1 := stubby.StubFunc(&jwtValidateNet, token, nil)
 			defer stub1.Reset()
 			stub2 := stubby.StubFunc(&restlyPostJSON, nil, nil)
 			defer stub2.Reset()
@@ -76,16 +79,40 @@ func TestSpec(t *testing.T) {
 			os.Setenv("STRIPE_VALIDATE", "true")
 			os.Setenv("STRIPE_JSON_PATH", "testdata/stripe.json")
 
-			err = processRequest(db, ctx)
+			_, err = processRequest(db, ctx)
 			So(err, ShouldBeError)
 		})
 
+		Convey("Failure - billing is resolved once per request", func() {
+			ctx, err := http.NewRequest("GET", "/users/12", nil)
+			So(err, ShouldBeNil)
+			ctx.Header.Set("Authorization", "Bearer "+jwtTokenFull)
+			token, err := jwt.ParseString(jwtTokenFull)
+			So(err, ShouldBeNil)
+			stub1 := stubby.StubFunc(&jwtValidateNet, token, nil)
+			defer stub1.Reset()
+			lookups := 0
+			stub3 := stubby.Stub(&auth0GetEmail, func(token *jwt.Token, audience string) (string, error) {
+				lookups++
+				return "", errors.New("email parsing failed")
+			})
+			defer stub3.Reset()
+			os.Setenv("RBAC_VALIDATE", "true")
+			os.Setenv("STRIPE_VALIDATE", "true")
+			os.Setenv("STRIPE_JSON_PATH", "testdata/stripe.json")
+
+			_, err = processRequest(db, ctx)
+			So(err, ShouldBeError)
+			So(lookups, ShouldEqual, 1)
+		})
+
 		Convey("Failure - stripe fails to find product", func() {
 			ctx, err := http.NewRequest("GET", "/users/12", nil)
 			So(err, ShouldBeNil)
+			ctx.Header.Set("Authorization", "Bearer "+jwtTokenFull)
 			token, err := jwt.ParseString(jwtTokenFull)
 			So(err, ShouldBeNil)
-			stub1 := stubby.StubFunc(&auth0ValidateNet, token, nil)
+			stub1 := stubby.StubFunc(&jwtValidateNet, token, nil)
 			defer stub1.Reset()
 			stub2 := stubby.StubFunc(&restlyPostJSON, nil, errors.New("random error"))
 			defer stub2.Reset()
@@ -95,16 +122,17 @@ func TestSpec(t *testing.T) {
 			os.Setenv("STRIPE_VALIDATE", "true")
 			os.Setenv("STRIPE_JSON_PATH", "testdata/stripe.json")
 
-			err = processRequest(db, ctx)
+			_, err = processRequest(db, ctx)
 			So(err, ShouldBeError)
 		})
 
 		Convey("Failure - RBAC failed due to invalid path", func() {
 			ctx, err := http.NewRequest("GET", "/foobar/12", nil)
 			So(err, ShouldBeNil)
+			ctx.Header.Set("Authorization", "Bearer "+jwtTokenFull)
 			token, err := jwt.ParseString(jwtTokenFull)
 			So(err, ShouldBeNil)
-			stub1 := stubby.StubFunc(&auth0ValidateNet, token, nil)
+			stub1 := stubby.StubFunc(&jwtValidateNet, token, nil)
 			defer stub1.Reset()
 			stub2 := stubby.StubFunc(&restlyPostJSON, nil, nil)
 			defer stub2.Reset()
@@ -112,16 +140,17 @@ func TestSpec(t *testing.T) {
 			defer stub3.Reset()
 			os.Setenv("RBAC_VALIDATE", "true")
 
-			err = processRequest(db, ctx)
+			_, err = processRequest(db, ctx)
 			So(err, ShouldBeError)
 		})
 
 		Convey("Failure - RBAC failed due to GetURLScopes failure", func() {
 			ctx, err := http.NewRequest("GET", "/foobar/12", nil)
 			So(err, ShouldBeNil)
+			ctx.Header.Set("Authorization", "Bearer "+jwtTokenFull)
 			token, err := jwt.ParseString(jwtTokenFull)
 			So(err, ShouldBeNil)
-			stub1 := stubby.StubFunc(&auth0ValidateNet, token, nil)
+			stub1 := stubby.StubFunc(&jwtValidateNet, token, nil)
 			defer stub1.Reset()
 			stub2 := stubby.StubFunc(&restlyPostJSON, nil, nil)
 			defer stub2.Reset()
@@ -132,16 +161,17 @@ func TestSpec(t *testing.T) {
 
 			os.Setenv("RBAC_VALIDATE", "true")
 
-			err = processRequest(db, ctx)
+			_, err = processRequest(db, ctx)
 			So(err, ShouldBeError)
 		})
 
 		Convey("Failure - cannot find stripe.json", func() {
 			ctx, err := http.NewRequest("GET", "/users/12", nil)
 			So(err, ShouldBeNil)
+			ctx.Header.Set("Authorization", "Bearer "+jwtTokenFull)
 			token, err := jwt.ParseString(jwtTokenFull)
 			So(err, ShouldBeNil)
-			stub1 := stubby.StubFunc(&auth0ValidateNet, token, nil)
+			stub1 := stubby.StubFunc(&jwtValidateNet, token, nil)
 			defer stub1.Reset()
 			stub2 := stubby.StubFunc(&restlyPostJSON, nil, nil)
 			defer stub2.Reset()
@@ -151,7 +181,7 @@ func TestSpec(t *testing.T) {
 			os.Setenv("STRIPE_VALIDATE", "true")
 			os.Setenv("STRIPE_JSON_PATH", "testdata/foobar.json")
 
-			err = processRequest(db, ctx)
+			_, err = processRequest(db, ctx)
 			So(err, ShouldBeError)
 		})
 	})
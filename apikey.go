@@ -0,0 +1,184 @@
+package apibillme
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+// apiKeyPrefix - the prefix of issued API keys (abm_<id>_<secret>)
+const apiKeyPrefix = "abm_"
+
+// APIKey - an issued API key - only the hash of its secret is stored
+type APIKey struct {
+	// ID - the public prefix of the key that identifies it
+	ID string `json:"id"`
+	// Hash - SHA-256 of the secret
+	Hash string `json:"hash"`
+	// CustomerID - the billing customer of the key
+	CustomerID string `json:"customerID"`
+	// Scopes - the scopes of the key (e.g. get:users)
+	Scopes []string `json:"scopes"`
+	// Expires - when the key expires (zero never expires)
+	Expires time.Time `json:"expires"`
+	// Created - when the key (or its last rotation) was issued
+	Created time.Time `json:"created"`
+}
+
+func apiKeyKey(id string) string {
+	return "apibillme:apikey:" + id
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newSecret - set a new secret hash on the key and return the full API key
+func (k *APIKey) newSecret() (string, error) {
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+	k.Hash = hashSecret(secret)
+	k.Created = time.Now().UTC()
+	return apiKeyPrefix + k.ID + "_" + secret, nil
+}
+
+func saveAPIKey(db *buntdb.DB, key *APIKey) error {
+	jsonBytes, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(apiKeyKey(key.ID), string(jsonBytes), nil)
+		return err
+	})
+}
+
+// CreateAPIKey - issue an API key for a billing customer and scopes - the returned key is only shown once
+func CreateAPIKey(db *buntdb.DB, customerID string, scopes []string, expires time.Time) (string, *APIKey, error) {
+	if customerID == "" {
+		return "", nil, errors.New("customer ID is required")
+	}
+	id, err := randomHex(6)
+	if err != nil {
+		return "", nil, err
+	}
+	key := &APIKey{ID: id, CustomerID: customerID, Scopes: scopes, Expires: expires}
+	apiKey, err := key.newSecret()
+	if err != nil {
+		return "", nil, err
+	}
+	err = saveAPIKey(db, key)
+	if err != nil {
+		return "", nil, err
+	}
+	return apiKey, key, nil
+}
+
+// GetAPIKey - get an API key by its ID
+func GetAPIKey(db *buntdb.DB, id string) (*APIKey, error) {
+	var key APIKey
+	err := db.View(func(tx *buntdb.Tx) error {
+		val, err := tx.Get(apiKeyKey(id))
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal([]byte(val), &key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// RotateAPIKey - issue a new secret for an API key - the old secret stops working immediately
+func RotateAPIKey(db *buntdb.DB, id string) (string, error) {
+	key, err := GetAPIKey(db, id)
+	if err != nil {
+		return "", err
+	}
+	apiKey, err := key.newSecret()
+	if err != nil {
+		return "", err
+	}
+	return apiKey, saveAPIKey(db, key)
+}
+
+// RevokeAPIKey - delete an API key
+func RevokeAPIKey(db *buntdb.DB, id string) error {
+	return db.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete(apiKeyKey(id))
+		return err
+	})
+}
+
+// extractAPIKey - get the API key from Authorization: ApiKey <key> or X-API-Key
+func extractAPIKey(req *http.Request) string {
+	tokenParts := strings.Fields(req.Header.Get("Authorization"))
+	if len(tokenParts) == 2 && strings.EqualFold(tokenParts[0], "ApiKey") {
+		return tokenParts[1]
+	}
+	return strings.TrimSpace(req.Header.Get("X-API-Key"))
+}
+
+// verifyAPIKey - verify an API key against its stored hash and expiry
+func verifyAPIKey(db *buntdb.DB, apiKey string) (*APIKey, error) {
+	if !strings.HasPrefix(apiKey, apiKeyPrefix) {
+		return nil, errors.New("API key has an invalid prefix")
+	}
+	parts := strings.SplitN(strings.TrimPrefix(apiKey, apiKeyPrefix), "_", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("API key is malformed")
+	}
+	key, err := GetAPIKey(db, parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(parts[1])), []byte(key.Hash)) != 1 {
+		return nil, errors.New("API key secret does not match")
+	}
+	if !key.Expires.IsZero() && time.Now().After(key.Expires) {
+		return nil, errors.New("API key has expired")
+	}
+	return key, nil
+}
+
+// APIKeyAuthenticator - authenticates API keys presented as Authorization: ApiKey <key> or X-API-Key
+type APIKeyAuthenticator struct{}
+
+// Authenticate - verify the API key and return its identity
+func (a *APIKeyAuthenticator) Authenticate(db *buntdb.DB, req *http.Request) (*Identity, error) {
+	apiKey := extractAPIKey(req)
+	if apiKey == "" {
+		return nil, errNoCredentials
+	}
+	key, err := verifyAPIKey(db, apiKey)
+	if err != nil {
+		return nil, errors.New("Unauthorized - Invalid API Key")
+	}
+	return &Identity{
+		Method:     MethodAPIKey,
+		Subject:    "apikey|" + key.ID,
+		CustomerID: key.CustomerID,
+		Scopes:     key.Scopes,
+	}, nil
+}
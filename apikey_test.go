@@ -0,0 +1,103 @@
+package apibillme
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+)
+
+func TestAPIKey(t *testing.T) {
+
+	Convey("APIKeyAuthenticator", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		apiKey, key, err := CreateAPIKey(db, "cus_123", []string{"get:users"}, time.Time{})
+		So(err, ShouldBeNil)
+		So(apiKey, ShouldStartWith, "abm_"+key.ID+"_")
+		So(key.Hash, ShouldNotContainSubstring, apiKey)
+
+		req, err := http.NewRequest("GET", "/users/12", nil)
+		So(err, ShouldBeNil)
+		authenticator := &APIKeyAuthenticator{}
+
+		Convey("Success - X-API-Key header", func() {
+			req.Header.Set("X-API-Key", apiKey)
+			identity, err := authenticator.Authenticate(db, req)
+			So(err, ShouldBeNil)
+			So(identity.Method, ShouldEqual, MethodAPIKey)
+			So(identity.CustomerID, ShouldEqual, "cus_123")
+			So(identity.Scopes, ShouldResemble, []string{"get:users"})
+		})
+
+		Convey("Success - Authorization: ApiKey header", func() {
+			req.Header.Set("Authorization", "apikey "+apiKey)
+			_, err := authenticator.Authenticate(db, req)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Success - rotated key works and the old secret does not", func() {
+			rotated, err := RotateAPIKey(db, key.ID)
+			So(err, ShouldBeNil)
+			req.Header.Set("X-API-Key", rotated)
+			_, err = authenticator.Authenticate(db, req)
+			So(err, ShouldBeNil)
+			req.Header.Set("X-API-Key", apiKey)
+			_, err = authenticator.Authenticate(db, req)
+			So(err, ShouldBeError)
+		})
+
+		Convey("Failure - no API key", func() {
+			_, err := authenticator.Authenticate(db, req)
+			So(err, ShouldEqual, errNoCredentials)
+		})
+
+		Convey("Failure - revoked key", func() {
+			err := RevokeAPIKey(db, key.ID)
+			So(err, ShouldBeNil)
+			req.Header.Set("X-API-Key", apiKey)
+			_, err = authenticator.Authenticate(db, req)
+			So(err, ShouldBeError)
+		})
+
+		Convey("Failure - wrong secret", func() {
+			req.Header.Set("X-API-Key", "abm_"+key.ID+"_foobar")
+			_, err := authenticator.Authenticate(db, req)
+			So(err, ShouldBeError)
+		})
+
+		Convey("Failure - expired key", func() {
+			expired, _, err := CreateAPIKey(db, "cus_123", []string{"get:users"}, time.Now().Add(-time.Minute))
+			So(err, ShouldBeNil)
+			req.Header.Set("X-API-Key", expired)
+			_, err = authenticator.Authenticate(db, req)
+			So(err, ShouldBeError)
+		})
+
+		Convey("processRequest - API key goes through RBAC", func() {
+			viper.AutomaticEnv()
+			os.Setenv("API_KEY_AUTH", "true")
+			os.Setenv("RBAC_VALIDATE", "true")
+			os.Setenv("STRIPE_VALIDATE", "false")
+			defer os.Setenv("API_KEY_AUTH", "")
+			req.Header.Set("X-API-Key", apiKey)
+			_, err := processRequest(db, req)
+			So(err, ShouldBeNil)
+
+			req, _ = http.NewRequest("POST", "/users", nil)
+			req.Header.Set("X-API-Key", apiKey)
+			_, err = processRequest(db, req)
+			So(err, ShouldBeError)
+		})
+	})
+}
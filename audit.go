@@ -0,0 +1,568 @@
+package apibillme
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+)
+
+// audit record types
+const (
+	AuditAuthorization = "authorization"
+	AuditCharge        = "charge"
+)
+
+// AuditRecord - an authorization or billing event in the audit log - Hash chains it to the previous record
+type AuditRecord struct {
+	Seq        uint64    `json:"seq"`
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	RequestID  string    `json:"requestID,omitempty"`
+	Subject    string    `json:"subject,omitempty"`
+	CustomerID string    `json:"customerID,omitempty"`
+	Scope      string    `json:"scope"`
+	// Decision - the reason code of authorization records (e.g. allowed) or charged/failed for charge records
+	Decision string `json:"decision"`
+	Units    int64  `json:"units,omitempty"`
+	PrevHash string `json:"prevHash"`
+	Hash     string `json:"hash"`
+}
+
+// hash - the SHA-256 of the record without its hash
+func (r AuditRecord) hash() string {
+	r.Hash = ""
+	jsonBytes, _ := json.Marshal(r)
+	sum := sha256.Sum256(jsonBytes)
+	return hex.EncodeToString(sum[:])
+}
+
+// auditAnchor - the last pruned record (the start of the chain after retention)
+type auditAnchor struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// auditStore - where the records are kept (buntdb or rotating files)
+type auditStore interface {
+	last() (*AuditRecord, error)
+	append(record AuditRecord) error
+	each(fn func(record AuditRecord) error) error
+	anchor() (auditAnchor, error)
+	prune(before time.Time) (int, error)
+}
+
+// AuditLog - an append-only hash chain of authorization and billing events
+type AuditLog struct {
+	sync.Mutex
+	store auditStore
+	// Retention - how long records are kept (0 keeps them forever)
+	Retention  time.Duration
+	lastPruned time.Time
+	// head - the seq and hash of the last record (loaded from the store on the first append)
+	head *auditAnchor
+	// pruneErr - the retention of an append that could not be applied (the record was appended)
+	pruneErr error
+}
+
+// NewBuntDBAuditLog - an audit log in buntdb
+func NewBuntDBAuditLog(db *buntdb.DB) *AuditLog {
+	return &AuditLog{store: &buntdbAudit{db: db}}
+}
+
+// NewFileAuditLog - an audit log of JSONL files in dir - a new file is started when the current one has maxBytes
+func NewFileAuditLog(dir string, maxBytes int64) (*AuditLog, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{store: &fileAudit{dir: dir, maxBytes: maxBytes}}, nil
+}
+
+// Append - chain the record to the last one and append it
+func (l *AuditLog) Append(record AuditRecord) error {
+	l.Lock()
+	defer l.Unlock()
+	if l.head == nil {
+		head, err := l.loadHead()
+		if err != nil {
+			return err
+		}
+		l.head = head
+	}
+	record.Seq = l.head.Seq + 1
+	record.PrevHash = l.head.Hash
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	record.Time = record.Time.UTC()
+	record.Hash = record.hash()
+	err := l.store.append(record)
+	if err != nil {
+		return err
+	}
+	l.head = &auditAnchor{Seq: record.Seq, Hash: record.Hash}
+	// apply the retention at most once an hour (a failure does not fail the append - it is kept for takePruneErr)
+	if l.Retention > 0 && time.Since(l.lastPruned) > time.Hour {
+		l.lastPruned = time.Now()
+		_, l.pruneErr = l.store.prune(time.Now().Add(-l.Retention))
+	}
+	return nil
+}
+
+// takePruneErr - the error of the last retention that could not be applied (once)
+func (l *AuditLog) takePruneErr() error {
+	l.Lock()
+	defer l.Unlock()
+	err := l.pruneErr
+	l.pruneErr = nil
+	return err
+}
+
+// loadHead - the last record or the anchor when all the records were pruned
+func (l *AuditLog) loadHead() (*auditAnchor, error) {
+	last, err := l.store.last()
+	if err != nil {
+		return nil, err
+	}
+	if last != nil {
+		return &auditAnchor{Seq: last.Seq, Hash: last.Hash}, nil
+	}
+	anchor, err := l.store.anchor()
+	if err != nil {
+		return nil, err
+	}
+	return &anchor, nil
+}
+
+// Prune - remove the records older than before (the chain is anchored on the last removed record)
+func (l *AuditLog) Prune(before time.Time) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.store.prune(before)
+}
+
+// AuditProblem - a record that breaks the chain
+type AuditProblem struct {
+	Seq     uint64 `json:"seq"`
+	Problem string `json:"problem"`
+}
+
+// AuditVerification - the result of verifying the audit log
+type AuditVerification struct {
+	Records  int            `json:"records"`
+	Valid    bool           `json:"valid"`
+	Problems []AuditProblem `json:"problems"`
+}
+
+// Verify - check that no record was edited, removed or reordered
+func (l *AuditLog) Verify() (*AuditVerification, error) {
+	l.Lock()
+	defer l.Unlock()
+	anchor, err := l.store.anchor()
+	if err != nil {
+		return nil, err
+	}
+	verification := &AuditVerification{Problems: []AuditProblem{}}
+	seq, prevHash := anchor.Seq, anchor.Hash
+	err = l.store.each(func(record AuditRecord) error {
+		verification.Records++
+		if record.Seq != seq+1 {
+			verification.Problems = append(verification.Problems, AuditProblem{
+				Seq:     record.Seq,
+				Problem: fmt.Sprintf("gap - expected record %d", seq+1),
+			})
+		} else if record.PrevHash != prevHash {
+			verification.Problems = append(verification.Problems, AuditProblem{Seq: record.Seq, Problem: "broken chain - previous hash does not match"})
+		}
+		if record.hash() != record.Hash {
+			verification.Problems = append(verification.Problems, AuditProblem{Seq: record.Seq, Problem: "edited - hash does not match"})
+		}
+		seq, prevHash = record.Seq, record.Hash
+		return nil
+	})
+	verification.Valid = len(verification.Problems) == 0
+	return verification, err
+}
+
+// buntdbAudit - records at apibillme:audit:record:<seq>
+type buntdbAudit struct {
+	db *buntdb.DB
+}
+
+const auditAnchorKey = "apibillme:audit:anchor"
+
+func auditKey(seq uint64) string {
+	return fmt.Sprintf("apibillme:audit:record:%020d", seq)
+}
+
+func (s *buntdbAudit) last() (*AuditRecord, error) {
+	var record *AuditRecord
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		var err error
+		tx.DescendKeys("apibillme:audit:record:*", func(key, value string) bool {
+			record = &AuditRecord{}
+			err = json.Unmarshal([]byte(value), record)
+			return false
+		})
+		return err
+	})
+	return record, err
+}
+
+func (s *buntdbAudit) append(record AuditRecord) error {
+	jsonBytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(auditKey(record.Seq), string(jsonBytes), nil)
+		return err
+	})
+}
+
+func (s *buntdbAudit) each(fn func(record AuditRecord) error) error {
+	return s.db.View(func(tx *buntdb.Tx) error {
+		var err error
+		tx.AscendKeys("apibillme:audit:record:*", func(key, value string) bool {
+			var record AuditRecord
+			err = json.Unmarshal([]byte(value), &record)
+			if err == nil {
+				err = fn(record)
+			}
+			return err == nil
+		})
+		return err
+	})
+}
+
+func (s *buntdbAudit) anchor() (auditAnchor, error) {
+	var anchor auditAnchor
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		val, err := tx.Get(auditAnchorKey)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal([]byte(val), &anchor)
+	})
+	if err == buntdb.ErrNotFound {
+		return anchor, nil
+	}
+	return anchor, err
+}
+
+func (s *buntdbAudit) prune(before time.Time) (int, error) {
+	var pruned []AuditRecord
+	err := s.each(func(record AuditRecord) error {
+		if !record.Time.Before(before) {
+			return errStop
+		}
+		pruned = append(pruned, record)
+		return nil
+	})
+	if err != nil && err != errStop {
+		return 0, err
+	}
+	if len(pruned) == 0 {
+		return 0, nil
+	}
+	last := pruned[len(pruned)-1]
+	jsonBytes, err := json.Marshal(auditAnchor{Seq: last.Seq, Hash: last.Hash})
+	if err != nil {
+		return 0, err
+	}
+	err = s.db.Update(func(tx *buntdb.Tx) error {
+		for _, record := range pruned {
+			_, err := tx.Delete(auditKey(record.Seq))
+			if err != nil {
+				return err
+			}
+		}
+		_, _, err := tx.Set(auditAnchorKey, string(jsonBytes), nil)
+		return err
+	})
+	return len(pruned), err
+}
+
+// errStop - stop iterating the records
+var errStop = errors.New("stop")
+
+// fileAudit - records in JSONL files named audit-<first seq>.jsonl
+type fileAudit struct {
+	dir      string
+	maxBytes int64
+	// current and size - the file records are appended to (found on the first append and set again on rotation)
+	current string
+	size    int64
+}
+
+func (s *fileAudit) files() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "audit-*.jsonl"))
+	sort.Strings(files)
+	return files, err
+}
+
+func readAuditFile(path string) ([]AuditRecord, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var records []AuditRecord
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var record AuditRecord
+		err := json.Unmarshal(line, &record)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+func (s *fileAudit) last() (*AuditRecord, error) {
+	files, err := s.files()
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+	records, err := readAuditFile(files[len(files)-1])
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	return &records[len(records)-1], nil
+}
+
+// open - find the current file and its size (once - the appends keep them up to date)
+func (s *fileAudit) open() error {
+	files, err := s.files()
+	if err != nil || len(files) == 0 {
+		return err
+	}
+	info, err := os.Stat(files[len(files)-1])
+	if err != nil {
+		return err
+	}
+	s.current, s.size = files[len(files)-1], info.Size()
+	return nil
+}
+
+func (s *fileAudit) append(record AuditRecord) error {
+	if s.current == "" {
+		err := s.open()
+		if err != nil {
+			return err
+		}
+	}
+	// rotate when the current file is full
+	path := s.current
+	if path == "" || s.maxBytes > 0 && s.size >= s.maxBytes {
+		path = filepath.Join(s.dir, fmt.Sprintf("audit-%020d.jsonl", record.Seq))
+		s.current, s.size = "", 0
+	}
+	jsonBytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	n, err := file.Write(append(jsonBytes, '\n'))
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	// a partial line is counted too (the next record starts a new file sooner rather than later)
+	s.current = path
+	s.size += int64(n)
+	return err
+}
+
+func (s *fileAudit) each(fn func(record AuditRecord) error) error {
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+	for _, path := range files {
+		records, err := readAuditFile(path)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			err := fn(record)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *fileAudit) anchor() (auditAnchor, error) {
+	var anchor auditAnchor
+	body, err := ioutil.ReadFile(filepath.Join(s.dir, "anchor.json"))
+	if os.IsNotExist(err) {
+		return anchor, nil
+	}
+	if err != nil {
+		return anchor, err
+	}
+	err = json.Unmarshal(body, &anchor)
+	return anchor, err
+}
+
+// prune - remove the files whose records are all older than before (the current file is kept)
+func (s *fileAudit) prune(before time.Time) (int, error) {
+	files, err := s.files()
+	if err != nil {
+		return 0, err
+	}
+	if len(files) > 0 {
+		files = files[:len(files)-1]
+	}
+	pruned := 0
+	for _, path := range files {
+		records, err := readAuditFile(path)
+		if err != nil {
+			return pruned, err
+		}
+		if len(records) > 0 && !records[len(records)-1].Time.Before(before) {
+			break
+		}
+		if len(records) > 0 {
+			last := records[len(records)-1]
+			jsonBytes, err := json.Marshal(auditAnchor{Seq: last.Seq, Hash: last.Hash})
+			if err != nil {
+				return pruned, err
+			}
+			err = ioutil.WriteFile(filepath.Join(s.dir, "anchor.json"), jsonBytes, 0600)
+			if err != nil {
+				return pruned, err
+			}
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return pruned, err
+		}
+		pruned += len(records)
+	}
+	return pruned, nil
+}
+
+// audit logs of the ENV VARS (one per db or dir so the chain has one writer)
+var auditLogs = struct {
+	sync.Mutex
+	byKey map[interface{}]*AuditLog
+}{byKey: map[interface{}]*AuditLog{}}
+
+// auditLogFromConfig - audit_log (buntdb or file), audit_log_dir, audit_log_max_bytes and audit_retention ENV VARS
+func auditLogFromConfig(db *buntdb.DB) *AuditLog {
+	kind := strings.ToLower(cast.ToString(viper.Get("audit_log")))
+	if kind != "buntdb" && kind != "file" {
+		return nil
+	}
+	var key interface{} = db
+	dir := cast.ToString(viper.Get("audit_log_dir"))
+	if kind == "file" {
+		key = dir
+	}
+	auditLogs.Lock()
+	defer auditLogs.Unlock()
+	log, ok := auditLogs.byKey[key]
+	if !ok {
+		if kind == "file" {
+			maxBytes := cast.ToInt64(viper.Get("audit_log_max_bytes"))
+			if maxBytes <= 0 {
+				maxBytes = 100 << 20
+			}
+			var err error
+			log, err = NewFileAuditLog(dir, maxBytes)
+			if err != nil {
+				return nil
+			}
+		} else {
+			log = NewBuntDBAuditLog(db)
+		}
+		auditLogs.byKey[key] = log
+	}
+	log.Retention = cast.ToDuration(viper.Get("audit_retention"))
+	return log
+}
+
+// auditAuthorization - append the decision of the request (a failure is counted and logged with the decision)
+func (l *AuditLog) auditAuthorization(d *decision) error {
+	if l == nil {
+		return nil
+	}
+	record := AuditRecord{
+		Type:      AuditAuthorization,
+		RequestID: d.requestID,
+		Scope:     d.serverMethod + ":" + d.serverBaseURL,
+		Decision:  d.reason,
+	}
+	if d.identity != nil {
+		record.Subject = d.identity.Subject
+		record.CustomerID = d.identity.CustomerID
+	}
+	err := d.auditFailed(AuditAuthorization, l.Append(record))
+	d.auditPruneFailed(l)
+	return err
+}
+
+// auditCharge - append the charge of the request (a failure is counted and logged with the decision)
+func (l *AuditLog) auditCharge(d *decision, event usageEvent, status string) error {
+	if l == nil {
+		return nil
+	}
+	err := d.auditFailed(AuditCharge, l.Append(AuditRecord{
+		Type:       AuditCharge,
+		RequestID:  d.requestID,
+		Subject:    event.Member,
+		CustomerID: event.CustomerID,
+		Scope:      event.ServerMethod + ":" + event.ServerBaseURL,
+		Decision:   status,
+		Units:      event.Units,
+	}))
+	d.auditPruneFailed(l)
+	return err
+}
+
+// auditFailed - count a failed append and keep its error for the decision log
+func (d *decision) auditFailed(recordType string, err error) error {
+	if err == nil {
+		return nil
+	}
+	d.metrics.add("apibillme_audit_errors_total", 1, recordType)
+	d.auditErr = err
+	return err
+}
+
+// auditPruneFailed - count a retention that could not be applied and keep its error for the decision log (the call was audited)
+func (d *decision) auditPruneFailed(l *AuditLog) {
+	err := l.takePruneErr()
+	if err == nil {
+		return
+	}
+	d.metrics.add("apibillme_audit_errors_total", 1, "prune")
+	d.auditPruneErr = err
+}
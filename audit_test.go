@@ -0,0 +1,302 @@
+package apibillme
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apibillme/stubby"
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+)
+
+// failingAudit - a store that cannot be written to
+type failingAudit struct{}
+
+func (failingAudit) last() (*AuditRecord, error)                  { return nil, nil }
+func (failingAudit) append(record AuditRecord) error              { return errors.New("disk full") }
+func (failingAudit) each(fn func(record AuditRecord) error) error { return nil }
+func (failingAudit) anchor() (auditAnchor, error)                 { return auditAnchor{}, nil }
+func (failingAudit) prune(before time.Time) (int, error)          { return 0, nil }
+
+// unprunableAudit - a store whose records cannot be pruned
+type unprunableAudit struct {
+	*buntdbAudit
+}
+
+func (unprunableAudit) prune(before time.Time) (int, error) { return 0, errors.New("read-only") }
+
+func TestAudit(t *testing.T) {
+
+	Convey("AuditLog - buntdb", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		auditLog := NewBuntDBAuditLog(db)
+		start := time.Now().Add(-48 * time.Hour)
+		for i := 0; i < 5; i++ {
+			err := auditLog.Append(AuditRecord{Time: start.Add(time.Duration(i) * time.Hour), Type: AuditAuthorization, Scope: "get:/users", Decision: DecisionAllowed})
+			So(err, ShouldBeNil)
+		}
+
+		Convey("Success - records are chained", func() {
+			verification, err := auditLog.Verify()
+			So(err, ShouldBeNil)
+			So(verification.Valid, ShouldBeTrue)
+			So(verification.Records, ShouldEqual, 5)
+
+			last, err := auditLog.store.last()
+			So(err, ShouldBeNil)
+			So(last.Seq, ShouldEqual, 5)
+			So(last.Hash, ShouldEqual, last.hash())
+		})
+
+		Convey("Failure - an edited record is detected", func() {
+			db.Update(func(tx *buntdb.Tx) error {
+				val, _ := tx.Get(auditKey(3))
+				tx.Set(auditKey(3), val[:len(val)-1]+`,"units":100}`, nil)
+				return nil
+			})
+			verification, err := auditLog.Verify()
+			So(err, ShouldBeNil)
+			So(verification.Valid, ShouldBeFalse)
+			So(verification.Problems, ShouldHaveLength, 1)
+			So(verification.Problems[0].Seq, ShouldEqual, 3)
+			So(verification.Problems[0].Problem, ShouldStartWith, "edited")
+		})
+
+		Convey("Failure - a removed record is detected", func() {
+			db.Update(func(tx *buntdb.Tx) error {
+				_, err := tx.Delete(auditKey(2))
+				return err
+			})
+			verification, err := auditLog.Verify()
+			So(err, ShouldBeNil)
+			So(verification.Valid, ShouldBeFalse)
+			So(verification.Problems[0].Seq, ShouldEqual, 3)
+			So(verification.Problems[0].Problem, ShouldStartWith, "gap")
+		})
+
+		Convey("Success - pruned records anchor the chain", func() {
+			pruned, err := auditLog.Prune(start.Add(150 * time.Minute))
+			So(err, ShouldBeNil)
+			So(pruned, ShouldEqual, 3)
+			verification, err := auditLog.Verify()
+			So(err, ShouldBeNil)
+			So(verification.Valid, ShouldBeTrue)
+			So(verification.Records, ShouldEqual, 2)
+
+			err = auditLog.Append(AuditRecord{Type: AuditCharge, Scope: "get:/users", Decision: LedgerCharged})
+			So(err, ShouldBeNil)
+			verification, _ = auditLog.Verify()
+			So(verification.Valid, ShouldBeTrue)
+		})
+	})
+
+	Convey("AuditLog - files", t, func() {
+
+		dir, err := ioutil.TempDir("", "audit")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		auditLog, err := NewFileAuditLog(dir, 1)
+		So(err, ShouldBeNil)
+		start := time.Now().Add(-48 * time.Hour)
+		for i := 0; i < 3; i++ {
+			err := auditLog.Append(AuditRecord{Time: start.Add(time.Duration(i) * time.Hour), Type: AuditAuthorization, Scope: "get:/users", Decision: DecisionAllowed})
+			So(err, ShouldBeNil)
+		}
+
+		Convey("Success - files are rotated and chained", func() {
+			files, _ := filepath.Glob(filepath.Join(dir, "audit-*.jsonl"))
+			So(files, ShouldHaveLength, 3)
+			verification, err := auditLog.Verify()
+			So(err, ShouldBeNil)
+			So(verification.Valid, ShouldBeTrue)
+			So(verification.Records, ShouldEqual, 3)
+		})
+
+		Convey("Success - pruned files anchor the chain", func() {
+			pruned, err := auditLog.Prune(time.Now())
+			So(err, ShouldBeNil)
+			So(pruned, ShouldEqual, 2)
+			verification, err := auditLog.Verify()
+			So(err, ShouldBeNil)
+			So(verification.Valid, ShouldBeTrue)
+			So(verification.Records, ShouldEqual, 1)
+		})
+
+		Convey("Success - appends do not read the current file", func() {
+			files, _ := filepath.Glob(filepath.Join(dir, "audit-*.jsonl"))
+			file, _ := os.OpenFile(files[len(files)-1], os.O_APPEND|os.O_WRONLY, 0600)
+			file.WriteString("foobar\n")
+			file.Close()
+			err := auditLog.Append(AuditRecord{Type: AuditCharge, Scope: "get:/users", Decision: LedgerCharged})
+			So(err, ShouldBeNil)
+			So(auditLog.head.Seq, ShouldEqual, 4)
+		})
+
+		Convey("Success - a log opened again continues the chain", func() {
+			reopened, err := NewFileAuditLog(dir, 1<<20)
+			So(err, ShouldBeNil)
+			for i := 0; i < 2; i++ {
+				err = reopened.Append(AuditRecord{Type: AuditCharge, Scope: "get:/users", Decision: LedgerCharged})
+				So(err, ShouldBeNil)
+			}
+			files, _ := filepath.Glob(filepath.Join(dir, "audit-*.jsonl"))
+			So(files, ShouldHaveLength, 3)
+			verification, err := reopened.Verify()
+			So(err, ShouldBeNil)
+			So(verification.Valid, ShouldBeTrue)
+			So(verification.Records, ShouldEqual, 5)
+		})
+
+		Convey("Failure - a removed file is detected", func() {
+			os.Remove(filepath.Join(dir, "audit-00000000000000000002.jsonl"))
+			verification, err := auditLog.Verify()
+			So(err, ShouldBeNil)
+			So(verification.Valid, ShouldBeFalse)
+			So(verification.Problems[0].Seq, ShouldEqual, 3)
+		})
+	})
+
+	Convey("Run - audit log", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		viper.AutomaticEnv()
+		os.Setenv("AUDIT_LOG", "buntdb")
+		os.Setenv("RBAC_VALIDATE", "false")
+		os.Setenv("STRIPE_VALIDATE", "true")
+		os.Setenv("STRIPE_JSON_PATH", "testdata/metering.json")
+		defer os.Setenv("AUDIT_LOG", "")
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		identity := &Identity{Method: MethodAPIKey, Subject: "apikey|1", CustomerID: "cus_123"}
+		router.Use(Run(db, WithAuthenticator(&stubAuthenticator{identity: identity})))
+		router.POST("/reports", func(c *gin.Context) {
+			c.String(http.StatusOK, "ok")
+		})
+
+		Convey("Success - authorization and charge records share the request ID", func() {
+			stub := stubby.StubFunc(&restlyPostJSON, nil, nil)
+			defer stub.Reset()
+			req, _ := http.NewRequest("POST", "/reports", nil)
+			req.Header.Set("X-Request-Id", "req-1")
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+
+			var records []AuditRecord
+			NewBuntDBAuditLog(db).store.each(func(record AuditRecord) error {
+				records = append(records, record)
+				return nil
+			})
+			So(records, ShouldHaveLength, 2)
+			So(records[0].Type, ShouldEqual, AuditCharge)
+			So(records[0].Decision, ShouldEqual, LedgerCharged)
+			So(records[0].Units, ShouldEqual, 10)
+			So(records[1].Type, ShouldEqual, AuditAuthorization)
+			So(records[1].Decision, ShouldEqual, DecisionAllowed)
+			So(records[1].RequestID, ShouldEqual, "req-1")
+			So(records[1].CustomerID, ShouldEqual, "cus_123")
+
+			verification, err := NewBuntDBAuditLog(db).Verify()
+			So(err, ShouldBeNil)
+			So(verification.Valid, ShouldBeTrue)
+		})
+	})
+
+	Convey("Run - audit log failures", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		viper.AutomaticEnv()
+		os.Setenv("RBAC_VALIDATE", "false")
+		os.Setenv("STRIPE_VALIDATE", "true")
+		os.Setenv("STRIPE_JSON_PATH", "testdata/metering.json")
+		defer os.Setenv("AUDIT_FAIL_CLOSED", "")
+		stub := stubby.StubFunc(&restlyPostJSON, nil, nil)
+		defer stub.Reset()
+
+		metrics := NewMetrics()
+		logger := &memoryLogger{}
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		identity := &Identity{Method: MethodAPIKey, Subject: "apikey|1", CustomerID: "cus_123"}
+		router.Use(Run(db, WithAuthenticator(&stubAuthenticator{identity: identity}), WithAuditLog(&AuditLog{store: failingAudit{}}), WithMetrics(metrics), WithLogger(logger)))
+		router.POST("/reports", func(c *gin.Context) {
+			c.String(http.StatusOK, "ok")
+		})
+		request := func() int {
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/reports", nil)
+			router.ServeHTTP(recorder, req)
+			return recorder.Code
+		}
+
+		Convey("Success - the failures are counted and logged with the decision", func() {
+			So(request(), ShouldEqual, http.StatusOK)
+			recorder := httptest.NewRecorder()
+			metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+			So(recorder.Body.String(), ShouldContainSubstring, `apibillme_audit_errors_total{type="authorization"} 1`)
+			So(recorder.Body.String(), ShouldContainSubstring, `apibillme_audit_errors_total{type="charge"} 1`)
+			So(logger.events, ShouldHaveLength, 1)
+			So(logger.events[0].Reason, ShouldEqual, DecisionAllowed)
+			So(logger.events[0].AuditError, ShouldEqual, "disk full")
+		})
+
+		Convey("Failure - calls that cannot be audited are denied with audit_fail_closed", func() {
+			os.Setenv("AUDIT_FAIL_CLOSED", "true")
+			So(request(), ShouldEqual, http.StatusInternalServerError)
+			So(logger.events, ShouldHaveLength, 1)
+			So(logger.events[0].Reason, ShouldEqual, DecisionConfigError)
+		})
+
+		Convey("Success - a failed retention does not fail the audited call", func() {
+			os.Setenv("AUDIT_FAIL_CLOSED", "true")
+			auditLog := &AuditLog{store: unprunableAudit{&buntdbAudit{db: db}}, Retention: time.Hour}
+			router := gin.New()
+			router.Use(Run(db, WithAuthenticator(&stubAuthenticator{identity: identity}), WithAuditLog(auditLog), WithMetrics(metrics), WithLogger(logger)))
+			router.POST("/reports", func(c *gin.Context) {
+				c.String(http.StatusOK, "ok")
+			})
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/reports", nil)
+			router.ServeHTTP(recorder, req)
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			verification, err := auditLog.Verify()
+			So(err, ShouldBeNil)
+			So(verification.Records, ShouldEqual, 2)
+
+			recorder = httptest.NewRecorder()
+			metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+			So(recorder.Body.String(), ShouldContainSubstring, `apibillme_audit_errors_total{type="prune"} 1`)
+			So(recorder.Body.String(), ShouldNotContainSubstring, `apibillme_audit_errors_total{type="authorization"}`)
+			So(logger.events, ShouldHaveLength, 1)
+			So(logger.events[0].AuditError, ShouldBeEmpty)
+			So(logger.events[0].AuditPruneError, ShouldEqual, "read-only")
+		})
+	})
+}
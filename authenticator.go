@@ -0,0 +1,133 @@
+package apibillme
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/apibillme/auth0"
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+)
+
+// identity methods (Identity.Method)
+const (
+	MethodJWT    = "jwt"
+	MethodAPIKey = "apikey"
+	MethodHMAC   = "hmac"
+	MethodMTLS   = "mtls"
+	// MethodIntrospection - opaque access_token (RFC 7662)
+	MethodIntrospection = "introspection"
+)
+
+// errNoCredentials - the request has no credentials for the authenticator (the next one is tried)
+var errNoCredentials = errors.New("no credentials")
+
+// Authenticator - authenticates the caller of a request
+type Authenticator interface {
+	// Authenticate - return the identity of the caller - errNoCredentials if the request has no credentials for it
+	Authenticate(db *buntdb.DB, req *http.Request) (*Identity, error)
+}
+
+// JWTAuthenticator - authenticates the access_token on the identity provider
+type JWTAuthenticator struct {
+	Provider Provider
+	// Sources - where to find the access_token (defaults to Authorization: Bearer)
+	Sources []TokenSource
+	metrics *Metrics
+}
+
+// Authenticate - validate the access_token and return its identity
+func (a *JWTAuthenticator) Authenticate(db *buntdb.DB, req *http.Request) (*Identity, error) {
+	sources := a.Sources
+	if sources == nil {
+		sources = defaultTokenSources
+	}
+	// only the configured sources are read - the provider reads the token as Authorization: Bearer <token>
+	token := extractToken(req, sources)
+	if token == "" {
+		return nil, errNoCredentials
+	}
+	// a token cache miss fetches the JWKS
+	hit := tokenCached(db, token)
+	spanFromContext(req.Context()).SetAttribute(AttributeTokenCacheHit, hit)
+	a.metrics.tokenCache(hit)
+	req = withBearer(req, token)
+	// the provider counts its JWKS fetches
+	if a.metrics != nil {
+		req = req.WithContext(contextWithMetrics(req.Context(), a.metrics))
+	}
+	validated, err := a.Provider.Validate(db, req)
+	if err != nil {
+		return nil, errors.New("Unauthorized - Invalid Token")
+	}
+	return newTokenIdentity(validated), nil
+}
+
+// authenticate - run the authenticators in order until one finds credentials
+func authenticate(db *buntdb.DB, req *http.Request, authenticators []Authenticator) (*Identity, error) {
+	for _, authenticator := range authenticators {
+		identity, err := authenticator.Authenticate(db, req)
+		if err == errNoCredentials {
+			continue
+		}
+		return identity, err
+	}
+	return nil, errors.New("Unauthorized - Invalid Token")
+}
+
+// authorizeAdmin - authenticate the caller like Run and require the admin scope (the status of the denial otherwise)
+func authorizeAdmin(db *buntdb.DB, req *http.Request, o *options, adminScope string) (*Identity, int, error) {
+	identity, err := authenticate(db, req, o.authenticators)
+	stripQueryTokens(req, o.tokenSources)
+	if err == nil && isRevoked(db, identity) {
+		err = errors.New("Unauthorized - Access Revoked")
+	}
+	if err != nil {
+		return nil, http.StatusUnauthorized, err
+	}
+	scopes, _ := urlScopes(identity)
+	for _, scope := range scopes {
+		if scope.Method+":"+scope.URL == adminScope {
+			return identity, http.StatusOK, nil
+		}
+	}
+	return nil, http.StatusForbidden, errors.New("Forbidden - the " + adminScope + " scope is required")
+}
+
+// requireAdmin - authenticate the caller like Run and require the admin scope
+func requireAdmin(db *buntdb.DB, opts []Option, adminScope func() string) gin.HandlerFunc {
+	viper.AutomaticEnv()
+	o := newOptions(opts)
+	return func(c *gin.Context) {
+		identity, status, err := authorizeAdmin(db, c.Request, o, adminScope())
+		if err != nil {
+			c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		c.Set(adminActorKey, identity.Subject)
+		c.Next()
+	}
+}
+
+// context key of the subject of the admin (e.g. the actor of a catalog change)
+const adminActorKey = "apibillme:admin:actor"
+
+// urlScopes - get the URL scopes of the identity (from the access_token or else from its scope set)
+func urlScopes(identity *Identity) ([]auth0.URLScope, error) {
+	if identity.Token != nil {
+		return auth0GetURLScopes(identity.Token)
+	}
+	var scopes []auth0.URLScope
+	r := regexp.MustCompile(`^([a-z]+):([a-z]+)$`)
+	for _, scope := range identity.Scopes {
+		parts := r.FindStringSubmatch(strings.ToLower(scope))
+		if parts == nil {
+			continue
+		}
+		scopes = append(scopes, auth0.URLScope{Method: parts[1], URL: parts[2]})
+	}
+	return scopes, nil
+}
@@ -0,0 +1,67 @@
+package apibillme
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"testing"
+
+	"github.com/apibillme/auth0"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/tidwall/buntdb"
+)
+
+type stubAuthenticator struct {
+	identity *Identity
+	err      error
+}
+
+func (a *stubAuthenticator) Authenticate(db *buntdb.DB, req *http.Request) (*Identity, error) {
+	return a.identity, a.err
+}
+
+func TestAuthenticator(t *testing.T) {
+
+	Convey("authenticate", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		req, err := http.NewRequest("GET", "/users/12", nil)
+		So(err, ShouldBeNil)
+
+		Convey("Success - skips authenticators without credentials", func() {
+			identity, err := authenticate(db, req, []Authenticator{
+				&stubAuthenticator{err: errNoCredentials},
+				&stubAuthenticator{identity: &Identity{Subject: "foo"}},
+			})
+			So(err, ShouldBeNil)
+			So(identity.Subject, ShouldEqual, "foo")
+		})
+
+		Convey("Failure - stops at invalid credentials", func() {
+			_, err := authenticate(db, req, []Authenticator{
+				&stubAuthenticator{err: errors.New("Unauthorized - Invalid API Key")},
+				&stubAuthenticator{identity: &Identity{Subject: "foo"}},
+			})
+			So(err, ShouldBeError)
+		})
+
+		Convey("Failure - no credentials at all", func() {
+			_, err := authenticate(db, req, []Authenticator{&stubAuthenticator{err: errNoCredentials}})
+			So(err, ShouldBeError)
+		})
+	})
+
+	Convey("urlScopes", t, func() {
+
+		Convey("Success - parses the scope set", func() {
+			scopes, err := urlScopes(&Identity{Scopes: []string{"get:users", "POST:Reports", "openid"}})
+			So(err, ShouldBeNil)
+			So(scopes, ShouldResemble, []auth0.URLScope{{Method: "get", URL: "users"}, {Method: "post", URL: "reports"}})
+		})
+	})
+}
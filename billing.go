@@ -0,0 +1,280 @@
+package apibillme
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apibillme/restly"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+)
+
+// billing identity sources (billing_identity ENV VAR)
+const (
+	billingIdentityEmail  = "email"
+	billingIdentitySub    = "sub"
+	billingIdentityClaim  = "claim"
+	billingIdentityLookup = "lookup"
+)
+
+// for stubbing
+var billingURL = "https://api.apibill.me"
+
+// billingStatus - the charges in flight, the outcome of the last one and the circuit breaker (for the readiness check)
+var billingStatus = struct {
+	sync.Mutex
+	inFlight    int64
+	lastSuccess time.Time
+	lastError   string
+	lastErrorAt time.Time
+	// failures - the consecutive failed charges (the breaker opens at billing_breaker_failures)
+	failures  int64
+	openUntil time.Time
+	// trial - a charge is sent to check whether the backend is back (half open)
+	trial bool
+}{}
+
+// circuit breaker states
+const (
+	BreakerDisabled = "disabled"
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// errBreakerOpen - the charge was not sent because the billing backend is failing
+var errBreakerOpen = errors.New("billing circuit breaker is open")
+
+// breakerFailures - the consecutive failed charges that open the breaker (billing_breaker_failures ENV VAR - 0 turns it off)
+func breakerFailures() int64 {
+	return cast.ToInt64(viper.Get("billing_breaker_failures"))
+}
+
+// breakerState - the state of the circuit breaker (billingStatus must be locked)
+func breakerState(now time.Time) string {
+	threshold := breakerFailures()
+	switch {
+	case threshold <= 0:
+		return BreakerDisabled
+	case billingStatus.failures < threshold:
+		return BreakerClosed
+	case now.Before(billingStatus.openUntil):
+		return BreakerOpen
+	}
+	return BreakerHalfOpen
+}
+
+// breakerAllows - whether a charge can be sent (one trial charge at a time when half open - billingStatus must be locked)
+func breakerAllows(now time.Time) bool {
+	switch breakerState(now) {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if billingStatus.trial {
+			return false
+		}
+		billingStatus.trial = true
+	}
+	return true
+}
+
+// breakerRetryAfter - how long the breaker stays open
+func breakerRetryAfter(now time.Time) time.Duration {
+	billingStatus.Lock()
+	defer billingStatus.Unlock()
+	if breakerState(now) != BreakerOpen {
+		return 0
+	}
+	return billingStatus.openUntil.Sub(now)
+}
+
+// breakerDone - count the outcome of a charge (the breaker opens for billing_breaker_cooldown - billingStatus must be locked)
+func breakerDone(err error, now time.Time) {
+	billingStatus.trial = false
+	if err == nil {
+		billingStatus.failures = 0
+		return
+	}
+	billingStatus.failures++
+	if threshold := breakerFailures(); threshold > 0 && billingStatus.failures >= threshold {
+		cooldown := cast.ToDuration(viper.Get("billing_breaker_cooldown"))
+		if cooldown <= 0 {
+			cooldown = 30 * time.Second
+		}
+		billingStatus.openUntil = now.Add(cooldown)
+	}
+}
+
+// usageEvent - a billable call sent to apibill.me
+type usageEvent struct {
+	ServerMethod  string `json:"serverMethod"`
+	ServerBaseURL string `json:"serverBaseURL"`
+	UserEmail     string `json:"userEmail,omitempty"`
+	CustomerID    string `json:"customerID"`
+	OrgID         string `json:"orgID,omitempty"`
+	// Member - the subject that made the call (per-member attribution of org usage)
+	Member string `json:"member,omitempty"`
+	// Units - the cost of the call (the weight of the scope times the metered units)
+	Units int64 `json:"units"`
+	// Timestamp - the unix time the usage is billed at (the time of the charge when 0 - e.g. corrections are billed in the period they reconcile)
+	Timestamp int64 `json:"timestamp,omitempty"`
+}
+
+func newUsageEvent(serverMethod string, serverBaseURL string, identity *Identity, units int64) usageEvent {
+	return usageEvent{
+		ServerMethod:  serverMethod,
+		ServerBaseURL: serverBaseURL,
+		UserEmail:     identity.Email,
+		CustomerID:    identity.CustomerID,
+		OrgID:         identity.OrgID,
+		Member:        identity.Subject,
+		Units:         units,
+	}
+}
+
+// verifySubscription - verify the subscription of the customer to the scope with a usage event of 0 units
+// apibill.me does not charge an event of 0 units - it only answers whether the customer is subscribed (not a charge - the breaker and the billing metrics do not count it)
+func verifySubscription(stripeKey string, event usageEvent, header http.Header) error {
+	event.Units = 0
+	return postCharge(stripeKey, event, header)
+}
+
+// subscriptionKey - a verified subscription of a customer to a scope
+func subscriptionKey(customerID string, scope string) string {
+	return "apibillme:subscription:" + customerID + ":" + scope
+}
+
+// subscriptionVerified - whether the subscription of a customer to a scope was verified in the last billing_subscription_ttl
+func subscriptionVerified(db *buntdb.DB, customerID string, scope string) bool {
+	err := db.View(func(tx *buntdb.Tx) error {
+		_, err := tx.Get(subscriptionKey(customerID, scope))
+		return err
+	})
+	return err == nil
+}
+
+// saveSubscription - reuse a verified subscription of a customer to a scope for billing_subscription_ttl
+func saveSubscription(db *buntdb.DB, customerID string, scope string) {
+	if ttl := subscriptionTTL(); ttl > 0 {
+		db.Update(func(tx *buntdb.Tx) error {
+			_, _, err := tx.Set(subscriptionKey(customerID, scope), "verified", &buntdb.SetOptions{Expires: true, TTL: ttl})
+			return err
+		})
+	}
+}
+
+// subscriptionTTL - how long a verified subscription is reused (billing_subscription_ttl ENV VAR - defaults to 1m - 0s turns it off)
+func subscriptionTTL() time.Duration {
+	if !viper.IsSet("billing_subscription_ttl") {
+		return time.Minute
+	}
+	return cast.ToDuration(viper.Get("billing_subscription_ttl"))
+}
+
+func customerKey(subject string) string {
+	return "apibillme:customer:" + subject
+}
+
+// SetBillingCustomer - map a subject (or an organization ID when org_billing is on) to a billing customer ID
+func SetBillingCustomer(db *buntdb.DB, subject string, customerID string) error {
+	if subject == "" || customerID == "" {
+		return errors.New("subject and customer ID are required")
+	}
+	return db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(customerKey(subject), customerID, nil)
+		return err
+	})
+}
+
+// GetBillingCustomer - get the billing customer ID mapped to a subject or organization ID
+func GetBillingCustomer(db *buntdb.DB, subject string) (string, error) {
+	var customerID string
+	err := db.View(func(tx *buntdb.Tx) error {
+		val, err := tx.Get(customerKey(subject))
+		customerID = val
+		return err
+	})
+	return customerID, err
+}
+
+// DeleteBillingCustomer - remove the billing customer ID mapped to a subject or organization ID
+func DeleteBillingCustomer(db *buntdb.DB, subject string) error {
+	return db.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete(customerKey(subject))
+		return err
+	})
+}
+
+// resolveCustomerID - get the billing customer ID of the identity based on billing_identity
+func resolveCustomerID(db *buntdb.DB, identity *Identity) (string, error) {
+	switch strings.ToLower(cast.ToString(viper.Get("billing_identity"))) {
+	case "", billingIdentityEmail:
+		if identity.Email == "" {
+			return "", errors.New("Unauthorized - cannot get email address from token")
+		}
+		return identity.Email, nil
+	case billingIdentitySub:
+		if identity.Subject == "" {
+			return "", errors.New("Unauthorized - cannot get subject from token")
+		}
+		return identity.Subject, nil
+	case billingIdentityClaim:
+		claim := cast.ToString(viper.Get("billing_identity_claim"))
+		customerID, err := claimValue(identity.Claims, claim)
+		if err != nil {
+			return "", errors.New("Unauthorized - cannot get " + claim + " claim from token")
+		}
+		return customerID, nil
+	case billingIdentityLookup:
+		customerID, err := GetBillingCustomer(db, identity.Subject)
+		if err != nil {
+			return "", errors.New("Unauthorized - no billing customer for this subject")
+		}
+		return customerID, nil
+	}
+	return "", errors.New("Unauthorized - invalid billing_identity - contact your admin")
+}
+
+// postCharge - post the usage event to apibill.me
+func postCharge(stripeKey string, event usageEvent, header http.Header) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req := restly.New()
+	req.Header.Add("x-stripe-key", stripeKey)
+	// e.g. the trace context (traceparent)
+	for key := range header {
+		req.Header.Set(key, header.Get(key))
+	}
+	_, err = restlyPostJSON(req, billingURL+"/charge", string(body))
+	return err
+}
+
+// charge - charge the customer for the call on apibill.me
+func charge(stripeKey string, event usageEvent, header http.Header) error {
+	billingStatus.Lock()
+	if !breakerAllows(time.Now()) {
+		billingStatus.Unlock()
+		return errBreakerOpen
+	}
+	billingStatus.inFlight++
+	billingStatus.Unlock()
+	err := postCharge(stripeKey, event, header)
+	billingStatus.Lock()
+	billingStatus.inFlight--
+	if err != nil {
+		billingStatus.lastError = err.Error()
+		billingStatus.lastErrorAt = time.Now()
+	} else {
+		billingStatus.lastSuccess = time.Now()
+	}
+	breakerDone(err, time.Now())
+	billingStatus.Unlock()
+	return err
+}
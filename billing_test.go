@@ -0,0 +1,154 @@
+package apibillme
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/apibillme/stubby"
+	"github.com/gin-gonic/gin"
+	"github.com/lestrrat-go/jwx/jwt"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/gjson"
+	"github.com/valyala/fasthttp"
+)
+
+func TestBilling(t *testing.T) {
+
+	Convey("resolveBilling", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		viper.AutomaticEnv()
+		defer os.Setenv("BILLING_IDENTITY", "")
+
+		token := jwt.New()
+		token.Set("sub", "github|892404")
+		token.Set("email", "test@example.com")
+		token.Set("https://example.com/tenant", "acme")
+		provider := &OIDCProvider{}
+
+		Convey("Success - email is the default", func() {
+			os.Setenv("BILLING_IDENTITY", "")
+			identity := newTokenIdentity(token)
+			err := resolveBilling(db, identity, provider)
+			So(err, ShouldBeNil)
+			So(identity.CustomerID, ShouldEqual, "test@example.com")
+		})
+
+		Convey("Success - sub", func() {
+			os.Setenv("BILLING_IDENTITY", "sub")
+			identity := newTokenIdentity(token)
+			err := resolveBilling(db, identity, provider)
+			So(err, ShouldBeNil)
+			So(identity.CustomerID, ShouldEqual, "github|892404")
+		})
+
+		Convey("Success - custom claim path", func() {
+			os.Setenv("BILLING_IDENTITY", "claim")
+			os.Setenv("BILLING_IDENTITY_CLAIM", `https://example\.com/tenant`)
+			identity := newTokenIdentity(token)
+			err := resolveBilling(db, identity, provider)
+			So(err, ShouldBeNil)
+			So(identity.CustomerID, ShouldEqual, "acme")
+		})
+
+		Convey("Success - lookup table", func() {
+			os.Setenv("BILLING_IDENTITY", "lookup")
+			err := SetBillingCustomer(db, "github|892404", "cus_123")
+			So(err, ShouldBeNil)
+			identity := newTokenIdentity(token)
+			err = resolveBilling(db, identity, provider)
+			So(err, ShouldBeNil)
+			So(identity.CustomerID, ShouldEqual, "cus_123")
+
+			Convey("Failure - mapping deleted", func() {
+				err := DeleteBillingCustomer(db, "github|892404")
+				So(err, ShouldBeNil)
+				err = resolveBilling(db, newTokenIdentity(token), provider)
+				So(err, ShouldBeError)
+			})
+		})
+
+		Convey("Failure - missing claim", func() {
+			os.Setenv("BILLING_IDENTITY", "claim")
+			os.Setenv("BILLING_IDENTITY_CLAIM", "foobar")
+			err := resolveBilling(db, newTokenIdentity(token), provider)
+			So(err, ShouldBeError)
+		})
+
+		Convey("Failure - invalid billing identity", func() {
+			os.Setenv("BILLING_IDENTITY", "foobar")
+			err := resolveBilling(db, newTokenIdentity(token), provider)
+			So(err, ShouldBeError)
+		})
+	})
+
+	Convey("charge", t, func() {
+
+		Convey("Success - sends the customer ID", func() {
+			var body string
+			stub1 := stubby.Stub(&restlyPostJSON, func(req *fasthttp.Request, uri string, b string) (gjson.Result, error) {
+				body = b
+				return gjson.Result{}, nil
+			})
+			defer stub1.Reset()
+			err := charge("sk_test", usageEvent{ServerMethod: "get", ServerBaseURL: "users", CustomerID: "cus_123"}, nil)
+			So(err, ShouldBeNil)
+			So(gjson.Get(body, "customerID").String(), ShouldEqual, "cus_123")
+		})
+	})
+
+	Convey("Run - billing circuit breaker", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		viper.AutomaticEnv()
+		os.Setenv("RBAC_VALIDATE", "false")
+		os.Setenv("STRIPE_VALIDATE", "true")
+		os.Setenv("STRIPE_JSON_PATH", "testdata/metering.json")
+		os.Setenv("BILLING_BREAKER_FAILURES", "1")
+		defer os.Setenv("BILLING_BREAKER_FAILURES", "")
+		defer func() {
+			billingStatus.failures, billingStatus.openUntil, billingStatus.trial = 0, time.Time{}, false
+		}()
+		stub := stubby.StubFunc(&restlyPostJSON, nil, errors.New("connection refused"))
+		defer stub.Reset()
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		identity := &Identity{Method: MethodAPIKey, Subject: "apikey|1", CustomerID: "cus_123"}
+		router.Use(Run(db, WithAuthenticator(&stubAuthenticator{identity: identity})))
+		router.POST("/reports", func(c *gin.Context) {
+			c.String(http.StatusOK, "ok")
+		})
+		request := func() *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/reports", nil)
+			router.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		Convey("Failure - calls are unavailable (not unsubscribed) while the breaker is open", func() {
+			So(request().Code, ShouldEqual, http.StatusUnauthorized)
+			recorder := request()
+			So(recorder.Code, ShouldEqual, http.StatusServiceUnavailable)
+			So(recorder.Body.String(), ShouldContainSubstring, "Service Unavailable - billing is unavailable")
+			So(recorder.Header().Get("Retry-After"), ShouldEqual, "30")
+		})
+	})
+}
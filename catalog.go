@@ -0,0 +1,151 @@
+package apibillme
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Catalog - the scope catalog (stripe.json) - the billable scopes and the limits of scopes and plans
+type Catalog struct {
+	// Version - the version of the catalog (defaults to the SHA-256 of the file)
+	Version string         `json:"version,omitempty"`
+	Scopes  []CatalogEntry `json:"scopes"`
+	// Plans - limits per plan (the default plan applies to customers without a plan)
+	Plans map[string]Plan `json:"plans,omitempty"`
+}
+
+// Limits - the limits of a scope or plan
+type Limits struct {
+	RateLimit   *RateLimit   `json:"rateLimit,omitempty"`
+	Quota       *Quota       `json:"quota,omitempty"`
+	Concurrency *Concurrency `json:"concurrency,omitempty"`
+}
+
+// CatalogEntry - a scope (method and base URL) of the catalog
+type CatalogEntry struct {
+	Method  string `json:"method"`
+	BaseURL string `json:"baseURL"`
+	// Billable - whether Stripe is called for the scope (defaults to true)
+	Billable *bool `json:"billable,omitempty"`
+	// Units - the weight of a call (e.g. post:reports = 10 units - defaults to 1)
+	Units int64 `json:"units,omitempty"`
+	// Metering - compute the units from the request, the response or the handler (times the weight)
+	Metering *Metering `json:"metering,omitempty"`
+	// FailPolicy - closed (default) denies calls the billing backend failed to charge and open lets them through
+	FailPolicy string `json:"failPolicy,omitempty"`
+	Limits
+}
+
+// fail policies of catalog entries
+const (
+	FailClosed = "closed"
+	FailOpen   = "open"
+)
+
+// Plan - the limits of a plan - per scope (e.g. get:users) limits override them
+type Plan struct {
+	Limits
+	Scopes map[string]Limits `json:"scopes,omitempty"`
+	// Alerts - usage threshold alerts of the customers of the plan
+	Alerts *Alerts `json:"alerts,omitempty"`
+}
+
+// default plan of customers without a plan
+const defaultPlan = "default"
+
+type cachedCatalog struct {
+	modTime time.Time
+	catalog *Catalog
+}
+
+// parsed catalogs by path (reloaded when the file changes)
+var catalogs = struct {
+	sync.Mutex
+	byPath map[string]cachedCatalog
+}{byPath: map[string]cachedCatalog{}}
+
+// loadCatalog - read the catalog file (cached until the file changes)
+func loadCatalog(path string) (*Catalog, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	catalogs.Lock()
+	defer catalogs.Unlock()
+	cached, ok := catalogs.byPath[path]
+	if ok && cached.modTime.Equal(info.ModTime()) {
+		return cached.catalog, nil
+	}
+	jsonBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var catalog Catalog
+	err = json.Unmarshal(jsonBytes, &catalog)
+	if err != nil {
+		return nil, err
+	}
+	if catalog.Version == "" {
+		sum := sha256.Sum256(jsonBytes)
+		catalog.Version = "sha256:" + hex.EncodeToString(sum[:6])
+	}
+	catalogs.byPath[path] = cachedCatalog{modTime: info.ModTime(), catalog: &catalog}
+	return &catalog, nil
+}
+
+// entry - the entry of the scope (nil if it is not in the catalog)
+func (c *Catalog) entry(serverMethod string, serverBaseURL string) *CatalogEntry {
+	for i, entry := range c.Scopes {
+		if entry.Method == serverMethod && entry.BaseURL == serverBaseURL {
+			return &c.Scopes[i]
+		}
+	}
+	return nil
+}
+
+// billable - whether Stripe is called for the scope
+func (c *Catalog) billable(serverMethod string, serverBaseURL string) bool {
+	entry := c.entry(serverMethod, serverBaseURL)
+	return entry != nil && (entry.Billable == nil || *entry.Billable)
+}
+
+// override - set the limits of l that are set in other (scoped when other is the limits of a scope)
+func (l *Limits) override(other Limits, scoped bool) {
+	if other.RateLimit != nil {
+		l.RateLimit = other.RateLimit
+	}
+	if other.Quota != nil {
+		quota := *other.Quota
+		quota.scoped = scoped
+		l.Quota = &quota
+	}
+	if other.Concurrency != nil {
+		concurrency := *other.Concurrency
+		concurrency.scoped = scoped
+		l.Concurrency = &concurrency
+	}
+}
+
+// limits - the limits of the scope for the plan - plan scope > scope > plan
+func (c *Catalog) limits(plan string, serverMethod string, serverBaseURL string) Limits {
+	if plan == "" {
+		plan = defaultPlan
+	}
+	var limits Limits
+	planLimits, hasPlan := c.Plans[plan]
+	if hasPlan {
+		limits.override(planLimits.Limits, false)
+	}
+	if entry := c.entry(serverMethod, serverBaseURL); entry != nil {
+		limits.override(entry.Limits, true)
+	}
+	if hasPlan {
+		limits.override(planLimits.Scopes[serverMethod+":"+serverBaseURL], true)
+	}
+	return limits
+}
@@ -0,0 +1,70 @@
+package apibillme
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCatalog(t *testing.T) {
+
+	Convey("loadCatalog", t, func() {
+
+		Convey("Success - cached until the file changes", func() {
+			catalog, err := loadCatalog("testdata/catalog.json")
+			So(err, ShouldBeNil)
+			So(catalog.Scopes, ShouldHaveLength, 3)
+			again, err := loadCatalog("testdata/catalog.json")
+			So(err, ShouldBeNil)
+			So(again, ShouldEqual, catalog)
+		})
+
+		Convey("Failure - no file", func() {
+			_, err := loadCatalog("testdata/foobar.json")
+			So(err, ShouldBeError)
+		})
+	})
+
+	Convey("Catalog", t, func() {
+
+		catalog, err := loadCatalog("testdata/catalog.json")
+		So(err, ShouldBeNil)
+
+		Convey("billable - scopes are billable unless billable is false", func() {
+			So(catalog.billable("get", "users"), ShouldBeTrue)
+			So(catalog.billable("post", "users"), ShouldBeTrue)
+			So(catalog.billable("get", "health"), ShouldBeFalse)
+			So(catalog.billable("delete", "users"), ShouldBeFalse)
+		})
+
+		Convey("limits - the default plan applies without a plan", func() {
+			limits := catalog.limits("", "post", "users")
+			So(limits.RateLimit.Limit, ShouldEqual, 100)
+		})
+
+		Convey("limits - the scope overrides the plan", func() {
+			limits := catalog.limits("", "get", "users")
+			So(limits.RateLimit.Limit, ShouldEqual, 2)
+		})
+
+		Convey("limits - the plan scope overrides the scope", func() {
+			limits := catalog.limits("pro", "get", "users")
+			So(limits.RateLimit.Limit, ShouldEqual, 10)
+			So(limits.RateLimit.Burst, ShouldEqual, 20)
+			limits = catalog.limits("pro", "post", "users")
+			So(limits.RateLimit.Limit, ShouldEqual, 1000)
+		})
+
+		Convey("limits - plan quotas count all scopes and scope quotas their scope", func() {
+			So(catalog.limits("", "get", "users").Quota.scoped, ShouldBeFalse)
+			quota := catalog.limits("pro", "get", "users").Quota
+			So(quota.Soft, ShouldBeTrue)
+			So(quota.scoped, ShouldBeTrue)
+		})
+
+		Convey("limits - unknown plans only have scope limits", func() {
+			So(catalog.limits("foobar", "post", "users").RateLimit, ShouldBeNil)
+			So(catalog.limits("foobar", "get", "users").RateLimit.Limit, ShouldEqual, 2)
+		})
+	})
+}
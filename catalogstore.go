@@ -0,0 +1,483 @@
+package apibillme
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+)
+
+// catalog keys in buntdb
+const (
+	catalogVersionKey = "apibillme:catalog:version"
+	catalogPlansKey   = "apibillme:catalog:plans"
+)
+
+// catalog changes
+const (
+	CatalogCreate = "create"
+	CatalogUpdate = "update"
+	CatalogDelete = "delete"
+	CatalogImport = "import"
+)
+
+var (
+	errCatalogEntryExists   = errors.New("the catalog entry already exists")
+	errCatalogEntryNotFound = errors.New("the catalog entry does not exist")
+	errCatalogConflict      = errors.New("the catalog entry was changed - get it again")
+)
+
+// StoredCatalogEntry - a catalog entry in buntdb - Version is the catalog version of its last change
+type StoredCatalogEntry struct {
+	CatalogEntry
+	Version int64     `json:"version"`
+	Updated time.Time `json:"updated"`
+}
+
+// CatalogChange - a change of the catalog in buntdb (Before is nil on create and After on delete)
+type CatalogChange struct {
+	Version int64         `json:"version"`
+	Time    time.Time     `json:"time"`
+	Action  string        `json:"action"`
+	Scope   string        `json:"scope"`
+	Actor   string        `json:"actor,omitempty"`
+	Before  *CatalogEntry `json:"before,omitempty"`
+	After   *CatalogEntry `json:"after,omitempty"`
+}
+
+func catalogEntryKey(serverMethod string, serverBaseURL string) string {
+	return "apibillme:catalog:entry:" + serverMethod + ":" + serverBaseURL
+}
+
+func catalogChangeKey(version int64) string {
+	return fmt.Sprintf("apibillme:catalog:history:%020d", version)
+}
+
+var (
+	catalogMethod  = regexp.MustCompile(`^(get|post|put|patch|delete|head|options)$`)
+	catalogBaseURL = regexp.MustCompile(`^[a-z0-9_.-]+$`)
+)
+
+// validate - check the entry can be matched and its limits are valid
+func (e *CatalogEntry) validate() error {
+	if !catalogMethod.MatchString(e.Method) {
+		return errors.New("method must be a lowercase HTTP method (e.g. get)")
+	}
+	if !catalogBaseURL.MatchString(e.BaseURL) {
+		return errors.New("baseURL must be the lowercase first segment of the route (e.g. users)")
+	}
+	if e.Units < 0 {
+		return errors.New("units must not be negative")
+	}
+	if e.FailPolicy != "" && e.FailPolicy != FailClosed && e.FailPolicy != FailOpen {
+		return errors.New("failPolicy must be closed or open")
+	}
+	if e.RateLimit != nil {
+		if _, _, err := e.RateLimit.rate(); err != nil {
+			return err
+		}
+	}
+	if e.Quota != nil {
+		if _, _, err := e.Quota.period(time.Now()); err != nil {
+			return err
+		}
+		if e.Quota.Limit <= 0 {
+			return errors.New("quota must have a limit")
+		}
+	}
+	if e.Concurrency != nil && e.Concurrency.Limit <= 0 {
+		return errors.New("concurrency must have a limit")
+	}
+	return nil
+}
+
+// changeCatalog - apply a change to an entry and record it in the history (in one transaction)
+func changeCatalog(tx *buntdb.Tx, action string, scope string, actor string, before *CatalogEntry, after *CatalogEntry) (int64, error) {
+	val, err := tx.Get(catalogVersionKey)
+	if err != nil && err != buntdb.ErrNotFound {
+		return 0, err
+	}
+	version := cast.ToInt64(val) + 1
+	now := time.Now().UTC()
+	if after != nil {
+		jsonBytes, err := json.Marshal(StoredCatalogEntry{CatalogEntry: *after, Version: version, Updated: now})
+		if err != nil {
+			return 0, err
+		}
+		_, _, err = tx.Set(catalogEntryKey(after.Method, after.BaseURL), string(jsonBytes), nil)
+		if err != nil {
+			return 0, err
+		}
+	} else if before != nil {
+		_, err := tx.Delete(catalogEntryKey(before.Method, before.BaseURL))
+		if err != nil {
+			return 0, err
+		}
+	}
+	jsonBytes, err := json.Marshal(CatalogChange{Version: version, Time: now, Action: action, Scope: scope, Actor: actor, Before: before, After: after})
+	if err != nil {
+		return 0, err
+	}
+	_, _, err = tx.Set(catalogChangeKey(version), string(jsonBytes), nil)
+	if err != nil {
+		return 0, err
+	}
+	_, _, err = tx.Set(catalogVersionKey, strconv.FormatInt(version, 10), nil)
+	return version, err
+}
+
+func storedCatalogEntry(tx *buntdb.Tx, serverMethod string, serverBaseURL string) (*StoredCatalogEntry, error) {
+	val, err := tx.Get(catalogEntryKey(serverMethod, serverBaseURL))
+	if err == buntdb.ErrNotFound {
+		return nil, errCatalogEntryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stored StoredCatalogEntry
+	err = json.Unmarshal([]byte(val), &stored)
+	return &stored, err
+}
+
+// GetCatalogEntry - get an entry of the catalog in buntdb
+func GetCatalogEntry(db *buntdb.DB, serverMethod string, serverBaseURL string) (*StoredCatalogEntry, error) {
+	var stored *StoredCatalogEntry
+	err := db.View(func(tx *buntdb.Tx) error {
+		var err error
+		stored, err = storedCatalogEntry(tx, serverMethod, serverBaseURL)
+		return err
+	})
+	return stored, err
+}
+
+// CreateCatalogEntry - add an entry to the catalog in buntdb
+func CreateCatalogEntry(db *buntdb.DB, entry CatalogEntry, actor string) (*StoredCatalogEntry, error) {
+	err := entry.validate()
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *buntdb.Tx) error {
+		if _, err := storedCatalogEntry(tx, entry.Method, entry.BaseURL); err == nil {
+			return errCatalogEntryExists
+		}
+		_, err := changeCatalog(tx, CatalogCreate, entry.Method+":"+entry.BaseURL, actor, nil, &entry)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return GetCatalogEntry(db, entry.Method, entry.BaseURL)
+}
+
+// UpdateCatalogEntry - replace an entry of the catalog in buntdb - version is the version it was read at (0 skips the check)
+func UpdateCatalogEntry(db *buntdb.DB, entry CatalogEntry, version int64, actor string) (*StoredCatalogEntry, error) {
+	err := entry.validate()
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *buntdb.Tx) error {
+		current, err := storedCatalogEntry(tx, entry.Method, entry.BaseURL)
+		if err != nil {
+			return err
+		}
+		if version != 0 && current.Version != version {
+			return errCatalogConflict
+		}
+		_, err = changeCatalog(tx, CatalogUpdate, entry.Method+":"+entry.BaseURL, actor, &current.CatalogEntry, &entry)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return GetCatalogEntry(db, entry.Method, entry.BaseURL)
+}
+
+// DeleteCatalogEntry - remove an entry from the catalog in buntdb
+func DeleteCatalogEntry(db *buntdb.DB, serverMethod string, serverBaseURL string, actor string) error {
+	return db.Update(func(tx *buntdb.Tx) error {
+		current, err := storedCatalogEntry(tx, serverMethod, serverBaseURL)
+		if err != nil {
+			return err
+		}
+		_, err = changeCatalog(tx, CatalogDelete, serverMethod+":"+serverBaseURL, actor, &current.CatalogEntry, nil)
+		return err
+	})
+}
+
+// CatalogEntries - the entries of the catalog in buntdb (by scope) and the version of the catalog
+func CatalogEntries(db *buntdb.DB) ([]StoredCatalogEntry, int64, error) {
+	entries := []StoredCatalogEntry{}
+	var version int64
+	err := db.View(func(tx *buntdb.Tx) error {
+		val, _ := tx.Get(catalogVersionKey)
+		version = cast.ToInt64(val)
+		var err error
+		tx.AscendKeys("apibillme:catalog:entry:*", func(key, val string) bool {
+			var stored StoredCatalogEntry
+			err = json.Unmarshal([]byte(val), &stored)
+			entries = append(entries, stored)
+			return err == nil
+		})
+		return err
+	})
+	return entries, version, err
+}
+
+// CatalogHistory - the changes of the catalog in buntdb (oldest first) - scope (e.g. get:users) is optional
+func CatalogHistory(db *buntdb.DB, scope string) ([]CatalogChange, error) {
+	changes := []CatalogChange{}
+	err := db.View(func(tx *buntdb.Tx) error {
+		var err error
+		tx.AscendKeys("apibillme:catalog:history:*", func(key, val string) bool {
+			var change CatalogChange
+			err = json.Unmarshal([]byte(val), &change)
+			if scope == "" || change.Scope == scope || change.Action == CatalogImport {
+				changes = append(changes, change)
+			}
+			return err == nil
+		})
+		return err
+	})
+	return changes, err
+}
+
+// ImportCatalog - replace the catalog in buntdb with a catalog file (stripe.json) - returns the number of entries
+func ImportCatalog(db *buntdb.DB, path string, actor string) (int, error) {
+	jsonBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var catalog Catalog
+	err = json.Unmarshal(jsonBytes, &catalog)
+	if err != nil {
+		return 0, err
+	}
+	for i := range catalog.Scopes {
+		if err := catalog.Scopes[i].validate(); err != nil {
+			return 0, fmt.Errorf("scope %d: %v", i, err)
+		}
+	}
+	plans, err := json.Marshal(catalog.Plans)
+	if err != nil {
+		return 0, err
+	}
+	err = db.Update(func(tx *buntdb.Tx) error {
+		var keys []string
+		tx.AscendKeys("apibillme:catalog:entry:*", func(key, val string) bool {
+			keys = append(keys, key)
+			return true
+		})
+		for _, key := range keys {
+			if _, err := tx.Delete(key); err != nil {
+				return err
+			}
+		}
+		if _, _, err := tx.Set(catalogPlansKey, string(plans), nil); err != nil {
+			return err
+		}
+		// one version for the import - the entries are in its history
+		version, err := changeCatalog(tx, CatalogImport, "", actor, nil, nil)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		for _, entry := range catalog.Scopes {
+			jsonBytes, err := json.Marshal(StoredCatalogEntry{CatalogEntry: entry, Version: version, Updated: now})
+			if err != nil {
+				return err
+			}
+			if _, _, err := tx.Set(catalogEntryKey(entry.Method, entry.BaseURL), string(jsonBytes), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return len(catalog.Scopes), err
+}
+
+// storedCatalog - the catalog in buntdb as a Catalog
+func storedCatalog(db *buntdb.DB) (*Catalog, error) {
+	entries, version, err := CatalogEntries(db)
+	if err != nil {
+		return nil, err
+	}
+	catalog := &Catalog{Version: strconv.FormatInt(version, 10), Scopes: []CatalogEntry{}}
+	for _, stored := range entries {
+		catalog.Scopes = append(catalog.Scopes, stored.CatalogEntry)
+	}
+	err = db.View(func(tx *buntdb.Tx) error {
+		val, err := tx.Get(catalogPlansKey)
+		if err == buntdb.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal([]byte(val), &catalog.Plans)
+	})
+	return catalog, err
+}
+
+// ExportCatalog - write the catalog in buntdb in the format of the catalog file (stripe.json)
+func ExportCatalog(db *buntdb.DB, w io.Writer) error {
+	catalog, err := storedCatalog(db)
+	if err != nil {
+		return err
+	}
+	sort.Slice(catalog.Scopes, func(i, j int) bool {
+		return catalog.Scopes[i].Method+":"+catalog.Scopes[i].BaseURL < catalog.Scopes[j].Method+":"+catalog.Scopes[j].BaseURL
+	})
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "    ")
+	return encoder.Encode(catalog)
+}
+
+// parsed catalogs of buntdb (rebuilt when the version changes)
+var storedCatalogs = struct {
+	sync.Mutex
+	byDB map[*buntdb.DB]*Catalog
+}{byDB: map[*buntdb.DB]*Catalog{}}
+
+// loadStoredCatalog - the catalog in buntdb (cached until its version changes)
+func loadStoredCatalog(db *buntdb.DB) (*Catalog, error) {
+	var val string
+	err := db.View(func(tx *buntdb.Tx) error {
+		var err error
+		val, err = tx.Get(catalogVersionKey)
+		return err
+	})
+	if err == buntdb.ErrNotFound {
+		return nil, errors.New("the catalog in buntdb is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+	storedCatalogs.Lock()
+	defer storedCatalogs.Unlock()
+	cached, ok := storedCatalogs.byDB[db]
+	if ok && cached.Version == val {
+		return cached, nil
+	}
+	catalog, err := storedCatalog(db)
+	if err != nil {
+		return nil, err
+	}
+	storedCatalogs.byDB[db] = catalog
+	return catalog, nil
+}
+
+// catalogFromConfig - the catalog of catalog_store (file or buntdb) - the file is stripe_json_path
+func catalogFromConfig(db *buntdb.DB) (*Catalog, error) {
+	if strings.ToLower(cast.ToString(viper.Get("catalog_store"))) == "buntdb" {
+		return loadStoredCatalog(db)
+	}
+	return loadCatalog(cast.ToString(viper.Get("stripe_json_path")))
+}
+
+// catalogAdminScope - the scope of the catalog admin API (catalog_admin_scope ENV VAR - defaults to admin:catalog)
+func catalogAdminScope() string {
+	scope := strings.ToLower(cast.ToString(viper.Get("catalog_admin_scope")))
+	if scope == "" {
+		scope = "admin:catalog"
+	}
+	return scope
+}
+
+func catalogErrorStatus(err error) int {
+	switch err {
+	case errCatalogEntryNotFound:
+		return http.StatusNotFound
+	case errCatalogEntryExists, errCatalogConflict:
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
+
+// MountCatalogAdmin - mount the catalog admin API on routes - every route requires the catalog admin scope (catalog_admin_scope ENV VAR)
+// GET/POST /entries, GET/PUT/DELETE /entries/:method/:baseURL, GET /history and GET /export
+func MountCatalogAdmin(routes gin.IRoutes, db *buntdb.DB, opts ...Option) {
+	admin := requireAdmin(db, opts, catalogAdminScope)
+	routes.GET("/entries", admin, func(c *gin.Context) {
+		entries, version, err := CatalogEntries(db)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"version": version, "entries": entries})
+	})
+	routes.GET("/entries/:method/:baseURL", admin, func(c *gin.Context) {
+		stored, err := GetCatalogEntry(db, c.Param("method"), c.Param("baseURL"))
+		if err != nil {
+			c.AbortWithStatusJSON(catalogErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.Header("ETag", strconv.FormatInt(stored.Version, 10))
+		c.JSON(http.StatusOK, stored)
+	})
+	routes.POST("/entries", admin, func(c *gin.Context) {
+		var entry CatalogEntry
+		err := json.NewDecoder(c.Request.Body).Decode(&entry)
+		var stored *StoredCatalogEntry
+		if err == nil {
+			stored, err = CreateCatalogEntry(db, entry, c.GetString(adminActorKey))
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(catalogErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, stored)
+	})
+	// If-Match (the version of the entry) rejects the update when the entry was changed since
+	routes.PUT("/entries/:method/:baseURL", admin, func(c *gin.Context) {
+		var entry CatalogEntry
+		err := json.NewDecoder(c.Request.Body).Decode(&entry)
+		var stored *StoredCatalogEntry
+		if err == nil {
+			entry.Method, entry.BaseURL = c.Param("method"), c.Param("baseURL")
+			version := cast.ToInt64(strings.Trim(c.GetHeader("If-Match"), `"`))
+			stored, err = UpdateCatalogEntry(db, entry, version, c.GetString(adminActorKey))
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(catalogErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, stored)
+	})
+	routes.DELETE("/entries/:method/:baseURL", admin, func(c *gin.Context) {
+		err := DeleteCatalogEntry(db, c.Param("method"), c.Param("baseURL"), c.GetString(adminActorKey))
+		if err != nil {
+			c.AbortWithStatusJSON(catalogErrorStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+	routes.GET("/history", admin, func(c *gin.Context) {
+		changes, err := CatalogHistory(db, c.Query("scope"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"changes": changes})
+	})
+	routes.GET("/export", admin, func(c *gin.Context) {
+		c.Header("Content-Type", "application/json")
+		c.Header("Content-Disposition", `attachment; filename="stripe.json"`)
+		err := ExportCatalog(db, c.Writer)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+	})
+}
@@ -0,0 +1,227 @@
+package apibillme
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/apibillme/stubby"
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/gjson"
+)
+
+func TestCatalogStore(t *testing.T) {
+
+	Convey("Catalog in buntdb", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		Convey("Success - entries are versioned and their changes kept", func() {
+			stored, err := CreateCatalogEntry(db, CatalogEntry{Method: "post", BaseURL: "reports", Units: 10}, "admin|1")
+			So(err, ShouldBeNil)
+			So(stored.Version, ShouldEqual, 1)
+
+			stored, err = UpdateCatalogEntry(db, CatalogEntry{Method: "post", BaseURL: "reports", Units: 20}, 1, "admin|1")
+			So(err, ShouldBeNil)
+			So(stored.Version, ShouldEqual, 2)
+			So(stored.Units, ShouldEqual, 20)
+
+			_, err = UpdateCatalogEntry(db, CatalogEntry{Method: "post", BaseURL: "reports", Units: 30}, 1, "admin|2")
+			So(err, ShouldEqual, errCatalogConflict)
+
+			_, err = CreateCatalogEntry(db, CatalogEntry{Method: "get", BaseURL: "users"}, "admin|1")
+			So(err, ShouldBeNil)
+			err = DeleteCatalogEntry(db, "get", "users", "admin|1")
+			So(err, ShouldBeNil)
+
+			entries, version, err := CatalogEntries(db)
+			So(err, ShouldBeNil)
+			So(version, ShouldEqual, 4)
+			So(entries, ShouldHaveLength, 1)
+
+			changes, err := CatalogHistory(db, "post:reports")
+			So(err, ShouldBeNil)
+			So(changes, ShouldHaveLength, 2)
+			So(changes[0].Action, ShouldEqual, CatalogCreate)
+			So(changes[1].Action, ShouldEqual, CatalogUpdate)
+			So(changes[1].Before.Units, ShouldEqual, 10)
+			So(changes[1].After.Units, ShouldEqual, 20)
+			So(changes[1].Actor, ShouldEqual, "admin|1")
+		})
+
+		Convey("Failure - invalid entries", func() {
+			_, err := CreateCatalogEntry(db, CatalogEntry{Method: "GET", BaseURL: "users"}, "")
+			So(err, ShouldBeError)
+			_, err = CreateCatalogEntry(db, CatalogEntry{Method: "get", BaseURL: "users/12"}, "")
+			So(err, ShouldBeError)
+			_, err = CreateCatalogEntry(db, CatalogEntry{Method: "get", BaseURL: "users", FailPolicy: "maybe"}, "")
+			So(err, ShouldBeError)
+			_, err = CreateCatalogEntry(db, CatalogEntry{Method: "get", BaseURL: "users", Limits: Limits{Quota: &Quota{Limit: 1, Period: "year"}}}, "")
+			So(err, ShouldBeError)
+			err = DeleteCatalogEntry(db, "get", "users", "")
+			So(err, ShouldEqual, errCatalogEntryNotFound)
+		})
+
+		Convey("Success - import and export in the file format", func() {
+			count, err := ImportCatalog(db, "testdata/catalog.json", "admin|1")
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 3)
+
+			var buf bytes.Buffer
+			err = ExportCatalog(db, &buf)
+			So(err, ShouldBeNil)
+			var exported Catalog
+			err = json.Unmarshal(buf.Bytes(), &exported)
+			So(err, ShouldBeNil)
+			So(exported.Version, ShouldEqual, "1")
+			So(exported.Scopes, ShouldHaveLength, 3)
+			So(exported.Plans["pro"].Scopes["get:users"].Quota.Limit, ShouldEqual, 1)
+
+			catalog, err := loadStoredCatalog(db)
+			So(err, ShouldBeNil)
+			So(catalog.limits("pro", "get", "users").RateLimit.Limit, ShouldEqual, 10)
+
+			// the cached catalog is rebuilt on a change
+			_, err = CreateCatalogEntry(db, CatalogEntry{Method: "post", BaseURL: "reports"}, "admin|1")
+			So(err, ShouldBeNil)
+			catalog, err = loadStoredCatalog(db)
+			So(err, ShouldBeNil)
+			So(catalog.Version, ShouldEqual, "2")
+			So(catalog.entry("post", "reports"), ShouldNotBeNil)
+		})
+	})
+
+	Convey("MountCatalogAdmin", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		viper.AutomaticEnv()
+		identity := &Identity{Method: MethodAPIKey, Subject: "admin|1", Scopes: []string{"admin:catalog"}}
+		request := func(identity *Identity, method string, url string, body string, header http.Header) *httptest.ResponseRecorder {
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			MountCatalogAdmin(router.Group("/catalog"), db, WithAuthenticator(&stubAuthenticator{identity: identity}))
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest(method, url, strings.NewReader(body))
+			for key := range header {
+				req.Header.Set(key, header.Get(key))
+			}
+			router.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		Convey("Success - create, update, list, history and export", func() {
+			recorder := request(identity, "POST", "/catalog/entries", `{"method": "post", "baseURL": "reports", "units": 10, "failPolicy": "open"}`, nil)
+			So(recorder.Code, ShouldEqual, http.StatusCreated)
+			So(gjson.Get(recorder.Body.String(), "version").Int(), ShouldEqual, 1)
+
+			recorder = request(identity, "POST", "/catalog/entries", `{"method": "post", "baseURL": "reports"}`, nil)
+			So(recorder.Code, ShouldEqual, http.StatusConflict)
+
+			recorder = request(identity, "GET", "/catalog/entries/post/reports", "", nil)
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(recorder.Header().Get("ETag"), ShouldEqual, "1")
+
+			recorder = request(identity, "PUT", "/catalog/entries/post/reports", `{"units": 5, "quota": {"limit": 100}}`, http.Header{"If-Match": {"1"}})
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(gjson.Get(recorder.Body.String(), "units").Int(), ShouldEqual, 5)
+
+			recorder = request(identity, "PUT", "/catalog/entries/post/reports", `{"units": 6}`, http.Header{"If-Match": {"1"}})
+			So(recorder.Code, ShouldEqual, http.StatusConflict)
+
+			recorder = request(identity, "GET", "/catalog/entries", "", nil)
+			So(gjson.Get(recorder.Body.String(), "version").Int(), ShouldEqual, 2)
+			So(gjson.Get(recorder.Body.String(), "entries.#").Int(), ShouldEqual, 1)
+
+			recorder = request(identity, "GET", "/catalog/history?scope=post:reports", "", nil)
+			So(gjson.Get(recorder.Body.String(), "changes.#.action").String(), ShouldEqual, `["create","update"]`)
+
+			recorder = request(identity, "GET", "/catalog/export", "", nil)
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(gjson.Get(recorder.Body.String(), "scopes.0.quota.limit").Int(), ShouldEqual, 100)
+
+			recorder = request(identity, "DELETE", "/catalog/entries/post/reports", "", nil)
+			So(recorder.Code, ShouldEqual, http.StatusNoContent)
+			recorder = request(identity, "GET", "/catalog/entries/post/reports", "", nil)
+			So(recorder.Code, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("Failure - the admin scope is required", func() {
+			recorder := request(&Identity{Method: MethodAPIKey, Subject: "apikey|1", Scopes: []string{"get:catalog"}}, "GET", "/catalog/entries", "", nil)
+			So(recorder.Code, ShouldEqual, http.StatusForbidden)
+
+			os.Setenv("CATALOG_ADMIN_SCOPE", "get:catalog")
+			defer os.Setenv("CATALOG_ADMIN_SCOPE", "")
+			recorder = request(&Identity{Method: MethodAPIKey, Subject: "apikey|1", Scopes: []string{"get:catalog"}}, "GET", "/catalog/entries", "", nil)
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("Failure - invalid entry", func() {
+			recorder := request(identity, "POST", "/catalog/entries", `{"method": "post", "baseURL": "reports", "units": -1}`, nil)
+			So(recorder.Code, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+
+	Convey("Run - catalog in buntdb", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		viper.AutomaticEnv()
+		os.Setenv("CATALOG_STORE", "buntdb")
+		os.Setenv("RBAC_VALIDATE", "false")
+		os.Setenv("STRIPE_VALIDATE", "true")
+		defer os.Setenv("CATALOG_STORE", "")
+
+		stub := stubby.StubFunc(&restlyPostJSON, nil, errors.New("foobar"))
+		defer stub.Reset()
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		identity := &Identity{Method: MethodAPIKey, Subject: "apikey|1", CustomerID: "cus_123"}
+		router.Use(Run(db, WithAuthenticator(&stubAuthenticator{identity: identity})))
+		router.POST("/reports", func(c *gin.Context) {
+			c.String(http.StatusOK, "ok")
+		})
+		request := func() int {
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/reports", nil)
+			router.ServeHTTP(recorder, req)
+			return recorder.Code
+		}
+
+		Convey("Failure - the catalog is empty", func() {
+			So(request(), ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("Success - entries apply without a restart and fail open", func() {
+			_, err := CreateCatalogEntry(db, CatalogEntry{Method: "post", BaseURL: "reports"}, "admin|1")
+			So(err, ShouldBeNil)
+			So(request(), ShouldEqual, http.StatusUnauthorized)
+
+			_, err = UpdateCatalogEntry(db, CatalogEntry{Method: "post", BaseURL: "reports", FailPolicy: FailOpen}, 0, "admin|1")
+			So(err, ShouldBeNil)
+			So(request(), ShouldEqual, http.StatusOK)
+		})
+	})
+}
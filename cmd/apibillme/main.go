@@ -0,0 +1,149 @@
+// apibillme - admin commands of the apibillme middleware
+//
+//	apibillme reconcile -db /data/apibillme.db -billed https://billing.example.com/usage -from 2019-03-01 -to 2019-04-01 [-customer cus_123] [-correct]
+//	apibillme audit-verify -db /data/apibillme.db | -dir /data/audit
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/apibillme/apibillme"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "reconcile":
+		err = reconcile(os.Args[2:])
+	case "audit-verify":
+		err = auditVerify(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: apibillme reconcile|audit-verify [flags]")
+	os.Exit(2)
+}
+
+// reconcile - print the reconciliation report of the ledger and the billing backend as JSON
+func reconcile(args []string) error {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	dbPath := flags.String("db", "", "the buntdb file of the middleware")
+	billed := flags.String("billed", "", "the billed usage - a JSON/JSONL file or a URL")
+	authorization := flags.String("authorization", "", "the Authorization header of the billed usage URL")
+	from := flags.String("from", "", "start of the period (2006-01-02 or RFC 3339)")
+	to := flags.String("to", "", "end of the period - exclusive (2006-01-02 or RFC 3339)")
+	customer := flags.String("customer", "", "only reconcile a customer")
+	correct := flags.Bool("correct", false, "charge the missing units (uses the stripe_key ENV VAR)")
+	flags.Parse(args)
+
+	if *dbPath == "" || *billed == "" {
+		return fmt.Errorf("-db and -billed are required")
+	}
+	fromTime, err := parseTime(*from)
+	if err != nil {
+		return err
+	}
+	toTime, err := parseTime(*to)
+	if err != nil {
+		return err
+	}
+
+	var source apibillme.UsageSource = &apibillme.FileUsageSource{Path: *billed}
+	if strings.HasPrefix(*billed, "http://") || strings.HasPrefix(*billed, "https://") {
+		header := http.Header{}
+		if *authorization != "" {
+			header.Set("Authorization", *authorization)
+		}
+		source = &apibillme.HTTPUsageSource{URL: *billed, Header: header}
+	}
+
+	db, err := buntdb.Open(*dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	viper.AutomaticEnv()
+	report, err := apibillme.Reconcile(db, source, fromTime, toTime, apibillme.ReconcileOptions{
+		CustomerID: *customer,
+		Correct:    *correct,
+		StripeKey:  cast.ToString(viper.Get("stripe_key")),
+	})
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+// auditVerify - print the verification of the audit log as JSON (exit status 1 when it was tampered with)
+func auditVerify(args []string) error {
+	flags := flag.NewFlagSet("audit-verify", flag.ExitOnError)
+	dbPath := flags.String("db", "", "the buntdb file of the middleware (audit_log=buntdb)")
+	dir := flags.String("dir", "", "the directory of the audit files (audit_log=file)")
+	flags.Parse(args)
+
+	var auditLog *apibillme.AuditLog
+	switch {
+	case *dbPath != "":
+		db, err := buntdb.Open(*dbPath)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		auditLog = apibillme.NewBuntDBAuditLog(db)
+	case *dir != "":
+		var err error
+		auditLog, err = apibillme.NewFileAuditLog(*dir, 0)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("-db or -dir is required")
+	}
+
+	verification, err := auditLog.Verify()
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(verification)
+	if err != nil {
+		return err
+	}
+	if !verification.Valid {
+		return fmt.Errorf("the audit log was tampered with")
+	}
+	return nil
+}
+
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, fmt.Errorf("-from and -to are required")
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,140 @@
+package apibillme
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Concurrency - at most Limit requests in flight per caller - Timeout (e.g. 5s) queues the others instead of a 429
+type Concurrency struct {
+	Limit   int    `json:"limit"`
+	Timeout string `json:"timeout,omitempty"`
+	// scoped - the limit is of a scope (per scope) and not of a plan (for all scopes)
+	scoped bool
+}
+
+// ConcurrencyStats - how often concurrency limits were hit (since the process started)
+type ConcurrencyStats struct {
+	// Allowed - requests that got a slot right away
+	Allowed uint64
+	// Queued - requests that got a slot after waiting
+	Queued uint64
+	// Rejected - requests that got no slot (right away or after the timeout)
+	Rejected uint64
+}
+
+var concurrencyStats ConcurrencyStats
+
+// GetConcurrencyStats - how often concurrency limits were hit
+func GetConcurrencyStats() ConcurrencyStats {
+	return ConcurrencyStats{
+		Allowed:  atomic.LoadUint64(&concurrencyStats.Allowed),
+		Queued:   atomic.LoadUint64(&concurrencyStats.Queued),
+		Rejected: atomic.LoadUint64(&concurrencyStats.Rejected),
+	}
+}
+
+var errConcurrencyLimit = errors.New("too many requests in flight")
+
+// slots - the in-flight requests of a caller
+type slots struct {
+	inFlight chan struct{}
+	// users - requests holding or waiting for a slot (removed at 0)
+	users int
+}
+
+// concurrencyLimiter - the slots of callers in the memory of this process
+type concurrencyLimiter struct {
+	sync.Mutex
+	slots map[string]*slots
+}
+
+var concurrency = &concurrencyLimiter{slots: map[string]*slots{}}
+
+func (l *concurrencyLimiter) done(key string, s *slots) {
+	l.Lock()
+	defer l.Unlock()
+	s.users--
+	if s.users == 0 {
+		delete(l.slots, key)
+	}
+}
+
+// acquire - take a slot (waiting up to timeout) - the release func gives it back
+func (l *concurrencyLimiter) acquire(ctx context.Context, key string, limit int, timeout time.Duration) (func(), error) {
+	// the limit is part of the key so catalog changes take effect
+	key += ":" + strconv.Itoa(limit)
+	l.Lock()
+	s, ok := l.slots[key]
+	if !ok {
+		s = &slots{inFlight: make(chan struct{}, limit)}
+		l.slots[key] = s
+	}
+	s.users++
+	l.Unlock()
+
+	release := func() {
+		<-s.inFlight
+		l.done(key, s)
+	}
+	select {
+	case s.inFlight <- struct{}{}:
+		atomic.AddUint64(&concurrencyStats.Allowed, 1)
+		return release, nil
+	default:
+	}
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case s.inFlight <- struct{}{}:
+			atomic.AddUint64(&concurrencyStats.Queued, 1)
+			return release, nil
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}
+	atomic.AddUint64(&concurrencyStats.Rejected, 1)
+	l.done(key, s)
+	return nil, errConcurrencyLimit
+}
+
+// concurrencyKey - the slots of the caller (customer or else subject) and scope
+func concurrencyKey(identity *Identity, serverMethod string, serverBaseURL string, scoped bool) string {
+	key := "sub:" + identity.Subject
+	if identity.CustomerID != "" {
+		key = "customer:" + identity.CustomerID
+	}
+	if scoped {
+		key += ":" + serverMethod + ":" + serverBaseURL
+	}
+	return key
+}
+
+// checkConcurrency - take a slot of the caller until the handler is done - 429 when there is none
+func checkConcurrency(req *http.Request, d *decision, limit *Concurrency) error {
+	timeout := time.Duration(0)
+	if limit.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(limit.Timeout)
+		if err != nil {
+			return newStatusError(http.StatusInternalServerError, "Concurrency limit is misconfigured - contact your admin")
+		}
+	}
+	if limit.Limit <= 0 {
+		return newStatusError(http.StatusInternalServerError, "Concurrency limit is misconfigured - contact your admin")
+	}
+	key := concurrencyKey(d.identity, d.serverMethod, d.serverBaseURL, limit.scoped)
+	release, err := concurrency.acquire(req.Context(), key, limit.Limit, timeout)
+	if err != nil {
+		d.headers.Set("Retry-After", "1")
+		return newStatusError(http.StatusTooManyRequests, "Too Many Requests - too many requests in flight")
+	}
+	d.release = release
+	return nil
+}
@@ -0,0 +1,123 @@
+package apibillme
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+)
+
+func TestConcurrency(t *testing.T) {
+
+	Convey("concurrencyLimiter", t, func() {
+
+		limiter := &concurrencyLimiter{slots: map[string]*slots{}}
+		ctx := context.Background()
+
+		Convey("Success - slots are given back", func() {
+			release, err := limiter.acquire(ctx, "customer:cus_123", 1, 0)
+			So(err, ShouldBeNil)
+			_, err = limiter.acquire(ctx, "customer:cus_123", 1, 0)
+			So(err, ShouldEqual, errConcurrencyLimit)
+			release()
+			So(limiter.slots, ShouldBeEmpty)
+			release, err = limiter.acquire(ctx, "customer:cus_123", 1, 0)
+			So(err, ShouldBeNil)
+			release()
+		})
+
+		Convey("Success - queued until a slot is free", func() {
+			before := GetConcurrencyStats()
+			release, _ := limiter.acquire(ctx, "customer:cus_123", 1, 0)
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				release()
+			}()
+			queued, err := limiter.acquire(ctx, "customer:cus_123", 1, time.Second)
+			So(err, ShouldBeNil)
+			queued()
+			So(GetConcurrencyStats().Queued-before.Queued, ShouldEqual, 1)
+		})
+
+		Convey("Failure - queue timeout", func() {
+			before := GetConcurrencyStats()
+			release, _ := limiter.acquire(ctx, "customer:cus_123", 1, 0)
+			defer release()
+			_, err := limiter.acquire(ctx, "customer:cus_123", 1, 10*time.Millisecond)
+			So(err, ShouldEqual, errConcurrencyLimit)
+			So(GetConcurrencyStats().Rejected-before.Rejected, ShouldEqual, 1)
+		})
+
+		Convey("Success - callers have their own slots", func() {
+			release, _ := limiter.acquire(ctx, "customer:cus_123", 1, 0)
+			defer release()
+			other, err := limiter.acquire(ctx, "customer:cus_456", 1, 0)
+			So(err, ShouldBeNil)
+			other()
+		})
+	})
+
+	Convey("Run - concurrency limit", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		viper.AutomaticEnv()
+		os.Setenv("CONCURRENCY_LIMIT", "true")
+		os.Setenv("RBAC_VALIDATE", "false")
+		os.Setenv("STRIPE_VALIDATE", "false")
+		os.Setenv("STRIPE_JSON_PATH", "testdata/catalog.json")
+		defer os.Setenv("CONCURRENCY_LIMIT", "")
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		identity := &Identity{Method: MethodAPIKey, Subject: "apikey|1", CustomerID: "cus_123"}
+		router.Use(Run(db, WithAuthenticator(&stubAuthenticator{identity: identity})))
+		started := make(chan bool)
+		finish := make(chan bool)
+		router.POST("/users", func(c *gin.Context) {
+			started <- true
+			<-finish
+			c.String(http.StatusOK, "ok")
+		})
+
+		request := func() *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/users", nil)
+			router.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		Convey("Success - 429 while a request is in flight", func() {
+			done := make(chan *httptest.ResponseRecorder)
+			go func() {
+				done <- request()
+			}()
+			<-started
+			recorder := request()
+			So(recorder.Code, ShouldEqual, http.StatusTooManyRequests)
+			So(recorder.Header().Get("Retry-After"), ShouldEqual, "1")
+			finish <- true
+			So((<-done).Code, ShouldEqual, http.StatusOK)
+
+			// the slot is given back when the handler is done
+			go func() {
+				done <- request()
+			}()
+			<-started
+			finish <- true
+			So((<-done).Code, ShouldEqual, http.StatusOK)
+		})
+	})
+}
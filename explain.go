@@ -0,0 +1,266 @@
+package apibillme
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+)
+
+// billing decisions of the explanation (besides the no_subscription and bad_request reason codes)
+const (
+	BillingOff          = "off"
+	BillingNotBillable  = "not_billable"
+	BillingAfterHandler = "after_handler"
+	BillingShadow       = "shadow"
+)
+
+// how many explanations are kept for the explain endpoint
+const maxExplanations = 100
+
+// StageTiming - the time a stage of the middleware took
+type StageTiming struct {
+	Stage      string  `json:"stage"`
+	DurationMS float64 `json:"durationMs"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// Explanation - why the middleware allowed or denied a request (debug mode only)
+type Explanation struct {
+	RequestID string    `json:"requestID"`
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	// Route - the normalized route the scopes and the catalog are matched on (e.g. /users)
+	Route string `json:"route"`
+	// RequiredScope - the scope RBAC requires (e.g. get:users)
+	RequiredScope string   `json:"requiredScope"`
+	TokenScopes   []string `json:"tokenScopes"`
+	AuthMethod    string   `json:"authMethod,omitempty"`
+	Subject       string   `json:"subject,omitempty"`
+	CustomerID    string   `json:"customerID,omitempty"`
+	Plan          string   `json:"plan,omitempty"`
+	// CatalogEntry - the entry of the catalog matched by the route (nil if none)
+	CatalogEntry *CatalogEntry `json:"catalogEntry"`
+	// Billing - off, not_billable, charged, failed, after_handler, shadow, no_subscription or bad_request
+	Billing   string           `json:"billing"`
+	Units     int64            `json:"units,omitempty"`
+	Decision  string           `json:"decision"`
+	Error     string           `json:"error,omitempty"`
+	Shadow    []ShadowDecision `json:"shadow,omitempty"`
+	Stages    []StageTiming    `json:"stages"`
+	LatencyMS float64          `json:"latencyMs"`
+}
+
+// productionSetting - the production setting that is on ("" if none)
+// production ENV VAR, gin release mode (GIN_MODE=release) or a live Stripe key
+func productionSetting() string {
+	switch {
+	case cast.ToBool(viper.Get("production")):
+		return "production"
+	case gin.Mode() == gin.ReleaseMode:
+		return "GIN_MODE=release"
+	case strings.Contains(cast.ToString(viper.Get("stripe_key")), "_live_"):
+		return "a live stripe_key"
+	}
+	return ""
+}
+
+// debugMode - debug_mode ENV VAR (never on with production settings)
+func debugMode() bool {
+	return cast.ToBool(viper.Get("debug_mode")) && productionSetting() == ""
+}
+
+// stageTimer - times the stage spans (and passes them on to the tracer)
+type stageTimer struct {
+	Tracer
+	sync.Mutex
+	timings []StageTiming
+}
+
+type timedSpan struct {
+	Span
+	timer *stageTimer
+	name  string
+	start time.Time
+	err   error
+}
+
+func (t *stageTimer) Start(ctx context.Context, name string) (context.Context, Span) {
+	ctx, span := t.Tracer.Start(ctx, name)
+	return ctx, &timedSpan{Span: span, timer: t, name: strings.TrimPrefix(name, "apibillme."), start: time.Now()}
+}
+
+func (s *timedSpan) SetError(err error) {
+	s.err = err
+	s.Span.SetError(err)
+}
+
+func (s *timedSpan) End() {
+	s.Span.End()
+	// the request span is the latency of the explanation
+	if s.name == "request" {
+		return
+	}
+	timing := StageTiming{Stage: s.name, DurationMS: float64(time.Since(s.start)) / float64(time.Millisecond)}
+	if s.err != nil {
+		timing.Error = s.err.Error()
+	}
+	s.timer.Lock()
+	s.timer.timings = append(s.timer.timings, timing)
+	s.timer.Unlock()
+}
+
+// recent explanations (newest last)
+var explanations = struct {
+	sync.Mutex
+	recent []*Explanation
+}{}
+
+// explain - set the X-Apibillme-Decision header and keep the explanation for the explain endpoint
+func explain(req *http.Request, d *decision, err error, latency time.Duration, stages *stageTimer) {
+	e := newExplanation(req, d, err, latency, stages)
+	d.headers.Set("X-Apibillme-Decision", e.header())
+	explanations.Lock()
+	explanations.recent = append(explanations.recent, e)
+	if len(explanations.recent) > maxExplanations {
+		explanations.recent = explanations.recent[len(explanations.recent)-maxExplanations:]
+	}
+	explanations.Unlock()
+}
+
+// newExplanation - the explanation of the decision
+func newExplanation(req *http.Request, d *decision, err error, latency time.Duration, stages *stageTimer) *Explanation {
+	e := &Explanation{
+		RequestID:     d.requestID,
+		Time:          time.Now().UTC(),
+		Method:        d.serverMethod,
+		Path:          req.URL.Path,
+		Route:         "/" + d.serverBaseURL,
+		RequiredScope: d.serverMethod + ":" + d.serverBaseURL,
+		TokenScopes:   []string{},
+		CatalogEntry:  d.entry,
+		Billing:       d.billing,
+		Units:         d.units,
+		Decision:      d.reason,
+		Shadow:        d.shadowDecisions,
+		LatencyMS:     float64(latency) / float64(time.Millisecond),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if e.Billing == "" {
+		e.Billing = "not_evaluated"
+	}
+	if d.identity != nil {
+		e.AuthMethod = d.identity.Method
+		e.Subject = d.identity.Subject
+		e.CustomerID = d.identity.CustomerID
+		e.Plan = d.identity.Plan
+		scopes, _ := urlScopes(d.identity)
+		for _, scope := range scopes {
+			e.TokenScopes = append(e.TokenScopes, scope.Method+":"+scope.URL)
+		}
+	}
+	stages.Lock()
+	e.Stages = append([]StageTiming{}, stages.timings...)
+	stages.Unlock()
+	return e
+}
+
+// header - the explanation as the X-Apibillme-Decision header
+// e.g. decision=insufficient_scope; route=/users; required=get:users; scopes=get:reports; entry=none; billing=not_evaluated; stages=authenticate:0.1ms,rbac:0.0ms
+func (e *Explanation) header() string {
+	entry := "none"
+	if e.CatalogEntry != nil {
+		entry = e.CatalogEntry.Method + ":" + e.CatalogEntry.BaseURL
+	}
+	billing := e.Billing
+	if e.Units > 0 {
+		billing += " " + strconv.FormatInt(e.Units, 10) + " units"
+	}
+	var stages []string
+	for _, stage := range e.Stages {
+		stages = append(stages, fmt.Sprintf("%s:%.1fms", stage.Stage, stage.DurationMS))
+	}
+	parts := []string{
+		"decision=" + e.Decision,
+		"route=" + e.Route,
+		"required=" + e.RequiredScope,
+		"scopes=" + strings.Join(e.TokenScopes, ","),
+		"entry=" + entry,
+		"billing=" + billing,
+	}
+	if len(e.Shadow) > 0 {
+		var shadow []string
+		for _, s := range e.Shadow {
+			shadow = append(shadow, s.Stage+":"+s.Decision)
+		}
+		parts = append(parts, "shadow="+strings.Join(shadow, ","))
+	}
+	parts = append(parts, "stages="+strings.Join(stages, ","))
+	return strings.Join(parts, "; ")
+}
+
+// explainAdminScope - the scope of the explain endpoint (explain_admin_scope ENV VAR - defaults to admin:explain)
+func explainAdminScope() string {
+	scope := strings.ToLower(cast.ToString(viper.Get("explain_admin_scope")))
+	if scope == "" {
+		scope = "admin:explain"
+	}
+	return scope
+}
+
+// Explain - the explain endpoint (mount it on /_apibillme/explain with the options of Run) - 404 unless debug mode is on
+// the caller is authenticated like Run and needs the explain admin scope (explain_admin_scope ENV VAR)
+// ?requestID= returns the explanation of a request (the X-Request-Id) - otherwise the recent ones (newest first)
+func Explain(db *buntdb.DB, opts ...Option) http.HandlerFunc {
+	viper.AutomaticEnv()
+	o := newOptions(opts)
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if !debugMode() {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Not Found - debug_mode is off"})
+			return
+		}
+		if _, status, err := authorizeAdmin(db, r, o, explainAdminScope()); err != nil {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		writeExplanations(w, r)
+	}
+}
+
+// writeExplanations - the explanation of the request ID or the recent ones
+func writeExplanations(w http.ResponseWriter, r *http.Request) {
+	explanations.Lock()
+	defer explanations.Unlock()
+	id := r.URL.Query().Get("requestID")
+	if id == "" {
+		recent := []*Explanation{}
+		for i := len(explanations.recent) - 1; i >= 0; i-- {
+			recent = append(recent, explanations.recent[i])
+		}
+		json.NewEncoder(w).Encode(recent)
+		return
+	}
+	for i := len(explanations.recent) - 1; i >= 0; i-- {
+		if explanations.recent[i].RequestID == id {
+			json.NewEncoder(w).Encode(explanations.recent[i])
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(map[string]string{"error": "Not Found - no explanation for this request"})
+}
@@ -0,0 +1,134 @@
+package apibillme
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/apibillme/stubby"
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/gjson"
+)
+
+func TestExplain(t *testing.T) {
+
+	Convey("productionSetting", t, func() {
+		viper.AutomaticEnv()
+		So(productionSetting(), ShouldBeEmpty)
+
+		os.Setenv("PRODUCTION", "true")
+		So(productionSetting(), ShouldEqual, "production")
+		os.Setenv("PRODUCTION", "")
+
+		os.Setenv("STRIPE_KEY", "sk_live_123")
+		So(productionSetting(), ShouldEqual, "a live stripe_key")
+		os.Setenv("STRIPE_KEY", "")
+
+		gin.SetMode(gin.ReleaseMode)
+		So(productionSetting(), ShouldEqual, "GIN_MODE=release")
+		gin.SetMode(gin.TestMode)
+	})
+
+	Convey("Run - debug mode", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		viper.AutomaticEnv()
+		os.Setenv("DEBUG_MODE", "true")
+		os.Setenv("RBAC_VALIDATE", "true")
+		os.Setenv("STRIPE_VALIDATE", "true")
+		os.Setenv("STRIPE_JSON_PATH", "testdata/metering.json")
+		defer os.Setenv("DEBUG_MODE", "")
+
+		stub := stubby.StubFunc(&restlyPostJSON, nil, nil)
+		defer stub.Reset()
+
+		gin.SetMode(gin.TestMode)
+		identity := &Identity{Method: MethodAPIKey, Subject: "apikey|1", Email: "test@example.com", CustomerID: "cus_123", Scopes: []string{"post:reports"}}
+		router := gin.New()
+		admin := &stubAuthenticator{identity: &Identity{Method: MethodAPIKey, Subject: "admin|1", Scopes: []string{"admin:explain"}}}
+		router.GET("/_apibillme/explain", gin.WrapF(Explain(db, WithAuthenticator(admin))))
+		api := router.Group("/", Run(db, WithAuthenticator(&stubAuthenticator{identity: identity})))
+		handler := func(c *gin.Context) {
+			c.String(http.StatusOK, "ok")
+		}
+		api.GET("/users/:id", handler)
+		api.GET("/Users/:id", handler)
+		api.POST("/reports", handler)
+		request := func(method string, url string) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest(method, url, nil)
+			req.Header.Set("X-Request-Id", "req-"+method)
+			router.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		Convey("Success - the header explains a denial", func() {
+			recorder := request("GET", "/Users/12")
+			So(recorder.Code, ShouldEqual, http.StatusUnauthorized)
+			header := recorder.Header().Get("X-Apibillme-Decision")
+			So(header, ShouldStartWith, "decision=insufficient_scope; route=/users; required=get:users; scopes=post:reports; entry=none; billing=not_evaluated")
+			So(header, ShouldContainSubstring, "stages=authenticate:")
+			So(header, ShouldContainSubstring, "rbac:")
+		})
+
+		Convey("Success - the explain endpoint has the charged entry and the stages", func() {
+			So(request("POST", "/reports").Code, ShouldEqual, http.StatusOK)
+			recorder := request("GET", "/_apibillme/explain?requestID=req-POST")
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			body := recorder.Body.String()
+			So(gjson.Get(body, "decision").String(), ShouldEqual, DecisionAllowed)
+			So(gjson.Get(body, "requiredScope").String(), ShouldEqual, "post:reports")
+			So(gjson.Get(body, "catalogEntry.units").Int(), ShouldEqual, 10)
+			So(gjson.Get(body, "billing").String(), ShouldEqual, LedgerCharged)
+			So(gjson.Get(body, "units").Int(), ShouldEqual, 10)
+			So(gjson.Get(body, "stages.#.stage").String(), ShouldEqual, `["authenticate","revocation","rbac","catalog","billing"]`)
+
+			recorder = request("GET", "/_apibillme/explain")
+			So(gjson.Get(recorder.Body.String(), "0.requestID").String(), ShouldEqual, "req-POST")
+		})
+
+		Convey("Failure - the caller must be authenticated", func() {
+			admin.identity, admin.err = nil, errNoCredentials
+			recorder := request("GET", "/_apibillme/explain")
+			So(recorder.Code, ShouldEqual, http.StatusUnauthorized)
+			So(gjson.Get(recorder.Body.String(), "error").String(), ShouldEqual, "Unauthorized - Invalid Token")
+		})
+
+		Convey("Failure - the caller must have the explain admin scope", func() {
+			So(request("POST", "/reports").Code, ShouldEqual, http.StatusOK)
+			admin.identity = identity
+			recorder := request("GET", "/_apibillme/explain?requestID=req-POST")
+			So(recorder.Code, ShouldEqual, http.StatusForbidden)
+			So(gjson.Get(recorder.Body.String(), "error").String(), ShouldEqual, "Forbidden - the admin:explain scope is required")
+			So(gjson.Get(recorder.Body.String(), "decision").Exists(), ShouldBeFalse)
+		})
+
+		Convey("Failure - unknown request", func() {
+			So(request("GET", "/_apibillme/explain?requestID=foobar").Code, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("Failure - no header or endpoint when debug mode is off", func() {
+			os.Setenv("DEBUG_MODE", "false")
+			So(request("GET", "/users/12").Header().Get("X-Apibillme-Decision"), ShouldBeEmpty)
+			So(request("GET", "/_apibillme/explain").Code, ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("Failure - debug mode cannot be on with production settings", func() {
+			os.Setenv("PRODUCTION", "true")
+			defer os.Setenv("PRODUCTION", "")
+			So(func() { Run(db) }, ShouldPanic)
+			So(request("GET", "/users/12").Header().Get("X-Apibillme-Decision"), ShouldBeEmpty)
+			So(request("GET", "/_apibillme/explain").Code, ShouldEqual, http.StatusNotFound)
+		})
+	})
+}
@@ -0,0 +1,276 @@
+package apibillme
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/gjson"
+)
+
+// health check statuses
+const (
+	HealthOK = "ok"
+	// HealthDegraded - an upstream (the JWKS or the billing backend) is failing - the middleware is still ready
+	HealthDegraded = "degraded"
+	HealthFailed   = "failed"
+	HealthSkipped  = "skipped"
+)
+
+// how long the result of a JWKS or billing probe is reused by default (probes run every few seconds)
+const healthProbeTTL = 30 * time.Second
+
+// HealthCheck - the status of a dependency of the middleware
+type HealthCheck struct {
+	Status  string                 `json:"status"`
+	Error   string                 `json:"error,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// HealthReport - the status of the middleware (failed when a check failed - degraded when an upstream is failing) and of each check
+type HealthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+// Health - the /healthz (liveness) and /readyz (readiness) handlers of the middleware
+type Health struct {
+	db   *buntdb.DB
+	opts []Option
+	// Timeout - the timeout of the JWKS and billing probes (defaults to 5s)
+	Timeout time.Duration
+	// ProbeTTL - how long the result of a JWKS or billing probe is reused (defaults to 30s)
+	ProbeTTL time.Duration
+	// Strict - readiness fails when the JWKS or the billing backend is failing (they are only degraded otherwise)
+	Strict bool
+}
+
+// NewHealth - the health of the middleware run with the same db and options
+func NewHealth(db *buntdb.DB, opts ...Option) *Health {
+	return &Health{db: db, opts: opts, Timeout: 5 * time.Second, ProbeTTL: healthProbeTTL}
+}
+
+// healthProbe - the result of a network probe
+type healthProbe struct {
+	checked time.Time
+	err     error
+	keys    int64
+}
+
+// probes by URL (running - the probes in progress)
+var healthProbes = struct {
+	sync.Mutex
+	byURL   map[string]healthProbe
+	running map[string]bool
+}{byURL: map[string]healthProbe{}, running: map[string]bool{}}
+
+// probe - run the probe of the URL unless it ran in the last ttl (the last result is reused while it runs)
+func probe(URL string, ttl time.Duration, run func() (int64, error)) healthProbe {
+	healthProbes.Lock()
+	cached, ok := healthProbes.byURL[URL]
+	if ok && (time.Since(cached.checked) < ttl || healthProbes.running[URL]) {
+		healthProbes.Unlock()
+		return cached
+	}
+	healthProbes.running[URL] = true
+	healthProbes.Unlock()
+	keys, err := run()
+	result := healthProbe{checked: time.Now(), err: err, keys: keys}
+	healthProbes.Lock()
+	healthProbes.byURL[URL] = result
+	delete(healthProbes.running, URL)
+	healthProbes.Unlock()
+	return result
+}
+
+// Live - 200 while the process can serve requests (the buntdb is open) - 503 otherwise
+func (h *Health) Live(w http.ResponseWriter, r *http.Request) {
+	report := &HealthReport{Checks: map[string]HealthCheck{"buntdb": h.checkDB()}}
+	writeHealth(w, report)
+}
+
+// Ready - 200 when the middleware can authenticate and bill (also when degraded) - 503 otherwise
+func (h *Health) Ready(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, h.Check(r.Context()))
+}
+
+// Check - run every check
+func (h *Health) Check(ctx context.Context) *HealthReport {
+	viper.AutomaticEnv()
+	o := newOptions(h.opts)
+	ctx, cancel := context.WithTimeout(ctx, h.Timeout)
+	defer cancel()
+	// the upstreams are only degraded unless the readiness is strict
+	strict := h.Strict || cast.ToBool(viper.Get("health_strict"))
+	return &HealthReport{Checks: map[string]HealthCheck{
+		"buntdb":  h.checkDB(),
+		"jwks":    upstreamCheck(h.checkJWKS(ctx, o.provider), strict),
+		"catalog": h.checkCatalog(),
+		"billing": upstreamCheck(h.checkBilling(ctx), strict),
+	}}
+}
+
+// upstreamCheck - a failed upstream is degraded unless strict
+func upstreamCheck(check HealthCheck, strict bool) HealthCheck {
+	if check.Status == HealthFailed && !strict {
+		check.Status = HealthDegraded
+	}
+	return check
+}
+
+func writeHealth(w http.ResponseWriter, report *HealthReport) {
+	report.Status = HealthOK
+	for _, check := range report.Checks {
+		if check.Status == HealthFailed {
+			report.Status = HealthFailed
+		} else if check.Status == HealthDegraded && report.Status == HealthOK {
+			report.Status = HealthDegraded
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status == HealthFailed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+func failedCheck(err error, details map[string]interface{}) HealthCheck {
+	return HealthCheck{Status: HealthFailed, Error: err.Error(), Details: details}
+}
+
+// checkDB - the buntdb can be read
+func (h *Health) checkDB() HealthCheck {
+	var keys int
+	err := h.db.View(func(tx *buntdb.Tx) error {
+		var err error
+		keys, err = tx.Len()
+		return err
+	})
+	if err != nil {
+		return failedCheck(err, nil)
+	}
+	return HealthCheck{Status: HealthOK, Details: map[string]interface{}{"keys": keys}}
+}
+
+// jwksProvider - a provider that validates tokens with a JWKS
+type jwksProvider interface {
+	keys(ctx context.Context, db *buntdb.DB) (string, string, error)
+}
+
+// checkJWKS - the JWKS of the provider can be fetched and has keys
+func (h *Health) checkJWKS(ctx context.Context, provider Provider) HealthCheck {
+	keysProvider, ok := provider.(jwksProvider)
+	if !ok {
+		return HealthCheck{Status: HealthSkipped}
+	}
+	jwkURL, _, err := keysProvider.keys(ctx, h.db)
+	if err != nil {
+		return failedCheck(err, nil)
+	}
+	result := probe(jwkURL, h.probeTTL(), func() (int64, error) {
+		jsonBytes, err := fetch(ctx, jwkURL)
+		if err != nil {
+			return 0, err
+		}
+		keys := gjson.GetBytes(jsonBytes, "keys.#").Int()
+		if keys == 0 {
+			return 0, errors.New("the JWKS has no keys")
+		}
+		return keys, nil
+	})
+	details := map[string]interface{}{
+		"url":        jwkURL,
+		"fetchedAt":  result.checked.UTC(),
+		"ageSeconds": int64(time.Since(result.checked).Seconds()),
+	}
+	if result.err != nil {
+		return failedCheck(result.err, details)
+	}
+	details["keys"] = result.keys
+	return HealthCheck{Status: HealthOK, Details: details}
+}
+
+// checkCatalog - the catalog (file or buntdb) loads when a stage needs it
+func (h *Health) checkCatalog() HealthCheck {
+	if !cast.ToBool(viper.Get("rate_limit")) && !cast.ToBool(viper.Get("quota")) &&
+		!cast.ToBool(viper.Get("concurrency_limit")) && !cast.ToBool(viper.Get("stripe_validate")) && !shadowConfigured("stripe_shadow") {
+		return HealthCheck{Status: HealthSkipped}
+	}
+	details := map[string]interface{}{"path": cast.ToString(viper.Get("stripe_json_path"))}
+	if strings.ToLower(cast.ToString(viper.Get("catalog_store"))) == "buntdb" {
+		details = map[string]interface{}{"store": "buntdb"}
+	}
+	catalog, err := catalogFromConfig(h.db)
+	if err != nil {
+		return failedCheck(err, details)
+	}
+	details["version"] = catalog.Version
+	details["scopes"] = len(catalog.Scopes)
+	details["plans"] = len(catalog.Plans)
+	return HealthCheck{Status: HealthOK, Details: details}
+}
+
+// probeTTL - how long the result of a probe is reused
+func (h *Health) probeTTL() time.Duration {
+	if h.ProbeTTL <= 0 {
+		return healthProbeTTL
+	}
+	return h.ProbeTTL
+}
+
+// checkBilling - the billing backend answers (any HTTP status) - with the charges in flight, the last error and the circuit breaker
+func (h *Health) checkBilling(ctx context.Context) HealthCheck {
+	if !cast.ToBool(viper.Get("stripe_validate")) && !shadowConfigured("stripe_shadow") {
+		return HealthCheck{Status: HealthSkipped}
+	}
+	result := probe(billingURL, h.probeTTL(), func() (int64, error) {
+		req, err := http.NewRequest("HEAD", billingURL, nil)
+		if err != nil {
+			return 0, err
+		}
+		res, err := httpClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return 0, err
+		}
+		res.Body.Close()
+		return 0, nil
+	})
+	billingStatus.Lock()
+	breaker := breakerState(time.Now())
+	details := map[string]interface{}{
+		"url":       billingURL,
+		"checkedAt": result.checked.UTC(),
+		// chargesInFlight - the charges that have not answered yet (charges are sent synchronously)
+		"chargesInFlight": billingStatus.inFlight,
+		"breaker":         breaker,
+		// consecutiveFailures - the failed charges since the last successful one
+		"consecutiveFailures": billingStatus.failures,
+	}
+	if breaker == BreakerOpen {
+		details["breakerOpenUntil"] = billingStatus.openUntil.UTC()
+	}
+	if !billingStatus.lastSuccess.IsZero() {
+		details["lastSuccessAt"] = billingStatus.lastSuccess.UTC()
+	}
+	if billingStatus.lastError != "" {
+		details["lastError"] = billingStatus.lastError
+		details["lastErrorAt"] = billingStatus.lastErrorAt.UTC()
+	}
+	billingStatus.Unlock()
+	if result.err != nil {
+		return failedCheck(result.err, details)
+	}
+	// the charges fail fast while the breaker is open
+	if breaker == BreakerOpen {
+		return failedCheck(errBreakerOpen, details)
+	}
+	return HealthCheck{Status: HealthOK, Details: details}
+}
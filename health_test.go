@@ -0,0 +1,180 @@
+package apibillme
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/apibillme/stubby"
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/gjson"
+	"github.com/valyala/fasthttp"
+)
+
+func TestHealth(t *testing.T) {
+
+	Convey("Health", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		// local JWKS and billing backend stand-in
+		jwks := `{"keys":[{"kid":"1"},{"kid":"2"}]}`
+		billingUp := true
+		billingProbes := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/jwks":
+				w.Write([]byte(jwks))
+			case "/billing":
+				billingProbes++
+				if !billingUp {
+					hj, _ := w.(http.Hijacker)
+					conn, _, _ := hj.Hijack()
+					conn.Close()
+					return
+				}
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		defer server.Close()
+		billingURL = server.URL + "/billing"
+		defer func() { billingURL = "https://api.apibill.me" }()
+		healthProbes.byURL = map[string]healthProbe{}
+
+		viper.AutomaticEnv()
+		os.Setenv("STRIPE_VALIDATE", "true")
+		os.Setenv("STRIPE_JSON_PATH", "testdata/catalog.json")
+
+		health := NewHealth(db, WithProvider(&OIDCProvider{JWKURL: server.URL + "/jwks"}))
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		router.GET("/healthz", gin.WrapF(health.Live))
+		router.GET("/readyz", gin.WrapF(health.Ready))
+		request := func(path string) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", path, nil)
+			router.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		Convey("Success - every check is ok", func() {
+			recorder := request("/readyz")
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			body := recorder.Body.String()
+			So(gjson.Get(body, "status").String(), ShouldEqual, HealthOK)
+			So(gjson.Get(body, "checks.buntdb.status").String(), ShouldEqual, HealthOK)
+			So(gjson.Get(body, "checks.jwks.details.keys").Int(), ShouldEqual, 2)
+			So(gjson.Get(body, "checks.catalog.details.version").String(), ShouldStartWith, "sha256:")
+			So(gjson.Get(body, "checks.billing.status").String(), ShouldEqual, HealthOK)
+			So(gjson.Get(body, "checks.billing.details.chargesInFlight").Int(), ShouldEqual, 0)
+			So(gjson.Get(body, "checks.billing.details.breaker").String(), ShouldEqual, BreakerDisabled)
+		})
+
+		Convey("Success - the probes are reused", func() {
+			request("/readyz")
+			request("/readyz")
+			So(billingProbes, ShouldEqual, 1)
+			health.ProbeTTL = time.Nanosecond
+			request("/readyz")
+			So(billingProbes, ShouldEqual, 2)
+		})
+
+		Convey("Success - checks of unused dependencies are skipped", func() {
+			os.Setenv("STRIPE_VALIDATE", "false")
+			defer os.Setenv("STRIPE_VALIDATE", "true")
+			body := request("/readyz").Body.String()
+			So(gjson.Get(body, "checks.catalog.status").String(), ShouldEqual, HealthSkipped)
+			So(gjson.Get(body, "checks.billing.status").String(), ShouldEqual, HealthSkipped)
+		})
+
+		Convey("Degraded - the JWKS has no keys", func() {
+			jwks = `{"keys":[]}`
+			recorder := request("/readyz")
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(gjson.Get(recorder.Body.String(), "status").String(), ShouldEqual, HealthDegraded)
+			So(gjson.Get(recorder.Body.String(), "checks.jwks.status").String(), ShouldEqual, HealthDegraded)
+		})
+
+		Convey("Degraded - the billing backend is unreachable", func() {
+			billingUp = false
+			recorder := request("/readyz")
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(gjson.Get(recorder.Body.String(), "status").String(), ShouldEqual, HealthDegraded)
+			So(gjson.Get(recorder.Body.String(), "checks.billing.status").String(), ShouldEqual, HealthDegraded)
+		})
+
+		Convey("Failure - the upstreams fail the readiness when strict", func() {
+			billingUp = false
+			jwks = `{"keys":[]}`
+			health.Strict = true
+			recorder := request("/readyz")
+			So(recorder.Code, ShouldEqual, http.StatusServiceUnavailable)
+			So(gjson.Get(recorder.Body.String(), "checks.jwks.status").String(), ShouldEqual, HealthFailed)
+			So(gjson.Get(recorder.Body.String(), "checks.billing.status").String(), ShouldEqual, HealthFailed)
+		})
+
+		Convey("Degraded - the billing circuit breaker is open", func() {
+			os.Setenv("BILLING_BREAKER_FAILURES", "2")
+			defer os.Setenv("BILLING_BREAKER_FAILURES", "")
+			defer func() {
+				billingStatus.failures, billingStatus.openUntil, billingStatus.trial = 0, time.Time{}, false
+			}()
+			calls := 0
+			stub := stubby.Stub(&restlyPostJSON, func(req *fasthttp.Request, uri string, body string) (gjson.Result, error) {
+				calls++
+				return gjson.Result{}, errors.New("connection refused")
+			})
+			defer func() { stub.Reset() }()
+			event := usageEvent{ServerMethod: "get", ServerBaseURL: "users", CustomerID: "cus_123", Units: 1}
+			So(charge("sk_test", event, nil), ShouldBeError)
+			So(gjson.Get(request("/readyz").Body.String(), "checks.billing.details.breaker").String(), ShouldEqual, BreakerClosed)
+			So(charge("sk_test", event, nil), ShouldBeError)
+
+			// the charges fail fast while the breaker is open
+			So(charge("sk_test", event, nil), ShouldEqual, errBreakerOpen)
+			So(calls, ShouldEqual, 2)
+			recorder := request("/readyz")
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			body := recorder.Body.String()
+			So(gjson.Get(body, "checks.billing.status").String(), ShouldEqual, HealthDegraded)
+			So(gjson.Get(body, "checks.billing.details.breaker").String(), ShouldEqual, BreakerOpen)
+			So(gjson.Get(body, "checks.billing.details.consecutiveFailures").Int(), ShouldEqual, 2)
+
+			// after the cooldown a trial charge closes it
+			billingStatus.openUntil = time.Now().Add(-time.Second)
+			So(gjson.Get(request("/readyz").Body.String(), "checks.billing.details.breaker").String(), ShouldEqual, BreakerHalfOpen)
+			stub.Reset()
+			stub = stubby.StubFunc(&restlyPostJSON, gjson.Result{}, nil)
+			So(charge("sk_test", event, nil), ShouldBeNil)
+			So(gjson.Get(request("/readyz").Body.String(), "checks.billing.details.breaker").String(), ShouldEqual, BreakerClosed)
+		})
+
+		Convey("Failure - the catalog cannot be loaded", func() {
+			os.Setenv("STRIPE_JSON_PATH", "testdata/foobar.json")
+			recorder := request("/readyz")
+			So(recorder.Code, ShouldEqual, http.StatusServiceUnavailable)
+			So(gjson.Get(recorder.Body.String(), "checks.catalog.status").String(), ShouldEqual, HealthFailed)
+		})
+
+		Convey("Live - only the buntdb", func() {
+			recorder := request("/healthz")
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(gjson.Get(recorder.Body.String(), "checks.jwks").Exists(), ShouldBeFalse)
+
+			db.Close()
+			recorder = request("/healthz")
+			So(recorder.Code, ShouldEqual, http.StatusServiceUnavailable)
+		})
+	})
+}
@@ -0,0 +1,276 @@
+package apibillme
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+)
+
+// HMAC signing scheme (similar to AWS SigV4)
+const (
+	hmacScheme      = "APIBILLME-HMAC-SHA256"
+	hmacDateHeader  = "X-Apibillme-Date"
+	hmacNonceHeader = "X-Apibillme-Nonce"
+	hmacDateFormat  = "20060102T150405Z"
+	// default allowed clock skew of a signed request (hmac_window ENV VAR)
+	hmacWindow = 5 * time.Minute
+)
+
+// HMACClient - a machine client that signs its requests with a shared secret
+type HMACClient struct {
+	// ID - the Credential of the signature
+	ID string `json:"id"`
+	// Secret - the shared signing secret
+	Secret string `json:"secret"`
+	// CustomerID - the billing customer of the client
+	CustomerID string `json:"customerID"`
+	// Scopes - the scopes of the client (e.g. get:users)
+	Scopes []string `json:"scopes"`
+}
+
+func hmacClientKey(id string) string {
+	return "apibillme:hmac:" + id
+}
+
+func hmacNonceKey(id string, nonce string) string {
+	return "apibillme:hmac:nonce:" + id + ":" + nonce
+}
+
+// CreateHMACClient - create a client with a new signing secret for a billing customer and scopes
+func CreateHMACClient(db *buntdb.DB, customerID string, scopes []string) (*HMACClient, error) {
+	if customerID == "" {
+		return nil, errors.New("customer ID is required")
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+	client := &HMACClient{ID: id, Secret: secret, CustomerID: customerID, Scopes: scopes}
+	jsonBytes, err := json.Marshal(client)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(hmacClientKey(id), string(jsonBytes), nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// GetHMACClient - get a client by its ID
+func GetHMACClient(db *buntdb.DB, id string) (*HMACClient, error) {
+	var client HMACClient
+	err := db.View(func(tx *buntdb.Tx) error {
+		val, err := tx.Get(hmacClientKey(id))
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal([]byte(val), &client)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+// DeleteHMACClient - delete a client
+func DeleteHMACClient(db *buntdb.DB, id string) error {
+	return db.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete(hmacClientKey(id))
+		return err
+	})
+}
+
+// SignRequest - sign a request as the client (sets the date, nonce and Authorization headers)
+func SignRequest(req *http.Request, clientID string, secret string, signedHeaders []string) error {
+	nonce, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(hmacDateHeader, time.Now().UTC().Format(hmacDateFormat))
+	req.Header.Set(hmacNonceHeader, nonce)
+	var names []string
+	for _, name := range signedHeaders {
+		names = append(names, strings.ToLower(name))
+	}
+	signature, err := signature(req, secret, names)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", hmacScheme+" Credential="+clientID+", SignedHeaders="+strings.Join(names, ";")+", Signature="+signature)
+	return nil
+}
+
+// signature - hex HMAC of the string to sign of the request
+func signature(req *http.Request, secret string, signedHeaders []string) (string, error) {
+	canonical, err := canonicalRequest(req, signedHeaders)
+	if err != nil {
+		return "", err
+	}
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	stringToSign := hmacScheme + "\n" +
+		req.Header.Get(hmacDateHeader) + "\n" +
+		req.Header.Get(hmacNonceHeader) + "\n" +
+		hex.EncodeToString(canonicalHash[:])
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(stringToSign))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// canonicalRequest - method, path, sorted query, signed headers and body hash
+func canonicalRequest(req *http.Request, signedHeaders []string) (string, error) {
+	// read the body and put it back for the handler
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		if err != nil {
+			return "", err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	bodyHash := sha256.Sum256(body)
+
+	var headers []string
+	for _, name := range signedHeaders {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.Host
+		}
+		headers = append(headers, name+":"+strings.TrimSpace(value))
+	}
+
+	return strings.Join([]string{
+		strings.ToUpper(req.Method),
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		strings.Join(headers, "\n"),
+		strings.Join(signedHeaders, ";"),
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n"), nil
+}
+
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, url.QueryEscape(key)+"="+url.QueryEscape(value))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// parseHMACAuthorization - get Credential, SignedHeaders and Signature of the Authorization header
+func parseHMACAuthorization(header string) (map[string]string, bool) {
+	tokenParts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	if len(tokenParts) != 2 || !strings.EqualFold(tokenParts[0], hmacScheme) {
+		return nil, false
+	}
+	fields := map[string]string{}
+	for _, field := range strings.Split(tokenParts[1], ",") {
+		pair := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(pair) == 2 {
+			fields[pair[0]] = pair[1]
+		}
+	}
+	return fields, true
+}
+
+// useNonce - save the nonce of the client - fails if it was already used in the window
+func useNonce(db *buntdb.DB, clientID string, nonce string, window time.Duration) error {
+	return db.Update(func(tx *buntdb.Tx) error {
+		key := hmacNonceKey(clientID, nonce)
+		_, err := tx.Get(key)
+		if err == nil {
+			return errors.New("nonce was already used")
+		}
+		_, _, err = tx.Set(key, "", &buntdb.SetOptions{Expires: true, TTL: 2 * window})
+		return err
+	})
+}
+
+func verifyHMAC(db *buntdb.DB, req *http.Request, fields map[string]string) (*HMACClient, error) {
+	client, err := GetHMACClient(db, fields["Credential"])
+	if err != nil {
+		return nil, err
+	}
+
+	// the timestamp must be in the window
+	window := cast.ToDuration(viper.Get("hmac_window"))
+	if window <= 0 {
+		window = hmacWindow
+	}
+	date, err := time.Parse(hmacDateFormat, req.Header.Get(hmacDateHeader))
+	if err != nil {
+		return nil, err
+	}
+	skew := time.Since(date)
+	if skew > window || skew < -window {
+		return nil, errors.New("request date is outside the window")
+	}
+	nonce := req.Header.Get(hmacNonceHeader)
+	if nonce == "" {
+		return nil, errors.New("request has no nonce")
+	}
+
+	var signedHeaders []string
+	if fields["SignedHeaders"] != "" {
+		signedHeaders = strings.Split(strings.ToLower(fields["SignedHeaders"]), ";")
+	}
+	expected, err := signature(req, client.Secret, signedHeaders)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(expected), []byte(fields["Signature"])) {
+		return nil, errors.New("signature does not match")
+	}
+
+	// only burn the nonce of valid signatures (replay protection)
+	err = useNonce(db, client.ID, nonce, window)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// HMACAuthenticator - authenticates requests signed with Authorization: APIBILLME-HMAC-SHA256 Credential=..., SignedHeaders=..., Signature=...
+type HMACAuthenticator struct{}
+
+// Authenticate - verify the signature of the request and return the identity of its client
+func (a *HMACAuthenticator) Authenticate(db *buntdb.DB, req *http.Request) (*Identity, error) {
+	fields, ok := parseHMACAuthorization(req.Header.Get("Authorization"))
+	if !ok {
+		return nil, errNoCredentials
+	}
+	client, err := verifyHMAC(db, req, fields)
+	if err != nil {
+		return nil, errors.New("Unauthorized - Invalid Signature")
+	}
+	return &Identity{
+		Method:     MethodHMAC,
+		Subject:    "hmac|" + client.ID,
+		CustomerID: client.CustomerID,
+		Scopes:     client.Scopes,
+	}, nil
+}
@@ -0,0 +1,102 @@
+package apibillme
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+)
+
+func TestHMAC(t *testing.T) {
+
+	Convey("HMACAuthenticator", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		client, err := CreateHMACClient(db, "cus_123", []string{"post:reports"})
+		So(err, ShouldBeNil)
+
+		req, err := http.NewRequest("POST", "http://api.example.com/reports?b=2&a=1", strings.NewReader(`{"foo":"bar"}`))
+		So(err, ShouldBeNil)
+		req.Header.Set("Content-Type", "application/json")
+		err = SignRequest(req, client.ID, client.Secret, []string{"Host", "Content-Type"})
+		So(err, ShouldBeNil)
+		authenticator := &HMACAuthenticator{}
+
+		Convey("Success - valid signature", func() {
+			identity, err := authenticator.Authenticate(db, req)
+			So(err, ShouldBeNil)
+			So(identity.Method, ShouldEqual, MethodHMAC)
+			So(identity.CustomerID, ShouldEqual, "cus_123")
+			So(identity.Scopes, ShouldResemble, []string{"post:reports"})
+
+			Convey("and the body is still readable", func() {
+				body, err := ioutil.ReadAll(req.Body)
+				So(err, ShouldBeNil)
+				So(string(body), ShouldEqual, `{"foo":"bar"}`)
+			})
+
+			Convey("Failure - replayed request", func() {
+				_, err := authenticator.Authenticate(db, req)
+				So(err, ShouldBeError)
+			})
+		})
+
+		Convey("Failure - tampered body", func() {
+			req.Body = ioutil.NopCloser(strings.NewReader(`{"foo":"baz"}`))
+			_, err := authenticator.Authenticate(db, req)
+			So(err, ShouldBeError)
+		})
+
+		Convey("Failure - tampered query", func() {
+			req.URL.RawQuery = "a=1&b=3"
+			_, err := authenticator.Authenticate(db, req)
+			So(err, ShouldBeError)
+		})
+
+		Convey("Failure - tampered signed header", func() {
+			req.Header.Set("Content-Type", "text/plain")
+			_, err := authenticator.Authenticate(db, req)
+			So(err, ShouldBeError)
+		})
+
+		Convey("Failure - date outside the window", func() {
+			viper.AutomaticEnv()
+			os.Setenv("HMAC_WINDOW", "1m")
+			defer os.Setenv("HMAC_WINDOW", "")
+			// re-sign with the old date so only the window fails
+			req.Header.Set(hmacDateHeader, time.Now().Add(-2*time.Minute).UTC().Format(hmacDateFormat))
+			sig, err := signature(req, client.Secret, []string{"host", "content-type"})
+			So(err, ShouldBeNil)
+			req.Header.Set("Authorization", hmacScheme+" Credential="+client.ID+", SignedHeaders=host;content-type, Signature="+sig)
+			_, err = verifyHMAC(db, req, map[string]string{"Credential": client.ID, "SignedHeaders": "host;content-type", "Signature": sig})
+			So(err.Error(), ShouldEqual, "request date is outside the window")
+			_, err = authenticator.Authenticate(db, req)
+			So(err, ShouldBeError)
+		})
+
+		Convey("Failure - unknown client", func() {
+			err := DeleteHMACClient(db, client.ID)
+			So(err, ShouldBeNil)
+			_, err = authenticator.Authenticate(db, req)
+			So(err, ShouldBeError)
+		})
+
+		Convey("Failure - no signature", func() {
+			req.Header.Del("Authorization")
+			_, err := authenticator.Authenticate(db, req)
+			So(err, ShouldEqual, errNoCredentials)
+		})
+	})
+}
@@ -0,0 +1,167 @@
+package apibillme
+
+import (
+	"errors"
+
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+)
+
+// Identity - the authenticated caller of a request
+type Identity struct {
+	// Method - how the caller was authenticated (jwt, apikey, hmac, mtls, introspection)
+	Method string
+	// Subject - the sub of the access_token (or the ID of the credential)
+	Subject string
+	// Email - the email of the user (empty if the token has none)
+	Email string
+	// OrgID - the organization of the user (only set when org_billing is on)
+	OrgID string
+	// CustomerID - the billing customer (the organization's when org_billing is on)
+	CustomerID string
+	// Plan - the plan of the customer in the catalog (empty is the default plan)
+	Plan string
+	// Scopes - the scopes of credentials without an access_token (e.g. get:users)
+	Scopes []string
+	// Claims - the JSON claims of the access_token (or of the introspection response)
+	Claims string
+	// Token - the validated access_token (nil for other credentials)
+	Token *jwt.Token
+}
+
+func orgKey(subject string) string {
+	return "apibillme:org:" + subject
+}
+
+// SetOrganization - map a subject (sub claim) to an organization ID (used when the token has no org claim)
+func SetOrganization(db *buntdb.DB, subject string, orgID string) error {
+	if subject == "" || orgID == "" {
+		return errors.New("subject and organization ID are required")
+	}
+	return db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(orgKey(subject), orgID, nil)
+		return err
+	})
+}
+
+// GetOrganization - get the organization ID mapped to a subject
+func GetOrganization(db *buntdb.DB, subject string) (string, error) {
+	var orgID string
+	err := db.View(func(tx *buntdb.Tx) error {
+		val, err := tx.Get(orgKey(subject))
+		orgID = val
+		return err
+	})
+	return orgID, err
+}
+
+// DeleteOrganization - remove the organization ID mapped to a subject
+func DeleteOrganization(db *buntdb.DB, subject string) error {
+	return db.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete(orgKey(subject))
+		return err
+	})
+}
+
+func planKey(customerID string) string {
+	return "apibillme:plan:" + customerID
+}
+
+// SetCustomerPlan - set the catalog plan of a billing customer (used when the token has no plan claim)
+func SetCustomerPlan(db *buntdb.DB, customerID string, plan string) error {
+	if customerID == "" || plan == "" {
+		return errors.New("customer ID and plan are required")
+	}
+	return db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(planKey(customerID), plan, nil)
+		return err
+	})
+}
+
+// DeleteCustomerPlan - move a billing customer back to the default plan
+func DeleteCustomerPlan(db *buntdb.DB, customerID string) error {
+	return db.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete(planKey(customerID))
+		return err
+	})
+}
+
+// resolvePlan - get the plan from the plan claim or else from the customer to plan mapping
+func resolvePlan(db *buntdb.DB, identity *Identity) string {
+	claim := cast.ToString(viper.Get("plan_claim"))
+	if claim == "" {
+		claim = "plan"
+	}
+	plan, err := claimValue(identity.Claims, claim)
+	if err == nil {
+		return plan
+	}
+	db.View(func(tx *buntdb.Tx) error {
+		plan, err = tx.Get(planKey(identity.CustomerID))
+		return err
+	})
+	return plan
+}
+
+// newTokenIdentity - the identity of a validated access_token
+func newTokenIdentity(token *jwt.Token) *Identity {
+	claims, _ := token.MarshalJSON()
+	return &Identity{Method: MethodJWT, Subject: token.Subject(), Claims: string(claims), Token: token}
+}
+
+// resolveOrg - get the organization from the org claim or else from the subject to org mapping
+func resolveOrg(db *buntdb.DB, identity *Identity) (string, error) {
+	claim := cast.ToString(viper.Get("org_claim"))
+	if claim == "" {
+		claim = "org_id"
+	}
+	orgID, err := claimValue(identity.Claims, claim)
+	if err == nil {
+		return orgID, nil
+	}
+	orgID, err = GetOrganization(db, identity.Subject)
+	if err != nil {
+		return "", errors.New("Unauthorized - cannot resolve organization")
+	}
+	return orgID, nil
+}
+
+// resolveBilling - set the billing customer of the identity (credentials without claims carry their own)
+func resolveBilling(db *buntdb.DB, identity *Identity, provider Provider) error {
+	if identity.CustomerID != "" {
+		return nil
+	}
+	if identity.Claims == "" {
+		return errors.New("Unauthorized - no billing customer for these credentials")
+	}
+	// email is only informational unless it is the billing identity
+	if identity.Token != nil {
+		identity.Email, _ = provider.Email(identity.Token)
+	} else {
+		identity.Email, _ = claimValue(identity.Claims, "email")
+	}
+
+	// org billing - one subscription (customer) per organization
+	if cast.ToBool(viper.Get("org_billing")) {
+		orgID, err := resolveOrg(db, identity)
+		if err != nil {
+			return err
+		}
+		identity.OrgID = orgID
+		// the organization is the customer unless it is mapped to one
+		identity.CustomerID, err = GetBillingCustomer(db, orgID)
+		if err != nil {
+			identity.CustomerID = orgID
+		}
+		return nil
+	}
+
+	customerID, err := resolveCustomerID(db, identity)
+	if err != nil {
+		return err
+	}
+	identity.CustomerID = customerID
+	return nil
+}
@@ -0,0 +1,104 @@
+package apibillme
+
+import (
+	"log"
+	"os"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/jwt"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+)
+
+func TestIdentity(t *testing.T) {
+
+	Convey("resolveBilling", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		viper.AutomaticEnv()
+		defer os.Setenv("ORG_BILLING", "")
+		defer os.Setenv("ORG_CLAIM", "")
+
+		token := jwt.New()
+		token.Set("sub", "github|892404")
+		token.Set("email", "test@example.com")
+		provider := &OIDCProvider{}
+
+		Convey("Success - user billing by default", func() {
+			os.Setenv("ORG_BILLING", "")
+			identity := newTokenIdentity(token)
+			err := resolveBilling(db, identity, provider)
+			So(err, ShouldBeNil)
+			So(identity.CustomerID, ShouldEqual, "test@example.com")
+			So(identity.OrgID, ShouldBeEmpty)
+		})
+
+		Convey("Success - org from the org_id claim", func() {
+			os.Setenv("ORG_BILLING", "true")
+			token.Set("org_id", "acme")
+			identity := newTokenIdentity(token)
+			err := resolveBilling(db, identity, provider)
+			So(err, ShouldBeNil)
+			So(identity.OrgID, ShouldEqual, "acme")
+			So(identity.CustomerID, ShouldEqual, "acme")
+			So(identity.Subject, ShouldEqual, "github|892404")
+
+			Convey("with the org mapped to a billing customer", func() {
+				err := SetBillingCustomer(db, "acme", "cus_123")
+				So(err, ShouldBeNil)
+				identity := newTokenIdentity(token)
+				err = resolveBilling(db, identity, provider)
+				So(err, ShouldBeNil)
+				So(identity.CustomerID, ShouldEqual, "cus_123")
+
+				event := newUsageEvent("get", "users", identity, 1)
+				So(event.OrgID, ShouldEqual, "acme")
+				So(event.Member, ShouldEqual, "github|892404")
+			})
+		})
+
+		Convey("Success - org from a custom claim", func() {
+			os.Setenv("ORG_BILLING", "true")
+			os.Setenv("ORG_CLAIM", "tenant")
+			token.Set("tenant", "globex")
+			identity := newTokenIdentity(token)
+			err := resolveBilling(db, identity, provider)
+			So(err, ShouldBeNil)
+			So(identity.OrgID, ShouldEqual, "globex")
+		})
+
+		Convey("Success - org from the subject mapping", func() {
+			os.Setenv("ORG_BILLING", "true")
+			err := SetOrganization(db, "github|892404", "initech")
+			So(err, ShouldBeNil)
+			identity := newTokenIdentity(token)
+			err = resolveBilling(db, identity, provider)
+			So(err, ShouldBeNil)
+			So(identity.OrgID, ShouldEqual, "initech")
+		})
+
+		Convey("Success - credentials with their own customer", func() {
+			identity := &Identity{Method: MethodAPIKey, CustomerID: "cus_123"}
+			err := resolveBilling(db, identity, provider)
+			So(err, ShouldBeNil)
+			So(identity.CustomerID, ShouldEqual, "cus_123")
+		})
+
+		Convey("Failure - credentials without customer or token", func() {
+			err := resolveBilling(db, &Identity{Method: MethodAPIKey}, provider)
+			So(err, ShouldBeError)
+		})
+
+		Convey("Failure - no org claim or mapping", func() {
+			os.Setenv("ORG_BILLING", "true")
+			err := resolveBilling(db, newTokenIdentity(token), provider)
+			So(err, ShouldBeError)
+		})
+	})
+}
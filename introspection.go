@@ -0,0 +1,153 @@
+package apibillme
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/gjson"
+)
+
+// default time inactive introspection results (and active ones without exp) are cached (introspection_inactive_ttl ENV VAR)
+const introspectionInactiveTTL = time.Minute
+
+// IntrospectionAuthenticator - authenticates opaque access_tokens with OAuth2 token introspection (RFC 7662)
+type IntrospectionAuthenticator struct {
+	// URL - the introspection endpoint
+	URL string
+	// ClientID - the client credentials used to call the introspection endpoint
+	ClientID string
+	// ClientSecret - the client credentials used to call the introspection endpoint
+	ClientSecret string
+	// Sources - where to find the access_token (defaults to Authorization: Bearer)
+	Sources []TokenSource
+}
+
+func introspectionKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "apibillme:introspection:" + hex.EncodeToString(sum[:])
+}
+
+// isJWT - JWTs are left to the JWT authenticator
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// introspect - call the introspection endpoint with client credentials
+func (a *IntrospectionAuthenticator) introspect(ctx context.Context, token string) ([]byte, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequest("POST", a.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(a.ClientID), url.QueryEscape(a.ClientSecret))
+	spanFromContext(ctx).Inject(req.Header)
+	res, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New("failed to introspect token (status " + res.Status + ")")
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if !gjson.ValidBytes(body) {
+		return nil, errors.New("introspection response is not valid JSON")
+	}
+	return body, nil
+}
+
+// introspection - get the introspection result of the token from db or else from the endpoint
+func (a *IntrospectionAuthenticator) introspection(ctx context.Context, db *buntdb.DB, token string) (gjson.Result, error) {
+	key := introspectionKey(token)
+
+	// check if the result is in db
+	var cached string
+	err := db.View(func(tx *buntdb.Tx) error {
+		val, err := tx.Get(key)
+		cached = val
+		return err
+	})
+	if err == nil {
+		return gjson.Parse(cached), nil
+	}
+
+	// if not then introspect the token and save the result in db
+	body, err := a.introspect(ctx, token)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	result := gjson.ParseBytes(body)
+
+	// active results are cached until exp - inactive ones (and active ones without exp) for a short time
+	ttl := cast.ToDuration(viper.Get("introspection_inactive_ttl"))
+	if ttl <= 0 {
+		ttl = introspectionInactiveTTL
+	}
+	if exp := result.Get("exp").Int(); result.Get("active").Bool() && exp != 0 {
+		ttl = time.Until(time.Unix(exp, 0))
+	}
+	if ttl > 0 {
+		err = db.Update(func(tx *buntdb.Tx) error {
+			_, _, err := tx.Set(key, string(body), &buntdb.SetOptions{Expires: true, TTL: ttl})
+			return err
+		})
+		if err != nil {
+			return gjson.Result{}, err
+		}
+	}
+	return result, nil
+}
+
+// Authenticate - introspect the opaque access_token and return its identity
+func (a *IntrospectionAuthenticator) Authenticate(db *buntdb.DB, req *http.Request) (*Identity, error) {
+	sources := a.Sources
+	if sources == nil {
+		sources = defaultTokenSources
+	}
+	token := extractToken(req, sources)
+	if token == "" || isJWT(token) {
+		return nil, errNoCredentials
+	}
+	result, err := a.introspection(req.Context(), db, token)
+	if err != nil {
+		return nil, errors.New("Unauthorized - Invalid Token")
+	}
+	exp := result.Get("exp").Int()
+	if !result.Get("active").Bool() || (exp != 0 && time.Now().Unix() >= exp) {
+		return nil, errors.New("Unauthorized - Invalid Token")
+	}
+	// the subject is the user - or the client for client credentials tokens
+	subject := result.Get("sub").String()
+	if subject == "" {
+		subject = result.Get("client_id").String()
+	}
+	return &Identity{
+		Method:  MethodIntrospection,
+		Subject: subject,
+		Scopes:  strings.Fields(result.Get("scope").String()),
+		Claims:  result.Raw,
+	}, nil
+}
+
+func introspectionFromConfig() *IntrospectionAuthenticator {
+	return &IntrospectionAuthenticator{
+		URL:          cast.ToString(viper.Get("introspection_url")),
+		ClientID:     cast.ToString(viper.Get("introspection_client_id")),
+		ClientSecret: cast.ToString(viper.Get("introspection_client_secret")),
+	}
+}
@@ -0,0 +1,127 @@
+package apibillme
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+)
+
+func TestIntrospection(t *testing.T) {
+
+	Convey("IntrospectionAuthenticator", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		// local introspection stand-in
+		calls := 0
+		exp := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			clientID, clientSecret, ok := r.BasicAuth()
+			if !ok || clientID != "gateway" || clientSecret != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			switch r.PostFormValue("token") {
+			case "active-token":
+				w.Write([]byte(`{"active":true,"sub":"github|892404","email":"test@example.com","scope":"openid get:users","exp":` + exp + `}`))
+			case "session-token":
+				w.Write([]byte(`{"active":true,"sub":"github|892404","scope":"get:users"}`))
+			case "client-token":
+				w.Write([]byte(`{"active":true,"client_id":"machine","scope":"get:users","exp":` + exp + `}`))
+			default:
+				w.Write([]byte(`{"active":false}`))
+			}
+		}))
+		defer server.Close()
+
+		authenticator := &IntrospectionAuthenticator{URL: server.URL, ClientID: "gateway", ClientSecret: "secret"}
+		req, err := http.NewRequest("GET", "/users/12", nil)
+		So(err, ShouldBeNil)
+
+		Convey("Success - active token", func() {
+			req.Header.Set("Authorization", "Bearer active-token")
+			identity, err := authenticator.Authenticate(db, req)
+			So(err, ShouldBeNil)
+			So(identity.Method, ShouldEqual, MethodIntrospection)
+			So(identity.Subject, ShouldEqual, "github|892404")
+			So(identity.Scopes, ShouldResemble, []string{"openid", "get:users"})
+
+			Convey("and the result is cached until exp", func() {
+				_, err := authenticator.Authenticate(db, req)
+				So(err, ShouldBeNil)
+				So(calls, ShouldEqual, 1)
+			})
+
+			Convey("and is billed like a JWT identity", func() {
+				err := resolveBilling(db, identity, nil)
+				So(err, ShouldBeNil)
+				So(identity.CustomerID, ShouldEqual, "test@example.com")
+			})
+		})
+
+		Convey("Success - an active token without exp is cached for the configured TTL", func() {
+			viper.AutomaticEnv()
+			os.Setenv("INTROSPECTION_INACTIVE_TTL", "10m")
+			defer os.Setenv("INTROSPECTION_INACTIVE_TTL", "")
+			req.Header.Set("Authorization", "Bearer session-token")
+			_, err := authenticator.Authenticate(db, req)
+			So(err, ShouldBeNil)
+			var ttl time.Duration
+			db.View(func(tx *buntdb.Tx) error {
+				ttl, err = tx.TTL(introspectionKey("session-token"))
+				return err
+			})
+			So(err, ShouldBeNil)
+			So(ttl, ShouldBeGreaterThan, 9*time.Minute)
+		})
+
+		Convey("Success - client credentials token uses client_id", func() {
+			req.Header.Set("Authorization", "Bearer client-token")
+			identity, err := authenticator.Authenticate(db, req)
+			So(err, ShouldBeNil)
+			So(identity.Subject, ShouldEqual, "machine")
+		})
+
+		Convey("Failure - inactive token is cached too", func() {
+			req.Header.Set("Authorization", "Bearer revoked-token")
+			_, err := authenticator.Authenticate(db, req)
+			So(err, ShouldBeError)
+			_, err = authenticator.Authenticate(db, req)
+			So(err, ShouldBeError)
+			So(calls, ShouldEqual, 1)
+		})
+
+		Convey("Failure - invalid client credentials", func() {
+			authenticator.ClientSecret = "foobar"
+			req.Header.Set("Authorization", "Bearer active-token")
+			_, err := authenticator.Authenticate(db, req)
+			So(err, ShouldBeError)
+		})
+
+		Convey("Failure - JWTs are left to the JWT authenticator", func() {
+			req.Header.Set("Authorization", "Bearer aaa.bbb.ccc")
+			_, err := authenticator.Authenticate(db, req)
+			So(err, ShouldEqual, errNoCredentials)
+		})
+
+		Convey("introspectionFromConfig", func() {
+			viper.AutomaticEnv()
+			os.Setenv("INTROSPECTION_URL", server.URL)
+			defer os.Setenv("INTROSPECTION_URL", "")
+			So(introspectionFromConfig().URL, ShouldEqual, server.URL)
+		})
+	})
+}
@@ -0,0 +1,281 @@
+package apibillme
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+// ledger statuses
+const (
+	LedgerCharged = "charged"
+	LedgerFailed  = "failed"
+	// LedgerShadow - a charge the billing stage in shadow mode would have made (nothing was charged)
+	LedgerShadow = "shadow"
+	// LedgerUnmetered - a served call whose units could not be metered (nothing was charged)
+	LedgerUnmetered = "unmetered"
+)
+
+// ledger indexes
+const (
+	ledgerByCustomer = "apibillme:ledger:customer"
+	ledgerByScope    = "apibillme:ledger:scope"
+	ledgerByDay      = "apibillme:ledger:day"
+	// ledgerByCustomerDay - the entries of a customer by day (the usage of a period)
+	ledgerByCustomerDay = "apibillme:ledger:customer:day"
+)
+
+// LedgerEntry - a usage event recorded in the local ledger
+type LedgerEntry struct {
+	ID            string    `json:"id"`
+	Time          time.Time `json:"time"`
+	Day           string    `json:"day"`
+	Scope         string    `json:"scope"`
+	ServerMethod  string    `json:"serverMethod"`
+	ServerBaseURL string    `json:"serverBaseURL"`
+	CustomerID    string    `json:"customerID"`
+	OrgID         string    `json:"orgID,omitempty"`
+	Member        string    `json:"member,omitempty"`
+	Units         int64     `json:"units"`
+	// Status - charged, failed (the charge call returned an error) or shadow
+	Status string `json:"status"`
+	// Served - the call was served (false for a failed charge of a scope that fails closed - the call was denied)
+	Served bool `json:"served"`
+}
+
+// LedgerQuery - filter ledger entries (empty fields match everything)
+type LedgerQuery struct {
+	CustomerID string
+	// Scope - method:baseURL (e.g. get:users)
+	Scope string
+	// From - inclusive start of the time range
+	From time.Time
+	// To - exclusive end of the time range
+	To time.Time
+	// Status - charged, failed or shadow
+	Status string
+}
+
+// LedgerTotal - the calls and units of a customer for a scope
+type LedgerTotal struct {
+	CustomerID string `json:"customerID"`
+	Scope      string `json:"scope"`
+	Calls      int64  `json:"calls"`
+	Units      int64  `json:"units"`
+}
+
+// ledgerIndexes - create the indexes of the ledger (once per db)
+func ledgerIndexes(db *buntdb.DB) error {
+	indexes := map[string]string{
+		ledgerByCustomer: "customerID",
+		ledgerByScope:    "scope",
+		ledgerByDay:      "day",
+	}
+	for name, path := range indexes {
+		// entries are sorted by time after the lookup (a time tie-break breaks AscendEqual)
+		err := db.CreateIndex(name, "apibillme:ledger:entry:*", buntdb.IndexJSON(path))
+		if err != nil && err != buntdb.ErrIndexExists {
+			return err
+		}
+	}
+	err := db.CreateIndex(ledgerByCustomerDay, "apibillme:ledger:entry:*", buntdb.IndexJSON("customerID"), buntdb.IndexJSON("day"))
+	if err != nil && err != buntdb.ErrIndexExists {
+		return err
+	}
+	return nil
+}
+
+// recordUsage - add the usage event to the ledger (served - the call was served)
+func recordUsage(db *buntdb.DB, event usageEvent, status string, served bool, now time.Time) (*LedgerEntry, error) {
+	err := ledgerIndexes(db)
+	if err != nil {
+		return nil, err
+	}
+	suffix, err := randomHex(4)
+	if err != nil {
+		return nil, err
+	}
+	now = now.UTC()
+	entry := &LedgerEntry{
+		ID:            strconv.FormatInt(now.UnixNano(), 10) + "-" + suffix,
+		Time:          now,
+		Day:           now.Format("2006-01-02"),
+		Scope:         event.ServerMethod + ":" + event.ServerBaseURL,
+		ServerMethod:  event.ServerMethod,
+		ServerBaseURL: event.ServerBaseURL,
+		CustomerID:    event.CustomerID,
+		OrgID:         event.OrgID,
+		Member:        event.Member,
+		Units:         event.Units,
+		Status:        status,
+		Served:        served,
+	}
+	jsonBytes, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set("apibillme:ledger:entry:"+entry.ID, string(jsonBytes), nil)
+		return err
+	})
+	return entry, err
+}
+
+// matches - whether the entry is in the query
+func (q LedgerQuery) matches(entry *LedgerEntry) bool {
+	switch {
+	case q.CustomerID != "" && entry.CustomerID != q.CustomerID:
+		return false
+	case q.Scope != "" && entry.Scope != q.Scope:
+		return false
+	case !q.From.IsZero() && entry.Time.Before(q.From):
+		return false
+	case !q.To.IsZero() && !entry.Time.Before(q.To):
+		return false
+	case q.Status != "" && entry.Status != q.Status:
+		return false
+	}
+	return true
+}
+
+func pivot(path string, value string) string {
+	jsonBytes, _ := json.Marshal(map[string]string{path: value})
+	return string(jsonBytes)
+}
+
+// customerDay - the pivot of the entries of a customer on a day
+func customerDay(customerID string, day string) string {
+	jsonBytes, _ := json.Marshal(map[string]string{"customerID": customerID, "day": day})
+	return string(jsonBytes)
+}
+
+// LedgerEntries - the ledger entries of the query (by customer, scope or day index)
+func LedgerEntries(db *buntdb.DB, query LedgerQuery) ([]LedgerEntry, error) {
+	err := ledgerIndexes(db)
+	if err != nil {
+		return nil, err
+	}
+	entries := []LedgerEntry{}
+	var decodeErr error
+	iterator := func(key, value string) bool {
+		var entry LedgerEntry
+		decodeErr = json.Unmarshal([]byte(value), &entry)
+		if decodeErr != nil {
+			return false
+		}
+		if query.matches(&entry) {
+			entries = append(entries, entry)
+		}
+		return true
+	}
+	err = db.View(func(tx *buntdb.Tx) error {
+		switch {
+		case query.CustomerID != "" && !query.From.IsZero():
+			// only the days of the time range (the day after To so the entries of its day are included)
+			to := "~"
+			if !query.To.IsZero() {
+				to = query.To.UTC().AddDate(0, 0, 1).Format("2006-01-02")
+			}
+			return tx.AscendRange(ledgerByCustomerDay, customerDay(query.CustomerID, query.From.UTC().Format("2006-01-02")), customerDay(query.CustomerID, to), iterator)
+		case query.CustomerID != "":
+			return tx.AscendEqual(ledgerByCustomer, pivot("customerID", query.CustomerID), iterator)
+		case query.Scope != "":
+			return tx.AscendEqual(ledgerByScope, pivot("scope", query.Scope), iterator)
+		case !query.From.IsZero() && !query.To.IsZero():
+			// the day after To so the entries of its day are included
+			to := query.To.UTC().AddDate(0, 0, 1).Format("2006-01-02")
+			return tx.AscendRange(ledgerByDay, pivot("day", query.From.UTC().Format("2006-01-02")), pivot("day", to), iterator)
+		case !query.From.IsZero():
+			return tx.AscendGreaterOrEqual(ledgerByDay, pivot("day", query.From.UTC().Format("2006-01-02")), iterator)
+		}
+		return tx.Ascend(ledgerByDay, iterator)
+	})
+	if err == nil {
+		err = decodeErr
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+	return entries, err
+}
+
+// LedgerTotals - the calls and units of the query per customer and scope
+func LedgerTotals(db *buntdb.DB, query LedgerQuery) ([]LedgerTotal, error) {
+	entries, err := LedgerEntries(db, query)
+	if err != nil {
+		return nil, err
+	}
+	byKey := map[string]*LedgerTotal{}
+	for _, entry := range entries {
+		key := entry.CustomerID + " " + entry.Scope
+		total, ok := byKey[key]
+		if !ok {
+			total = &LedgerTotal{CustomerID: entry.CustomerID, Scope: entry.Scope}
+			byKey[key] = total
+		}
+		total.Calls++
+		total.Units += entry.Units
+	}
+	totals := []LedgerTotal{}
+	for _, total := range byKey {
+		totals = append(totals, *total)
+	}
+	sort.Slice(totals, func(i, j int) bool {
+		if totals[i].CustomerID != totals[j].CustomerID {
+			return totals[i].CustomerID < totals[j].CustomerID
+		}
+		return totals[i].Scope < totals[j].Scope
+	})
+	return totals, nil
+}
+
+// ledger export formats
+const (
+	ExportJSONL = "jsonl"
+	ExportCSV   = "csv"
+)
+
+// ExportLedger - write the ledger entries of the query as JSONL or CSV
+func ExportLedger(db *buntdb.DB, query LedgerQuery, w io.Writer, format string) error {
+	entries, err := LedgerEntries(db, query)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case ExportJSONL:
+		encoder := json.NewEncoder(w)
+		for _, entry := range entries {
+			err := encoder.Encode(entry)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case ExportCSV:
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"id", "time", "customerID", "orgID", "member", "serverMethod", "serverBaseURL", "units", "status", "served"})
+		for _, entry := range entries {
+			writer.Write([]string{
+				entry.ID,
+				entry.Time.Format(time.RFC3339Nano),
+				entry.CustomerID,
+				entry.OrgID,
+				entry.Member,
+				entry.ServerMethod,
+				entry.ServerBaseURL,
+				strconv.FormatInt(entry.Units, 10),
+				entry.Status,
+				strconv.FormatBool(entry.Served),
+			})
+		}
+		writer.Flush()
+		return writer.Error()
+	}
+	return errors.New("export format must be jsonl or csv")
+}
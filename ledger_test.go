@@ -0,0 +1,199 @@
+package apibillme
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apibillme/stubby"
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+)
+
+func TestLedger(t *testing.T) {
+
+	Convey("Ledger", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		day := time.Date(2019, 3, 20, 12, 0, 0, 0, time.UTC)
+		events := []struct {
+			event usageEvent
+			time  time.Time
+		}{
+			{usageEvent{ServerMethod: "get", ServerBaseURL: "users", CustomerID: "cus_123", Units: 1}, day},
+			{usageEvent{ServerMethod: "get", ServerBaseURL: "users", CustomerID: "cus_123", Units: 1}, day.Add(time.Hour)},
+			{usageEvent{ServerMethod: "post", ServerBaseURL: "reports", CustomerID: "cus_123", Units: 10}, day.AddDate(0, 0, 1)},
+			{usageEvent{ServerMethod: "get", ServerBaseURL: "users", CustomerID: "cus_456", Units: 1}, day.AddDate(0, 0, 2)},
+		}
+		for _, e := range events {
+			_, err := recordUsage(db, e.event, LedgerCharged, true, e.time)
+			So(err, ShouldBeNil)
+		}
+
+		Convey("LedgerEntries - by customer in order", func() {
+			entries, err := LedgerEntries(db, LedgerQuery{CustomerID: "cus_123"})
+			So(err, ShouldBeNil)
+			So(entries, ShouldHaveLength, 3)
+			So(entries[0].Day, ShouldEqual, "2019-03-20")
+			So(entries[2].Scope, ShouldEqual, "post:reports")
+		})
+
+		Convey("LedgerEntries - by scope", func() {
+			entries, err := LedgerEntries(db, LedgerQuery{Scope: "get:users"})
+			So(err, ShouldBeNil)
+			So(entries, ShouldHaveLength, 3)
+		})
+
+		Convey("LedgerEntries - by time range", func() {
+			entries, err := LedgerEntries(db, LedgerQuery{From: day.Add(time.Minute), To: day.AddDate(0, 0, 2)})
+			So(err, ShouldBeNil)
+			So(entries, ShouldHaveLength, 2)
+		})
+
+		Convey("LedgerEntries - by customer from a time", func() {
+			entries, err := LedgerEntries(db, LedgerQuery{CustomerID: "cus_123", From: day.Add(time.Minute)})
+			So(err, ShouldBeNil)
+			So(entries, ShouldHaveLength, 2)
+			So(entries[0].Time.Equal(day.Add(time.Hour)), ShouldBeTrue)
+			entries, err = LedgerEntries(db, LedgerQuery{CustomerID: "cus_123", From: day, To: day.AddDate(0, 0, 1)})
+			So(err, ShouldBeNil)
+			So(entries, ShouldHaveLength, 2)
+			entries, err = LedgerEntries(db, LedgerQuery{CustomerID: "cus_456", From: day})
+			So(err, ShouldBeNil)
+			So(entries, ShouldHaveLength, 1)
+		})
+
+		Convey("LedgerTotals - per customer and scope", func() {
+			totals, err := LedgerTotals(db, LedgerQuery{})
+			So(err, ShouldBeNil)
+			So(totals, ShouldResemble, []LedgerTotal{
+				{CustomerID: "cus_123", Scope: "get:users", Calls: 2, Units: 2},
+				{CustomerID: "cus_123", Scope: "post:reports", Calls: 1, Units: 10},
+				{CustomerID: "cus_456", Scope: "get:users", Calls: 1, Units: 1},
+			})
+		})
+
+		Convey("ExportLedger - JSONL", func() {
+			var out bytes.Buffer
+			err := ExportLedger(db, LedgerQuery{CustomerID: "cus_456"}, &out, ExportJSONL)
+			So(err, ShouldBeNil)
+			So(strings.Count(out.String(), "\n"), ShouldEqual, 1)
+			So(out.String(), ShouldContainSubstring, `"customerID":"cus_456"`)
+		})
+
+		Convey("ExportLedger - CSV", func() {
+			var out bytes.Buffer
+			err := ExportLedger(db, LedgerQuery{CustomerID: "cus_123"}, &out, ExportCSV)
+			So(err, ShouldBeNil)
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			So(lines, ShouldHaveLength, 4)
+			So(lines[0], ShouldStartWith, "id,time,customerID")
+		})
+
+		Convey("ExportLedger - unknown format", func() {
+			err := ExportLedger(db, LedgerQuery{}, &bytes.Buffer{}, "xml")
+			So(err, ShouldBeError)
+		})
+	})
+
+	Convey("Run - ledger", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		viper.AutomaticEnv()
+		os.Setenv("LEDGER", "true")
+		os.Setenv("RBAC_VALIDATE", "false")
+		os.Setenv("STRIPE_VALIDATE", "true")
+		os.Setenv("STRIPE_JSON_PATH", "testdata/metering.json")
+		defer os.Setenv("LEDGER", "")
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		identity := &Identity{Method: MethodAPIKey, Subject: "apikey|1", CustomerID: "cus_123"}
+		router.Use(Run(db, WithAuthenticator(&stubAuthenticator{identity: identity})))
+		router.POST("/reports", func(c *gin.Context) {
+			c.String(http.StatusOK, "ok")
+		})
+
+		Convey("Success - charged and failed calls are recorded", func() {
+			stub := stubby.StubFunc(&restlyPostJSON, nil, nil)
+			req, _ := http.NewRequest("POST", "/reports", nil)
+			router.ServeHTTP(httptest.NewRecorder(), req)
+			stub.Reset()
+
+			stub = stubby.StubFunc(&restlyPostJSON, nil, errors.New("foobar"))
+			defer stub.Reset()
+			req, _ = http.NewRequest("POST", "/reports", nil)
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+			So(recorder.Code, ShouldEqual, http.StatusUnauthorized)
+
+			entries, err := LedgerEntries(db, LedgerQuery{CustomerID: "cus_123"})
+			So(err, ShouldBeNil)
+			So(entries, ShouldHaveLength, 2)
+			So(entries[0].Status, ShouldEqual, LedgerCharged)
+			So(entries[0].Units, ShouldEqual, 10)
+			So(entries[1].Status, ShouldEqual, LedgerFailed)
+		})
+	})
+	Convey("Run - ledger failures", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		viper.AutomaticEnv()
+		os.Setenv("LEDGER", "true")
+		os.Setenv("RBAC_VALIDATE", "false")
+		os.Setenv("STRIPE_VALIDATE", "true")
+		os.Setenv("STRIPE_JSON_PATH", "testdata/metering.json")
+		defer os.Setenv("LEDGER", "")
+		stub := stubby.StubFunc(&restlyPostJSON, nil, nil)
+		defer stub.Reset()
+		stubLedger := stubby.StubFunc(&ledgerRecord, nil, errors.New("disk full"))
+		defer stubLedger.Reset()
+
+		metrics := NewMetrics()
+		logger := &memoryLogger{}
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		identity := &Identity{Method: MethodAPIKey, Subject: "apikey|1", CustomerID: "cus_123"}
+		router.Use(Run(db, WithAuthenticator(&stubAuthenticator{identity: identity}), WithMetrics(metrics), WithLogger(logger), WithLogSampling(0)))
+		router.POST("/reports", func(c *gin.Context) {
+			c.String(http.StatusOK, "ok")
+		})
+
+		Convey("Success - the failures are counted and logged with the decision", func() {
+			req, _ := http.NewRequest("POST", "/reports", nil)
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+
+			recorder = httptest.NewRecorder()
+			metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+			So(recorder.Body.String(), ShouldContainSubstring, `apibillme_ledger_errors_total{status="charged"} 1`)
+			So(logger.events, ShouldHaveLength, 1)
+			So(logger.events[0].Reason, ShouldEqual, DecisionAllowed)
+			So(logger.events[0].LedgerError, ShouldEqual, "disk full")
+		})
+	})
+}
@@ -0,0 +1,211 @@
+package apibillme
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// DecisionEvent - the structured log event of a decision (redacted - emails are only logged as hashes)
+type DecisionEvent struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"requestID"`
+	Method     string    `json:"method"`
+	Route      string    `json:"route"`
+	Scope      string    `json:"scope"`
+	Subject    string    `json:"subject,omitempty"`
+	EmailHash  string    `json:"emailHash,omitempty"`
+	CustomerID string    `json:"customerID,omitempty"`
+	AuthMethod string    `json:"authMethod,omitempty"`
+	// Decision - allowed or denied
+	Decision string `json:"decision"`
+	// Reason - the reason code (e.g. insufficient_scope)
+	Reason    string  `json:"reason"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMS float64 `json:"latencyMs"`
+	// Shadow - what the stages in shadow mode would have done
+	Shadow []ShadowDecision `json:"shadow,omitempty"`
+	// AuditError - why the audit record of the call could not be appended
+	AuditError string `json:"auditError,omitempty"`
+	// AuditPruneError - why the retention of the audit log could not be applied (the call was audited)
+	AuditPruneError string `json:"auditPruneError,omitempty"`
+	// LedgerError - why the ledger entry of the call could not be written
+	LedgerError string `json:"ledgerError,omitempty"`
+	// BillingError - why the served call was not charged (e.g. the handler did not set the units)
+	BillingError string `json:"billingError,omitempty"`
+}
+
+// Logger - receives the decision events
+type Logger interface {
+	Log(event DecisionEvent)
+}
+
+// JSONLogger - writes decision events as JSON lines
+type JSONLogger struct {
+	sync.Mutex
+	w io.Writer
+}
+
+// NewJSONLogger - a logger of JSON lines to w
+func NewJSONLogger(w io.Writer) *JSONLogger {
+	return &JSONLogger{w: w}
+}
+
+// Log - write the event as a JSON line
+func (l *JSONLogger) Log(event DecisionEvent) {
+	jsonBytes, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.w.Write(append(jsonBytes, '\n'))
+}
+
+// default redaction rules - JWTs, Authorization credentials, API keys and emails
+var defaultRedactions = []*regexp.Regexp{
+	regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]*\.[A-Za-z0-9_-]*`),
+	regexp.MustCompile(`(?i)(bearer|basic|apikey)\s+\S+`),
+	regexp.MustCompile(`abm_[0-9a-f]+_[0-9a-f]+`),
+	regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`),
+}
+
+const redacted = "[REDACTED]"
+
+// decisionLog - the logger of decisions with its sampling and redaction rules
+type decisionLog struct {
+	logger Logger
+	// sampleAllowed - the share of allowed requests that are logged (denied ones are always logged)
+	sampleAllowed float64
+	sampleSet     bool
+	redactions    []*regexp.Regexp
+	// hashSalt - salt of the email hashes
+	hashSalt string
+}
+
+// for stubbing
+var sampleRandom = rand.Float64
+
+// WithLogger - log a structured event for every decision
+func WithLogger(logger Logger) Option {
+	return func(o *options) {
+		o.log.logger = logger
+	}
+}
+
+// WithLogSampling - log this share (0 to 1) of the allowed requests (denied requests are always logged)
+func WithLogSampling(sampleAllowed float64) Option {
+	return func(o *options) {
+		o.log.sampleAllowed = sampleAllowed
+		o.log.sampleSet = true
+	}
+}
+
+// WithRedaction - redact these patterns from the decision events too
+func WithRedaction(patterns ...*regexp.Regexp) Option {
+	return func(o *options) {
+		o.log.redactions = append(o.log.redactions, patterns...)
+	}
+}
+
+// logFromConfig - log_decisions (JSON lines on stdout), log_sample_allowed and log_hash_salt ENV VARS
+func logFromConfig(log *decisionLog) {
+	if log.logger == nil && cast.ToBool(viper.Get("log_decisions")) {
+		log.logger = NewJSONLogger(os.Stdout)
+	}
+	if !log.sampleSet {
+		log.sampleAllowed = 1
+		if viper.IsSet("log_sample_allowed") {
+			log.sampleAllowed = cast.ToFloat64(viper.Get("log_sample_allowed"))
+		}
+	}
+	if log.hashSalt == "" {
+		log.hashSalt = cast.ToString(viper.Get("log_hash_salt"))
+	}
+}
+
+func (l *decisionLog) redact(value string) string {
+	for _, pattern := range defaultRedactions {
+		value = pattern.ReplaceAllString(value, redacted)
+	}
+	for _, pattern := range l.redactions {
+		value = pattern.ReplaceAllString(value, redacted)
+	}
+	return value
+}
+
+// hashEmail - a salted hash of the email so events of a user can be correlated without the email
+func (l *decisionLog) hashEmail(email string) string {
+	if email == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(l.hashSalt + strings.ToLower(email)))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// requestID - the X-Request-Id of the request (or a new one sent back in the response)
+func requestID(req *http.Request, d *decision) string {
+	id := req.Header.Get("X-Request-Id")
+	if id == "" {
+		id, _ = randomHex(16)
+		d.headers.Set("X-Request-Id", id)
+	}
+	return id
+}
+
+// log - log the decision of the request (allowed requests are sampled)
+func (l *decisionLog) log(req *http.Request, d *decision, err error, latency time.Duration) {
+	if l.logger == nil {
+		return
+	}
+	if d.reason == DecisionAllowed && !d.shadowDenied() && d.auditErr == nil && d.auditPruneErr == nil && d.ledgerErr == nil && d.billingErr == nil && (l.sampleAllowed <= 0 || sampleRandom() >= l.sampleAllowed) {
+		return
+	}
+	event := DecisionEvent{
+		Time:      time.Now().UTC(),
+		RequestID: l.redact(d.requestID),
+		Method:    d.serverMethod,
+		Route:     l.redact(req.URL.Path),
+		Scope:     d.serverMethod + ":" + d.serverBaseURL,
+		Decision:  "allowed",
+		Reason:    d.reason,
+		LatencyMS: float64(latency) / float64(time.Millisecond),
+		Shadow:    d.shadowDecisions,
+	}
+	if d.reason != DecisionAllowed {
+		event.Decision = "denied"
+	}
+	if err != nil {
+		event.Error = l.redact(err.Error())
+	}
+	if d.auditErr != nil {
+		event.AuditError = l.redact(d.auditErr.Error())
+	}
+	if d.auditPruneErr != nil {
+		event.AuditPruneError = l.redact(d.auditPruneErr.Error())
+	}
+	if d.ledgerErr != nil {
+		event.LedgerError = l.redact(d.ledgerErr.Error())
+	}
+	if d.billingErr != nil {
+		event.BillingError = l.redact(d.billingErr.Error())
+	}
+	if d.identity != nil {
+		event.Subject = l.redact(d.identity.Subject)
+		event.EmailHash = l.hashEmail(d.identity.Email)
+		event.CustomerID = l.redact(d.identity.CustomerID)
+		event.AuthMethod = d.identity.Method
+	}
+	l.logger.Log(event)
+}
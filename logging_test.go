@@ -0,0 +1,142 @@
+package apibillme
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/apibillme/stubby"
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+)
+
+type memoryLogger struct {
+	events []DecisionEvent
+}
+
+func (l *memoryLogger) Log(event DecisionEvent) {
+	l.events = append(l.events, event)
+}
+
+func TestLogging(t *testing.T) {
+
+	Convey("decisionLog", t, func() {
+
+		l := &decisionLog{}
+
+		Convey("redact - tokens, credentials, API keys and emails", func() {
+			So(l.redact("token eyJhbGciOi.eyJzdWIiOi.c2lnbmF0dXJl here"), ShouldEqual, "token [REDACTED] here")
+			So(l.redact("Authorization: Bearer abc.def"), ShouldEqual, "Authorization: [REDACTED]")
+			So(l.redact("/keys/abm_0a1b_2c3d"), ShouldEqual, "/keys/[REDACTED]")
+			So(l.redact("/users/test@example.com"), ShouldEqual, "/users/[REDACTED]")
+		})
+
+		Convey("redact - custom rules", func() {
+			l.redactions = []*regexp.Regexp{regexp.MustCompile(`cus_[a-z0-9]+`)}
+			So(l.redact("cus_123"), ShouldEqual, "[REDACTED]")
+		})
+
+		Convey("hashEmail - salted and case-insensitive", func() {
+			So(l.hashEmail("Test@Example.com"), ShouldEqual, l.hashEmail("test@example.com"))
+			So(l.hashEmail("test@example.com"), ShouldStartWith, "sha256:")
+			salted := &decisionLog{hashSalt: "pepper"}
+			So(salted.hashEmail("test@example.com"), ShouldNotEqual, l.hashEmail("test@example.com"))
+		})
+	})
+
+	Convey("Run - decision logging", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		viper.AutomaticEnv()
+		os.Setenv("RBAC_VALIDATE", "true")
+		os.Setenv("STRIPE_VALIDATE", "false")
+
+		logger := &memoryLogger{}
+		identity := &Identity{Method: MethodAPIKey, Subject: "apikey|1", Email: "test@example.com", CustomerID: "cus_123", Scopes: []string{"get:users"}}
+		authenticator := &stubAuthenticator{identity: identity}
+
+		request := func(opts []Option, method string, url string) *httptest.ResponseRecorder {
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.Use(Run(db, opts...))
+			router.Handle(method, "/*path", func(c *gin.Context) {
+				c.String(http.StatusOK, "ok")
+			})
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest(method, url, nil)
+			req.Header.Set("X-Request-Id", "req-1")
+			router.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		Convey("Success - allowed and denied events", func() {
+			opts := []Option{WithAuthenticator(authenticator), WithLogger(logger)}
+			request(opts, "GET", "/users/test@example.com?foo=bar")
+			request(opts, "POST", "/users")
+			So(logger.events, ShouldHaveLength, 2)
+			allowed := logger.events[0]
+			So(allowed.RequestID, ShouldEqual, "req-1")
+			So(allowed.Decision, ShouldEqual, "allowed")
+			So(allowed.Reason, ShouldEqual, DecisionAllowed)
+			So(allowed.Scope, ShouldEqual, "get:users")
+			So(allowed.Route, ShouldEqual, "/users/[REDACTED]")
+			So(allowed.Subject, ShouldEqual, "apikey|1")
+			So(allowed.EmailHash, ShouldStartWith, "sha256:")
+			denied := logger.events[1]
+			So(denied.Decision, ShouldEqual, "denied")
+			So(denied.Reason, ShouldEqual, DecisionInsufficientScope)
+			So(denied.Error, ShouldEqual, "Unauthorized - Invalid Scope Permissions")
+		})
+
+		Convey("Success - allowed requests are sampled", func() {
+			stub := stubby.StubFunc(&sampleRandom, 0.5)
+			defer stub.Reset()
+			opts := []Option{WithAuthenticator(authenticator), WithLogger(logger), WithLogSampling(0.1)}
+			request(opts, "GET", "/users/12")
+			request(opts, "POST", "/users")
+			So(logger.events, ShouldHaveLength, 1)
+			So(logger.events[0].Reason, ShouldEqual, DecisionInsufficientScope)
+		})
+
+		Convey("Success - JSON lines without tokens or emails", func() {
+			var out bytes.Buffer
+			failing := &stubAuthenticator{err: errors.New("Unauthorized - bad token eyJhbGciOi.eyJzdWIiOi.c2ln for test@example.com")}
+			recorder := request([]Option{WithAuthenticator(failing), WithLogger(NewJSONLogger(&out))}, "GET", "/users/12")
+			So(recorder.Code, ShouldEqual, http.StatusUnauthorized)
+			So(out.String(), ShouldNotContainSubstring, "eyJ")
+			So(out.String(), ShouldNotContainSubstring, "test@example.com")
+			var event DecisionEvent
+			err := json.Unmarshal([]byte(strings.TrimSpace(out.String())), &event)
+			So(err, ShouldBeNil)
+			So(event.Reason, ShouldEqual, DecisionInvalidToken)
+		})
+
+		Convey("Success - a request ID is generated and sent back", func() {
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.Use(Run(db, WithAuthenticator(authenticator), WithLogger(logger)))
+			router.GET("/users/:id", func(c *gin.Context) {
+				c.String(http.StatusOK, "ok")
+			})
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/users/12", nil)
+			router.ServeHTTP(recorder, req)
+			So(recorder.Header().Get("X-Request-Id"), ShouldNotBeEmpty)
+			So(logger.events[0].RequestID, ShouldEqual, recorder.Header().Get("X-Request-Id"))
+		})
+	})
+}
@@ -0,0 +1,323 @@
+package apibillme
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+)
+
+// QuotaStatus - the usage of a quota in the current period
+type QuotaStatus struct {
+	Limit     int64     `json:"limit"`
+	Used      int64     `json:"used"`
+	Remaining int64     `json:"remaining"`
+	Period    string    `json:"period"`
+	Soft      bool      `json:"soft,omitempty"`
+	Start     time.Time `json:"periodStart"`
+	End       time.Time `json:"periodEnd"`
+}
+
+// Entitlement - whether the caller can call a scope
+type Entitlement struct {
+	Scope string `json:"scope"`
+	// Granted - the credentials have the scope
+	Granted  bool `json:"granted"`
+	Billable bool `json:"billable"`
+	// Units - the weight of a call (metered scopes are multiplied by the metered units)
+	Units int64 `json:"units,omitempty"`
+	// Status - allowed or the reason code of the stage that would deny the call (insufficient_scope, quota_exceeded or no_subscription - the subscription of billable scopes is verified)
+	Status string `json:"status"`
+	// Quota - the quota of the scope (the plan quota is in MeResponse)
+	Quota *QuotaStatus `json:"quota,omitempty"`
+	// Usage - the usage of the scope in the current period
+	Usage *Usage `json:"usage,omitempty"`
+}
+
+// Usage - the calls and units in the current period (the period of the quota or else the month)
+type Usage struct {
+	Calls int64 `json:"calls"`
+	// Units - the charged units (only known from the ledger)
+	Units  int64     `json:"units,omitempty"`
+	Period string    `json:"period"`
+	Start  time.Time `json:"periodStart"`
+	End    time.Time `json:"periodEnd"`
+	// Source - ledger (charged calls and failed calls that were served) or quota (the quota counter)
+	Source string `json:"source"`
+}
+
+// usage sources
+const (
+	UsageLedger = "ledger"
+	UsageQuota  = "quota"
+)
+
+// MeResponse - the account of the caller
+type MeResponse struct {
+	Subject    string `json:"subject"`
+	AuthMethod string `json:"authMethod"`
+	// CustomerID - the billing identity (empty when it cannot be resolved)
+	CustomerID     string        `json:"customerID,omitempty"`
+	OrgID          string        `json:"orgID,omitempty"`
+	Plan           string        `json:"plan"`
+	Scopes         []string      `json:"scopes"`
+	BillableScopes []string      `json:"billableScopes"`
+	Entitlements   []Entitlement `json:"entitlements"`
+	// Quota - the quota of the plan (counted for all scopes)
+	Quota *QuotaStatus `json:"quota,omitempty"`
+	// Usage - the usage of all scopes in the current period
+	Usage *Usage `json:"usage,omitempty"`
+}
+
+// status - the usage of the quota in the current period (without counting a call)
+func (q *Quota) status(db *buntdb.DB, identity *Identity, serverMethod string, serverBaseURL string, now time.Time) (*QuotaStatus, error) {
+	start, end, err := q.period(now)
+	if err != nil {
+		return nil, err
+	}
+	status := &QuotaStatus{Limit: q.Limit, Period: q.Period, Soft: q.Soft, Start: start, End: end}
+	if status.Period == "" {
+		status.Period = QuotaMonth
+	}
+	err = db.View(func(tx *buntdb.Tx) error {
+		val, err := tx.Get(quotaKey(identity, q.scope(serverMethod, serverBaseURL), start))
+		status.Used = cast.ToInt64(val)
+		return err
+	})
+	if err != nil && err != buntdb.ErrNotFound {
+		return nil, err
+	}
+	if status.Used < status.Limit {
+		status.Remaining = status.Limit - status.Used
+	}
+	return status, nil
+}
+
+// usagePeriod - the period of the quota (a month when there is none)
+func usagePeriod(quota *Quota) *Quota {
+	if quota == nil {
+		return &Quota{Period: QuotaMonth}
+	}
+	return quota
+}
+
+// ledgerUsage - the usage of a scope (all scopes when scope is empty) in the period of quota from the ledger entries of the customer
+func ledgerUsage(entries []LedgerEntry, quota *Quota, scope string, now time.Time) *Usage {
+	start, end, err := quota.period(now)
+	if err != nil {
+		return nil
+	}
+	usage := &Usage{Period: quota.Period, Start: start, End: end, Source: UsageLedger}
+	if usage.Period == "" {
+		usage.Period = QuotaMonth
+	}
+	for _, entry := range entries {
+		if scope != "" && entry.Scope != scope || entry.Time.Before(start) || !entry.Time.Before(end) {
+			continue
+		}
+		// the same usage as reconciliation
+		if entry.Status == LedgerCharged || entry.Status == LedgerFailed && entry.Served {
+			usage.Calls++
+			usage.Units += entry.Units
+		}
+	}
+	return usage
+}
+
+// quotaUsage - the usage of a quota counter
+func quotaUsage(status *QuotaStatus) *Usage {
+	if status == nil {
+		return nil
+	}
+	return &Usage{Calls: status.Used, Period: status.Period, Start: status.Start, End: status.End, Source: UsageQuota}
+}
+
+// exhausted - a hard quota with no calls left
+func (s *QuotaStatus) exhausted() bool {
+	return s != nil && !s.Soft && s.Remaining == 0
+}
+
+// subscribed - whether the customer is subscribed to a billable scope (verified like before the handler in Run - a verified subscription is reused for billing_subscription_ttl)
+func subscribed(db *buntdb.DB, identity *Identity, entry *CatalogEntry, billingErr error) bool {
+	if billingErr != nil {
+		return false
+	}
+	scope := entry.Method + ":" + entry.BaseURL
+	if subscriptionVerified(db, identity.CustomerID, scope) {
+		return true
+	}
+	err := verifySubscription(cast.ToString(viper.Get("stripe_key")), newUsageEvent(entry.Method, entry.BaseURL, identity, 0), http.Header{})
+	if err != nil {
+		return false
+	}
+	saveSubscription(db, identity.CustomerID, scope)
+	return true
+}
+
+// Me - the self-service endpoint of API consumers (mount it on /_apibillme/me)
+// the caller is authenticated like in Run and gets their billing identity, scopes, entitlements and usage (nothing is charged or counted)
+func Me(db *buntdb.DB, opts ...Option) http.HandlerFunc {
+	// viper auto config
+	viper.AutomaticEnv()
+	o := newOptions(opts)
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		me, err := account(db, r, o)
+		if err != nil {
+			status := http.StatusUnauthorized
+			if statusErr, ok := err.(*statusError); ok {
+				status = statusErr.status
+			}
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(me)
+	}
+}
+
+// account - authenticate the caller and get their account
+func account(db *buntdb.DB, req *http.Request, o *options) (*MeResponse, error) {
+	// the same authentication and revocation as Run
+	identity, err := authenticate(db, req, o.authenticators)
+	stripQueryTokens(req, o.tokenSources)
+	if err != nil {
+		return nil, err
+	}
+	billingErr := resolveBilling(db, identity, o.provider)
+	if isRevoked(db, identity) {
+		return nil, errors.New("Unauthorized - Access Revoked")
+	}
+
+	me := &MeResponse{
+		Subject:        identity.Subject,
+		AuthMethod:     identity.Method,
+		CustomerID:     identity.CustomerID,
+		OrgID:          identity.OrgID,
+		Scopes:         []string{},
+		BillableScopes: []string{},
+		Entitlements:   []Entitlement{},
+	}
+	granted := map[string]bool{}
+	scopes, _ := urlScopes(identity)
+	for _, scope := range scopes {
+		name := scope.Method + ":" + scope.URL
+		if !granted[name] {
+			granted[name] = true
+			me.Scopes = append(me.Scopes, name)
+		}
+	}
+
+	useRBAC := cast.ToBool(viper.Get("rbac_validate"))
+	useQuota := cast.ToBool(viper.Get("quota"))
+	useStripe := cast.ToBool(viper.Get("stripe_validate"))
+	catalog := &Catalog{}
+	if cast.ToBool(viper.Get("rate_limit")) || useQuota || cast.ToBool(viper.Get("concurrency_limit")) || useStripe {
+		catalog, err = catalogFromConfig(db)
+		if err != nil {
+			return nil, newStatusError(http.StatusInternalServerError, "Unauthorized - cannot find stripe.json on server - contact your admin")
+		}
+		identity.Plan = resolvePlan(db, identity)
+	}
+	me.Plan = identity.Plan
+	if me.Plan == "" {
+		me.Plan = defaultPlan
+	}
+
+	now := time.Now()
+	// the quota of the plan (counted for all scopes)
+	planQuota := catalog.limits(identity.Plan, "", "").Quota
+	if planQuota != nil {
+		me.Quota, _ = planQuota.status(db, identity, "", "", now)
+	}
+	// the usage is in the ledger of the customer from the start of the earliest current period (or else in the quota counters)
+	var entries []LedgerEntry
+	useLedger := cast.ToBool(viper.Get("ledger")) && identity.CustomerID != ""
+	if useLedger {
+		from, _, _ := usagePeriod(planQuota).period(now)
+		for _, entry := range catalog.Scopes {
+			quota := catalog.limits(identity.Plan, entry.Method, entry.BaseURL).Quota
+			if quota == nil || !quota.scoped {
+				continue
+			}
+			if start, _, err := quota.period(now); err == nil && start.Before(from) {
+				from = start
+			}
+		}
+		entries, err = LedgerEntries(db, LedgerQuery{CustomerID: identity.CustomerID, From: from})
+		if err != nil {
+			return nil, err
+		}
+		me.Usage = ledgerUsage(entries, usagePeriod(planQuota), "", now)
+	} else {
+		me.Usage = quotaUsage(me.Quota)
+	}
+
+	// the scopes of the catalog and the granted scopes
+	names := []string{}
+	seen := map[string]bool{}
+	for _, entry := range catalog.Scopes {
+		name := entry.Method + ":" + entry.BaseURL
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, name := range me.Scopes {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		entitlement := Entitlement{Scope: name, Granted: granted[name], Status: DecisionAllowed}
+		var entry *CatalogEntry
+		for i := range catalog.Scopes {
+			if catalog.Scopes[i].Method+":"+catalog.Scopes[i].BaseURL == name {
+				entry = &catalog.Scopes[i]
+				break
+			}
+		}
+		quota := me.Quota
+		scopeQuota := planQuota
+		if entry != nil {
+			entitlement.Billable = catalog.billable(entry.Method, entry.BaseURL)
+			if entitlement.Billable {
+				me.BillableScopes = append(me.BillableScopes, name)
+				entitlement.Units = entry.Units
+				if entitlement.Units <= 0 {
+					entitlement.Units = 1
+				}
+			}
+			limits := catalog.limits(identity.Plan, entry.Method, entry.BaseURL)
+			if limits.Quota != nil && limits.Quota.scoped {
+				entitlement.Quota, _ = limits.Quota.status(db, identity, entry.Method, entry.BaseURL, now)
+				quota = entitlement.Quota
+				scopeQuota = limits.Quota
+				entitlement.Usage = quotaUsage(entitlement.Quota)
+			}
+		}
+		if useLedger {
+			entitlement.Usage = ledgerUsage(entries, usagePeriod(scopeQuota), name, now)
+		}
+		// the stage that would deny the call (in the order of Run)
+		switch {
+		case useRBAC && !entitlement.Granted:
+			entitlement.Status = DecisionInsufficientScope
+		case useQuota && quota.exhausted():
+			entitlement.Status = DecisionQuotaExceeded
+		case useStripe && entitlement.Billable && entry.FailPolicy != FailOpen && !subscribed(db, identity, entry, billingErr):
+			entitlement.Status = DecisionNoSubscription
+		}
+		me.Entitlements = append(me.Entitlements, entitlement)
+	}
+	return me, nil
+}
@@ -0,0 +1,153 @@
+package apibillme
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/apibillme/stubby"
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/gjson"
+)
+
+func TestMe(t *testing.T) {
+
+	Convey("Me", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		viper.AutomaticEnv()
+		os.Setenv("RBAC_VALIDATE", "true")
+		os.Setenv("STRIPE_VALIDATE", "true")
+		os.Setenv("QUOTA", "true")
+		os.Setenv("STRIPE_JSON_PATH", "testdata/catalog.json")
+		defer os.Setenv("QUOTA", "")
+
+		// the subscriptions are verified with apibill.me
+		stub := stubby.StubFunc(&restlyPostJSON, nil, nil)
+		defer func() { stub.Reset() }()
+
+		identity := &Identity{Method: MethodAPIKey, Subject: "apikey|1", CustomerID: "cus_123", Scopes: []string{"get:users", "get:reports"}}
+		authenticator := &stubAuthenticator{identity: identity}
+		request := func(authenticator Authenticator) *httptest.ResponseRecorder {
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.GET("/_apibillme/me", gin.WrapF(Me(db, WithAuthenticator(authenticator))))
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/_apibillme/me", nil)
+			router.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		Convey("Success - account, scopes and entitlements", func() {
+			recorder := request(authenticator)
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			body := recorder.Body.String()
+			So(gjson.Get(body, "subject").String(), ShouldEqual, "apikey|1")
+			So(gjson.Get(body, "customerID").String(), ShouldEqual, "cus_123")
+			So(gjson.Get(body, "plan").String(), ShouldEqual, defaultPlan)
+			So(gjson.Get(body, "scopes").String(), ShouldEqual, `["get:users","get:reports"]`)
+			So(gjson.Get(body, "billableScopes").String(), ShouldEqual, `["get:users","post:users"]`)
+			So(gjson.Get(body, "quota.limit").Int(), ShouldEqual, 3)
+			So(gjson.Get(body, "quota.remaining").Int(), ShouldEqual, 3)
+
+			So(gjson.Get(body, "entitlements.#.scope").String(), ShouldEqual, `["get:health","get:reports","get:users","post:users"]`)
+			So(gjson.Get(body, `entitlements.#[scope=="get:users"].status`).String(), ShouldEqual, DecisionAllowed)
+			So(gjson.Get(body, `entitlements.#[scope=="get:health"].billable`).Bool(), ShouldBeFalse)
+			So(gjson.Get(body, `entitlements.#[scope=="post:users"].status`).String(), ShouldEqual, DecisionInsufficientScope)
+		})
+
+		Convey("Success - usage of the current period", func() {
+			quota := &Quota{Limit: 3, Period: QuotaMonth}
+			for i := 0; i < 3; i++ {
+				_, err := quota.use(db, identity, "get", "users", time.Now())
+				So(err, ShouldBeNil)
+			}
+			body := request(authenticator).Body.String()
+			So(gjson.Get(body, "quota.used").Int(), ShouldEqual, 3)
+			So(gjson.Get(body, "quota.remaining").Int(), ShouldEqual, 0)
+			So(gjson.Get(body, "usage.calls").Int(), ShouldEqual, 3)
+			So(gjson.Get(body, "usage.source").String(), ShouldEqual, UsageQuota)
+			So(gjson.Get(body, `entitlements.#[scope=="get:users"].status`).String(), ShouldEqual, DecisionQuotaExceeded)
+		})
+
+		Convey("Success - scope quotas of the plan", func() {
+			SetCustomerPlan(db, "cus_123", "pro")
+			body := request(authenticator).Body.String()
+			So(gjson.Get(body, "plan").String(), ShouldEqual, "pro")
+			So(gjson.Get(body, `entitlements.#[scope=="get:users"].quota.limit`).Int(), ShouldEqual, 1)
+			So(gjson.Get(body, `entitlements.#[scope=="get:users"].quota.soft`).Bool(), ShouldBeTrue)
+		})
+
+		Convey("Success - usage from the ledger of a plan without a quota", func() {
+			os.Setenv("LEDGER", "true")
+			defer os.Setenv("LEDGER", "")
+			SetCustomerPlan(db, "cus_123", "pro")
+			now := time.Now()
+			recordUsage(db, newUsageEvent("get", "users", identity, 1), LedgerCharged, true, now)
+			recordUsage(db, newUsageEvent("post", "users", identity, 5), LedgerCharged, true, now)
+			recordUsage(db, newUsageEvent("post", "users", identity, 4), LedgerFailed, true, now)
+			// denied calls, shadow charges and the calls of the previous period are not usage
+			recordUsage(db, newUsageEvent("post", "users", identity, 3), LedgerFailed, false, now)
+			recordUsage(db, newUsageEvent("post", "users", identity, 3), LedgerShadow, true, now)
+			recordUsage(db, newUsageEvent("post", "users", identity, 3), LedgerCharged, true, now.AddDate(0, -1, -1))
+
+			body := request(authenticator).Body.String()
+			So(gjson.Get(body, "quota").Exists(), ShouldBeFalse)
+			So(gjson.Get(body, "usage.calls").Int(), ShouldEqual, 3)
+			So(gjson.Get(body, "usage.units").Int(), ShouldEqual, 10)
+			So(gjson.Get(body, "usage.period").String(), ShouldEqual, QuotaMonth)
+			So(gjson.Get(body, "usage.source").String(), ShouldEqual, UsageLedger)
+			So(gjson.Get(body, `entitlements.#[scope=="post:users"].quota`).Exists(), ShouldBeFalse)
+			So(gjson.Get(body, `entitlements.#[scope=="post:users"].usage.calls`).Int(), ShouldEqual, 2)
+			So(gjson.Get(body, `entitlements.#[scope=="post:users"].usage.units`).Int(), ShouldEqual, 9)
+			// the scope quota has its own period
+			So(gjson.Get(body, `entitlements.#[scope=="get:users"].usage.calls`).Int(), ShouldEqual, 1)
+			So(gjson.Get(body, `entitlements.#[scope=="get:users"].usage.period`).String(), ShouldEqual, QuotaDay)
+			So(gjson.Get(body, `entitlements.#[scope=="get:reports"].usage.calls`).Int(), ShouldEqual, 0)
+		})
+
+		Convey("Success - subscriptions are verified", func() {
+			stub.Reset()
+			stub = stubby.StubFunc(&restlyPostJSON, nil, errors.New("no subscription"))
+			body := request(authenticator).Body.String()
+			So(gjson.Get(body, `entitlements.#[scope=="get:users"].status`).String(), ShouldEqual, DecisionNoSubscription)
+			So(gjson.Get(body, `entitlements.#[scope=="get:reports"].status`).String(), ShouldEqual, DecisionAllowed)
+
+			// a verified subscription is reused
+			saveSubscription(db, "cus_123", "get:users")
+			body = request(authenticator).Body.String()
+			So(gjson.Get(body, `entitlements.#[scope=="get:users"].status`).String(), ShouldEqual, DecisionAllowed)
+		})
+
+		Convey("Success - no billing identity", func() {
+			body := request(&stubAuthenticator{identity: &Identity{Method: MethodAPIKey, Subject: "apikey|2", Scopes: []string{"get:users", "get:health"}}}).Body.String()
+			So(gjson.Get(body, "customerID").Exists(), ShouldBeFalse)
+			So(gjson.Get(body, `entitlements.#[scope=="get:users"].status`).String(), ShouldEqual, DecisionNoSubscription)
+			So(gjson.Get(body, `entitlements.#[scope=="get:health"].status`).String(), ShouldEqual, DecisionAllowed)
+		})
+
+		Convey("Failure - invalid credentials", func() {
+			recorder := request(&stubAuthenticator{err: errors.New("Unauthorized - Invalid Token")})
+			So(recorder.Code, ShouldEqual, http.StatusUnauthorized)
+			So(gjson.Get(recorder.Body.String(), "error").String(), ShouldEqual, "Unauthorized - Invalid Token")
+		})
+
+		Convey("Failure - revoked customer", func() {
+			err := Revoke(db, Revocation{Type: RevokeCustomer, Value: "cus_123"})
+			So(err, ShouldBeNil)
+			So(request(authenticator).Code, ShouldEqual, http.StatusUnauthorized)
+		})
+	})
+}
@@ -0,0 +1,171 @@
+package apibillme
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+// metering sources
+const (
+	// UnitsRequestSize - units from the size of the request body
+	UnitsRequestSize = "request_size"
+	// UnitsRequestItems - units from the number of items of a JSON array of the request body
+	UnitsRequestItems = "request_items"
+	// UnitsResponseSize - units from the size of the response body
+	UnitsResponseSize = "response_size"
+	// UnitsResponseItems - units from the number of items of a JSON array of the response body
+	UnitsResponseItems = "response_items"
+	// UnitsHandler - units set by the handler with SetUnits
+	UnitsHandler = "handler"
+)
+
+// Metering - compute the units of a call from the request, the response or the handler
+type Metering struct {
+	// Source - request_size, request_items, response_size, response_items or handler
+	Source string `json:"source"`
+	// Path - the gjson path of the array for request_items and response_items (e.g. data.items)
+	Path string `json:"path,omitempty"`
+	// Per - bytes per unit for request_size and response_size (e.g. 1024 - defaults to 1)
+	Per int64 `json:"per,omitempty"`
+}
+
+// context key of SetUnits
+const unitsKey = "apibillme:units"
+
+// SetUnits - set the units of the call from the handler (the catalog entry must have the handler source)
+func SetUnits(c *gin.Context, units int64) {
+	c.Set(unitsKey, units)
+}
+
+// afterHandler - whether the units are only known when the handler is done
+func (m *Metering) afterHandler() bool {
+	return m != nil && (m.Source == UnitsResponseSize || m.Source == UnitsResponseItems || m.Source == UnitsHandler)
+}
+
+// count - the units of a body (size or array items)
+func (m *Metering) count(body []byte) (int64, error) {
+	switch m.Source {
+	case UnitsRequestSize, UnitsResponseSize:
+		return m.sizeUnits(int64(len(body))), nil
+	case UnitsRequestItems, UnitsResponseItems:
+		result := gjson.GetBytes(body, m.Path)
+		if !result.IsArray() {
+			return 0, errors.New("metering path is not an array")
+		}
+		return int64(len(result.Array())), nil
+	}
+	return 0, errors.New("unknown metering source")
+}
+
+// sizeUnits - the units of a body of size bytes
+func (m *Metering) sizeUnits(size int64) int64 {
+	per := m.Per
+	if per <= 0 {
+		per = 1
+	}
+	return int64(math.Ceil(float64(size) / float64(per)))
+}
+
+// weight - the units of a call of the entry (defaults to 1)
+func (e *CatalogEntry) weight() int64 {
+	if e == nil || e.Units <= 0 {
+		return 1
+	}
+	return e.Units
+}
+
+// requestUnits - the units of a call that are known before the handler
+func requestUnits(req *http.Request, entry *CatalogEntry) (int64, error) {
+	if entry == nil || entry.Metering == nil {
+		return entry.weight(), nil
+	}
+	// read the body and put it back for the handler
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		if err != nil {
+			return 0, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	units, err := entry.Metering.count(body)
+	return units * entry.weight(), err
+}
+
+// responseRecorder - keeps a copy of the response body for metering the items of the response
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// handlerUnits - the units of a call that are known when the handler is done (recorder is only set for response items)
+func handlerUnits(c *gin.Context, recorder *responseRecorder, entry *CatalogEntry) (int64, error) {
+	switch entry.Metering.Source {
+	case UnitsHandler:
+		units, ok := c.Get(unitsKey)
+		if !ok {
+			return 0, errors.New("the handler did not set the units")
+		}
+		return units.(int64) * entry.weight(), nil
+	case UnitsResponseSize:
+		// the bytes written (the body is not kept)
+		size := int64(c.Writer.Size())
+		if size < 0 {
+			size = 0
+		}
+		return entry.Metering.sizeUnits(size) * entry.weight(), nil
+	}
+	units, err := entry.Metering.count(recorder.body.Bytes())
+	return units * entry.weight(), err
+}
+
+// meter - charge the call when the handler is done (only for units from the response or the handler)
+// the decision is recorded with the result of the charge - the response is already sent so a failed charge is only recorded as failed
+func (d *decision) meter(c *gin.Context) {
+	if d.pendingCharge == nil {
+		c.Next()
+		return
+	}
+	if d.finish != nil {
+		defer d.finish()
+	}
+	var recorder *responseRecorder
+	if d.pendingCharge.Metering.Source == UnitsResponseItems {
+		recorder = &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+	}
+	c.Next()
+	if recorder != nil {
+		c.Writer = recorder.ResponseWriter
+	}
+	// failed calls are not charged
+	if c.Writer.Status() >= http.StatusBadRequest {
+		return
+	}
+	units, err := handlerUnits(c, recorder, d.pendingCharge)
+	if err == nil && units <= 0 {
+		err = errors.New("the call has no units")
+	}
+	if err != nil {
+		d.unmetered(err)
+		return
+	}
+	d.charge(units)
+}
@@ -0,0 +1,257 @@
+package apibillme
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apibillme/stubby"
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/gjson"
+	"github.com/valyala/fasthttp"
+)
+
+func TestMetering(t *testing.T) {
+
+	Convey("Metering.count", t, func() {
+
+		Convey("Success - body size per unit", func() {
+			units, err := (&Metering{Source: UnitsRequestSize, Per: 4}).count([]byte("123456789"))
+			So(err, ShouldBeNil)
+			So(units, ShouldEqual, 3)
+		})
+
+		Convey("Success - array items", func() {
+			units, err := (&Metering{Source: UnitsResponseItems, Path: "data"}).count([]byte(`{"data":[1,2,3]}`))
+			So(err, ShouldBeNil)
+			So(units, ShouldEqual, 3)
+		})
+
+		Convey("Failure - not an array", func() {
+			_, err := (&Metering{Source: UnitsRequestItems, Path: "data"}).count([]byte(`{"data":1}`))
+			So(err, ShouldBeError)
+		})
+	})
+
+	Convey("requestUnits", t, func() {
+
+		Convey("Success - the weight of the entry", func() {
+			req, _ := http.NewRequest("POST", "/reports", nil)
+			units, err := requestUnits(req, &CatalogEntry{Units: 10})
+			So(err, ShouldBeNil)
+			So(units, ShouldEqual, 10)
+		})
+
+		Convey("Success - the body is put back for the handler", func() {
+			req, _ := http.NewRequest("POST", "/batch", strings.NewReader(`{"items":[1,2]}`))
+			units, err := requestUnits(req, &CatalogEntry{Units: 3, Metering: &Metering{Source: UnitsRequestItems, Path: "items"}})
+			So(err, ShouldBeNil)
+			So(units, ShouldEqual, 6)
+			body, err := ioutil.ReadAll(req.Body)
+			So(err, ShouldBeNil)
+			So(string(body), ShouldEqual, `{"items":[1,2]}`)
+		})
+	})
+
+	Convey("Run - metered charges", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		viper.AutomaticEnv()
+		os.Setenv("RBAC_VALIDATE", "false")
+		os.Setenv("STRIPE_VALIDATE", "true")
+		os.Setenv("STRIPE_JSON_PATH", "testdata/metering.json")
+
+		// charges of 0 units are the pre-authorizations of the calls charged after the handler
+		var charges, authorizations []string
+		var chargeErr error
+		stub := stubby.Stub(&restlyPostJSON, func(req *fasthttp.Request, uri string, b string) (gjson.Result, error) {
+			if gjson.Get(b, "units").Int() == 0 {
+				authorizations = append(authorizations, b)
+			} else {
+				charges = append(charges, b)
+			}
+			return gjson.Result{}, chargeErr
+		})
+		defer stub.Reset()
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		identity := &Identity{Method: MethodAPIKey, Subject: "apikey|1", CustomerID: "cus_123"}
+		logger := &memoryLogger{}
+		router.Use(Run(db, WithAuthenticator(&stubAuthenticator{identity: identity}), WithLogger(logger)))
+		router.POST("/reports", func(c *gin.Context) {
+			c.String(http.StatusOK, "ok")
+		})
+		router.POST("/batch", func(c *gin.Context) {
+			c.String(http.StatusOK, "ok")
+		})
+		router.GET("/reports", func(c *gin.Context) {
+			if c.Query("empty") != "" {
+				c.JSON(http.StatusOK, gin.H{"data": []int{}})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"data": []int{1, 2, 3}})
+		})
+		router.GET("/exports", func(c *gin.Context) {
+			c.String(http.StatusOK, "0123456789")
+		})
+		router.PUT("/exports", func(c *gin.Context) {
+			SetUnits(c, 3)
+			c.String(http.StatusOK, "ok")
+		})
+		router.PUT("/reports", func(c *gin.Context) {
+			if c.Query("fail") != "" {
+				SetUnits(c, 5)
+				c.String(http.StatusInternalServerError, "failed")
+				return
+			}
+			SetUnits(c, 7)
+			c.String(http.StatusOK, "ok")
+		})
+		router.DELETE("/reports", func(c *gin.Context) {
+			c.String(http.StatusOK, "ok")
+		})
+
+		request := func(method string, url string, body string) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest(method, url, strings.NewReader(body))
+			router.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		Convey("Success - the weight of the scope", func() {
+			So(request("POST", "/reports", "").Code, ShouldEqual, http.StatusOK)
+			So(charges, ShouldHaveLength, 1)
+			So(gjson.Get(charges[0], "units").Int(), ShouldEqual, 10)
+		})
+
+		Convey("Success - items of the request", func() {
+			So(request("POST", "/batch", `{"items":[1,2,3,4]}`).Code, ShouldEqual, http.StatusOK)
+			So(gjson.Get(charges[0], "units").Int(), ShouldEqual, 4)
+		})
+
+		Convey("Failure - the request cannot be metered", func() {
+			So(request("POST", "/batch", `{}`).Code, ShouldEqual, http.StatusBadRequest)
+			So(charges, ShouldBeEmpty)
+		})
+
+		Convey("Success - items of the response times the weight", func() {
+			recorder := request("GET", "/reports", "")
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(recorder.Body.String(), ShouldContainSubstring, `"data"`)
+			So(charges, ShouldHaveLength, 1)
+			So(gjson.Get(charges[0], "units").Int(), ShouldEqual, 6)
+			So(authorizations, ShouldHaveLength, 1)
+		})
+
+		Convey("Success - the decision is recorded with the charge", func() {
+			os.Setenv("DEBUG_MODE", "true")
+			defer os.Setenv("DEBUG_MODE", "")
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/reports", nil)
+			req.Header.Set("X-Request-Id", "req-metered")
+			router.ServeHTTP(recorder, req)
+			So(recorder.Header().Get("X-Apibillme-Decision"), ShouldContainSubstring, "billing="+BillingAfterHandler)
+
+			explained := httptest.NewRecorder()
+			req, _ = http.NewRequest("GET", "/_apibillme/explain?requestID=req-metered", nil)
+			admin := &stubAuthenticator{identity: &Identity{Method: MethodAPIKey, Subject: "admin|1", Scopes: []string{"admin:explain"}}}
+			Explain(db, WithAuthenticator(admin))(explained, req)
+			So(gjson.Get(explained.Body.String(), "billing").String(), ShouldEqual, LedgerCharged)
+			So(gjson.Get(explained.Body.String(), "units").Int(), ShouldEqual, 6)
+		})
+
+		Convey("Success - bytes of the response", func() {
+			So(request("GET", "/exports", "").Body.String(), ShouldEqual, "0123456789")
+			So(gjson.Get(charges[0], "units").Int(), ShouldEqual, 3)
+		})
+
+		Convey("Success - units set by the handler", func() {
+			So(request("PUT", "/reports", "").Code, ShouldEqual, http.StatusOK)
+			So(gjson.Get(charges[0], "units").Int(), ShouldEqual, 7)
+		})
+
+		Convey("Success - a served call without units is recorded as unmetered", func() {
+			os.Setenv("LEDGER", "true")
+			defer os.Setenv("LEDGER", "")
+			So(request("DELETE", "/reports", "").Code, ShouldEqual, http.StatusOK)
+			So(charges, ShouldBeEmpty)
+			entries, err := LedgerEntries(db, LedgerQuery{CustomerID: "cus_123"})
+			So(err, ShouldBeNil)
+			So(entries, ShouldHaveLength, 1)
+			So(entries[0].Status, ShouldEqual, LedgerUnmetered)
+			So(entries[0].Units, ShouldEqual, 0)
+			So(entries[0].Served, ShouldBeTrue)
+			So(logger.events[len(logger.events)-1].BillingError, ShouldEqual, "the handler did not set the units")
+
+			// an empty response has no units
+			So(request("GET", "/reports?empty=true", "").Code, ShouldEqual, http.StatusOK)
+			So(charges, ShouldBeEmpty)
+			So(logger.events[len(logger.events)-1].BillingError, ShouldEqual, "the call has no units")
+		})
+
+		Convey("Success - a verified subscription is reused", func() {
+			So(request("PUT", "/reports", "").Code, ShouldEqual, http.StatusOK)
+			So(request("PUT", "/reports", "").Code, ShouldEqual, http.StatusOK)
+			So(authorizations, ShouldHaveLength, 1)
+			So(charges, ShouldHaveLength, 2)
+
+			os.Setenv("BILLING_SUBSCRIPTION_TTL", "0s")
+			defer os.Unsetenv("BILLING_SUBSCRIPTION_TTL")
+			So(request("PUT", "/exports", "").Code, ShouldEqual, http.StatusOK)
+			So(request("PUT", "/exports", "").Code, ShouldEqual, http.StatusOK)
+			So(authorizations, ShouldHaveLength, 3)
+		})
+
+		Convey("Success - the verifications of the subscription are not charges", func() {
+			os.Setenv("BILLING_BREAKER_FAILURES", "1")
+			defer os.Setenv("BILLING_BREAKER_FAILURES", "")
+			defer func() {
+				billingStatus.failures, billingStatus.openUntil, billingStatus.trial = 0, time.Time{}, false
+			}()
+			chargeErr = errors.New("foobar")
+			So(request("PUT", "/reports", "").Code, ShouldEqual, http.StatusUnauthorized)
+			So(authorizations, ShouldHaveLength, 1)
+			So(billingStatus.failures, ShouldEqual, 0)
+			So(gjson.Get(authorizations[0], "units").Exists(), ShouldBeTrue)
+		})
+
+		Convey("Success - failed calls are not charged", func() {
+			So(request("PUT", "/reports?fail=true", "").Code, ShouldEqual, http.StatusInternalServerError)
+			So(charges, ShouldBeEmpty)
+		})
+
+		Convey("Failure - the subscription is verified before the handler", func() {
+			os.Setenv("LEDGER", "true")
+			defer os.Setenv("LEDGER", "")
+			chargeErr = errors.New("foobar")
+			recorder := request("PUT", "/reports", "")
+			So(recorder.Code, ShouldEqual, http.StatusUnauthorized)
+			So(recorder.Body.String(), ShouldNotContainSubstring, "ok")
+			So(authorizations, ShouldHaveLength, 1)
+			So(charges, ShouldBeEmpty)
+
+			// a scope that fails open is served and the failed charge is recorded
+			So(request("PUT", "/exports", "").Code, ShouldEqual, http.StatusOK)
+			entries, err := LedgerEntries(db, LedgerQuery{CustomerID: "cus_123"})
+			So(err, ShouldBeNil)
+			So(entries, ShouldHaveLength, 1)
+			So(entries[0].Status, ShouldEqual, LedgerFailed)
+			So(entries[0].Units, ShouldEqual, 3)
+		})
+	})
+}
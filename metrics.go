@@ -0,0 +1,293 @@
+package apibillme
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+// metric kinds
+const (
+	counterMetric   = "counter"
+	gaugeMetric     = "gauge"
+	histogramMetric = "histogram"
+)
+
+// default histogram buckets in seconds
+var defaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// default number of scope label values (the others are "other")
+const defaultMaxScopes = 100
+
+// series - the value of a metric for label values
+type series struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+// metricFamily - a metric and its series
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+}
+
+// Metrics - counters and histograms of the middleware in the Prometheus text format (mount it as a handler)
+type Metrics struct {
+	sync.Mutex
+	// MaxScopes - the number of scope label values (the others are "other" - defaults to 100)
+	MaxScopes int
+	families  []*metricFamily
+	byName    map[string]*metricFamily
+	scopes    map[string]bool
+}
+
+// NewMetrics - the metrics of the middleware
+func NewMetrics() *Metrics {
+	m := &Metrics{byName: map[string]*metricFamily{}, scopes: map[string]bool{}}
+	m.register("apibillme_requests_total", "Requests by decision and scope.", counterMetric, "decision", "scope")
+	m.register("apibillme_decision_duration_seconds", "Time the middleware took to decide.", histogramMetric, "decision")
+	m.register("apibillme_token_cache_total", "Access tokens found (hit) or not (miss) in the token cache.", counterMetric, "result")
+	m.register("apibillme_jwks_fetches_total", "JWKS fetches of the identity provider.", counterMetric)
+	m.register("apibillme_billing_duration_seconds", "Latency of the billing calls.", histogramMetric, "scope")
+	m.register("apibillme_billing_errors_total", "Failed billing calls.", counterMetric, "scope")
+	m.register("apibillme_charges_in_flight", "Charges sent to the billing backend that have not answered yet.", gaugeMetric)
+	m.register("apibillme_limit_rejections_total", "Requests rejected by rate limits, quotas and concurrency limits.", counterMetric, "limit", "scope")
+	m.register("apibillme_shadow_decisions_total", "What the stages in shadow mode would have done (denied or charged).", counterMetric, "stage", "decision", "scope")
+	m.register("apibillme_shadow_units_total", "Units the billing stage in shadow mode would have charged.", counterMetric, "scope")
+	m.register("apibillme_audit_errors_total", "Audit records that could not be appended by record type.", counterMetric, "type")
+	m.register("apibillme_ledger_errors_total", "Ledger entries that could not be written by status.", counterMetric, "status")
+	return m
+}
+
+func (m *Metrics) register(name string, help string, kind string, labels ...string) {
+	family := &metricFamily{name: name, help: help, kind: kind, labels: labels, series: map[string]*series{}}
+	if kind == histogramMetric {
+		family.buckets = defaultBuckets
+	}
+	m.families = append(m.families, family)
+	m.byName[name] = family
+}
+
+// get - the series of the label values (created on first use)
+func (m *Metrics) get(name string, labelValues []string) *series {
+	family := m.byName[name]
+	key := strings.Join(labelValues, "\xff")
+	s, ok := family.series[key]
+	if !ok {
+		s = &series{labelValues: labelValues, counts: make([]uint64, len(family.buckets))}
+		family.series[key] = s
+	}
+	return s
+}
+
+func (m *Metrics) add(name string, value float64, labelValues ...string) {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.get(name, labelValues).value += value
+}
+
+func (m *Metrics) observe(name string, value float64, labelValues ...string) {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	family := m.byName[name]
+	s := m.get(name, labelValues)
+	for i, bound := range family.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+// scope - the scope label value - only the scopes of the catalog have their own label (bounded by MaxScopes) so unknown URLs cannot grow the series
+func (m *Metrics) scope(serverMethod string, serverBaseURL string, inCatalog bool) string {
+	if serverMethod == "" {
+		return "none"
+	}
+	if !inCatalog {
+		return "other"
+	}
+	scope := serverMethod + ":" + serverBaseURL
+	m.Lock()
+	defer m.Unlock()
+	max := m.MaxScopes
+	if max <= 0 {
+		max = defaultMaxScopes
+	}
+	if !m.scopes[scope] {
+		if len(m.scopes) >= max {
+			return "other"
+		}
+		m.scopes[scope] = true
+	}
+	return scope
+}
+
+// decided - count the decision of a request
+func (m *Metrics) decided(d *decision, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	scope := m.scope(d.serverMethod, d.serverBaseURL, d.inCatalog())
+	m.add("apibillme_requests_total", 1, d.reason, scope)
+	m.observe("apibillme_decision_duration_seconds", duration.Seconds(), d.reason)
+	switch d.reason {
+	case DecisionRateLimited, DecisionQuotaExceeded, DecisionConcurrencyLimited:
+		m.add("apibillme_limit_rejections_total", 1, d.reason, scope)
+	}
+}
+
+// shadowed - count what a stage in shadow mode would have done
+func (m *Metrics) shadowed(d *decision, stage string, decision string, units int64) {
+	if m == nil {
+		return
+	}
+	scope := m.scope(d.serverMethod, d.serverBaseURL, d.inCatalog())
+	m.add("apibillme_shadow_decisions_total", 1, stage, decision, scope)
+	if decision == ShadowCharged {
+		m.add("apibillme_shadow_units_total", float64(units), scope)
+	}
+}
+
+// tokenCached - whether the access_token is in the token cache of the providers (the raw token is the key)
+func tokenCached(db *buntdb.DB, token string) bool {
+	err := db.View(func(tx *buntdb.Tx) error {
+		_, err := tx.Get(token)
+		return err
+	})
+	return err == nil
+}
+
+// inCatalog - whether the scope of the request is in the catalog (loaded here only for requests decided before a stage that needs it)
+func (d *decision) inCatalog() bool {
+	if d.entry != nil {
+		return true
+	}
+	if d.catalog != nil || d.serverMethod == "" || !usesCatalog(d.serverMethod, d.serverBaseURL) {
+		return false
+	}
+	catalog, err := catalogFromConfig(d.db)
+	return err == nil && catalog.entry(d.serverMethod, d.serverBaseURL) != nil
+}
+
+// tokenCache - count a token cache hit or miss
+func (m *Metrics) tokenCache(hit bool) {
+	if m == nil {
+		return
+	}
+	if hit {
+		m.add("apibillme_token_cache_total", 1, "hit")
+		return
+	}
+	m.add("apibillme_token_cache_total", 1, "miss")
+}
+
+type metricsKey struct{}
+
+// contextWithMetrics - the metrics of the requests of the providers (e.g. the JWKS fetches)
+func contextWithMetrics(ctx context.Context, m *Metrics) context.Context {
+	return context.WithValue(ctx, metricsKey{}, m)
+}
+
+// metricsFromContext - the metrics of ctx (nil if there are none)
+func metricsFromContext(ctx context.Context) *Metrics {
+	m, _ := ctx.Value(metricsKey{}).(*Metrics)
+	return m
+}
+
+// jwksFetched - count a JWKS fetch
+func (m *Metrics) jwksFetched() {
+	if m == nil {
+		return
+	}
+	m.add("apibillme_jwks_fetches_total", 1)
+}
+
+// billing - track a billing call - call the returned func when it is done
+func (m *Metrics) billing(serverMethod string, serverBaseURL string) func(error) {
+	if m == nil {
+		return func(error) {}
+	}
+	start := time.Now()
+	// charges are only sent for the scopes of the catalog
+	scope := m.scope(serverMethod, serverBaseURL, true)
+	m.add("apibillme_charges_in_flight", 1)
+	return func(err error) {
+		m.add("apibillme_charges_in_flight", -1)
+		m.observe("apibillme_billing_duration_seconds", time.Since(start).Seconds(), scope)
+		if err != nil {
+			m.add("apibillme_billing_errors_total", 1, scope)
+		}
+	}
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func formatLabels(names []string, values []string, extra ...string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+escapeLabel(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// ServeHTTP - write the metrics in the Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Lock()
+	defer m.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, family := range m.families {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind)
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := family.series[key]
+			if family.kind != histogramMetric {
+				fmt.Fprintf(w, "%s%s %s\n", family.name, formatLabels(family.labels, s.labelValues), formatFloat(s.value))
+				continue
+			}
+			for i, bound := range family.buckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", family.name, formatLabels(family.labels, s.labelValues, "le", formatFloat(bound)), s.counts[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", family.name, formatLabels(family.labels, s.labelValues, "le", "+Inf"), s.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", family.name, formatLabels(family.labels, s.labelValues), formatFloat(s.sum))
+			fmt.Fprintf(w, "%s_count%s %d\n", family.name, formatLabels(family.labels, s.labelValues), s.count)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package apibillme
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+)
+
+// CertificateMapping - maps a client certificate to a billing customer and scopes
+type CertificateMapping struct {
+	// ID - subject:<DN>, uri:<SAN URI> or sha256:<hex fingerprint> of the certificate
+	ID string `json:"id"`
+	// CustomerID - the billing customer of the certificate
+	CustomerID string `json:"customerID"`
+	// Scopes - the scopes of the certificate (e.g. get:users)
+	Scopes []string `json:"scopes"`
+}
+
+func certificateKey(id string) string {
+	return "apibillme:mtls:" + id
+}
+
+// SetCertificateMapping - map a client certificate to a billing customer and scopes in buntdb
+func SetCertificateMapping(db *buntdb.DB, mapping CertificateMapping) error {
+	if mapping.ID == "" || mapping.CustomerID == "" {
+		return errors.New("ID and customer ID are required")
+	}
+	jsonBytes, err := json.Marshal(mapping)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(certificateKey(mapping.ID), string(jsonBytes), nil)
+		return err
+	})
+}
+
+// DeleteCertificateMapping - remove the mapping of a client certificate from buntdb
+func DeleteCertificateMapping(db *buntdb.DB, id string) error {
+	return db.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete(certificateKey(id))
+		return err
+	})
+}
+
+// CertificateFingerprint - SHA-256 fingerprint of a certificate as used in sha256:<hex> IDs
+func CertificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// certificateIDs - the IDs of the certificate from the most to the least specific
+func certificateIDs(cert *x509.Certificate) []string {
+	ids := []string{"sha256:" + CertificateFingerprint(cert)}
+	for _, uri := range cert.URIs {
+		ids = append(ids, "uri:"+uri.String())
+	}
+	return append(ids, "subject:"+cert.Subject.String())
+}
+
+// readCertificateMappings - read the mappings of the mtls_mappings_path file ({"certificates": [...]})
+func readCertificateMappings(path string) ([]CertificateMapping, error) {
+	jsonBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Certificates []CertificateMapping `json:"certificates"`
+	}
+	err = json.Unmarshal(jsonBytes, &file)
+	if err != nil {
+		return nil, err
+	}
+	return file.Certificates, nil
+}
+
+// findCertificateMapping - find the mapping of the certificate in the mappings file or else in buntdb
+func findCertificateMapping(db *buntdb.DB, cert *x509.Certificate) (*CertificateMapping, error) {
+	ids := certificateIDs(cert)
+
+	path := cast.ToString(viper.Get("mtls_mappings_path"))
+	if path != "" {
+		mappings, err := readCertificateMappings(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			for _, mapping := range mappings {
+				if mapping.ID == id {
+					return &mapping, nil
+				}
+			}
+		}
+	}
+
+	for _, id := range ids {
+		var mapping CertificateMapping
+		err := db.View(func(tx *buntdb.Tx) error {
+			val, err := tx.Get(certificateKey(id))
+			if err != nil {
+				return err
+			}
+			return json.Unmarshal([]byte(val), &mapping)
+		})
+		if err == nil {
+			return &mapping, nil
+		}
+	}
+	return nil, errors.New("client certificate is not mapped")
+}
+
+// MTLSAuthenticator - authenticates verified TLS client certificates (when there is no Authorization header)
+type MTLSAuthenticator struct{}
+
+// Authenticate - map the client certificate to its identity
+func (a *MTLSAuthenticator) Authenticate(db *buntdb.DB, req *http.Request) (*Identity, error) {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 || req.Header.Get("Authorization") != "" {
+		return nil, errNoCredentials
+	}
+	// only trust certificates verified by the TLS server (ClientAuth must verify them)
+	if len(req.TLS.VerifiedChains) == 0 {
+		return nil, errors.New("Unauthorized - Client Certificate Not Verified")
+	}
+	mapping, err := findCertificateMapping(db, req.TLS.PeerCertificates[0])
+	if err != nil {
+		return nil, errors.New("Unauthorized - Invalid Client Certificate")
+	}
+	return &Identity{
+		Method:     MethodMTLS,
+		Subject:    "mtls|" + mapping.ID,
+		CustomerID: mapping.CustomerID,
+		Scopes:     mapping.Scopes,
+	}, nil
+}
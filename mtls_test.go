@@ -0,0 +1,142 @@
+package apibillme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+)
+
+// newTestCertificate - create a certificate signed by parent (self-signed CA when parent is nil)
+func newTestCertificate(subject pkix.Name, uri string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if uri != "" {
+		u, _ := url.Parse(uri)
+		template.URIs = []*url.URL{u}
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent = template
+		parentKey = key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		log.Panic(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		log.Panic(err)
+	}
+	return cert, key
+}
+
+// verifiedState - the TLS state of a client certificate verified against the CA
+func verifiedState(cert *x509.Certificate, ca *x509.Certificate) *tls.ConnectionState {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	chains, _ := cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	return &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: chains}
+}
+
+func TestMTLS(t *testing.T) {
+
+	Convey("MTLSAuthenticator", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		ca, caKey := newTestCertificate(pkix.Name{CommonName: "Test CA"}, "", nil, nil)
+		cert, _ := newTestCertificate(pkix.Name{CommonName: "partner", Organization: []string{"Acme"}}, "spiffe://acme/partner", ca, caKey)
+
+		req, err := http.NewRequest("GET", "/users/12", nil)
+		So(err, ShouldBeNil)
+		req.TLS = verifiedState(cert, ca)
+		authenticator := &MTLSAuthenticator{}
+
+		Convey("Success - fingerprint mapping", func() {
+			err := SetCertificateMapping(db, CertificateMapping{ID: "sha256:" + CertificateFingerprint(cert), CustomerID: "cus_123", Scopes: []string{"get:users"}})
+			So(err, ShouldBeNil)
+			identity, err := authenticator.Authenticate(db, req)
+			So(err, ShouldBeNil)
+			So(identity.Method, ShouldEqual, MethodMTLS)
+			So(identity.CustomerID, ShouldEqual, "cus_123")
+			So(identity.Scopes, ShouldResemble, []string{"get:users"})
+		})
+
+		Convey("Success - SAN URI mapping", func() {
+			err := SetCertificateMapping(db, CertificateMapping{ID: "uri:spiffe://acme/partner", CustomerID: "cus_456"})
+			So(err, ShouldBeNil)
+			identity, err := authenticator.Authenticate(db, req)
+			So(err, ShouldBeNil)
+			So(identity.CustomerID, ShouldEqual, "cus_456")
+		})
+
+		Convey("Success - subject DN mapping", func() {
+			err := SetCertificateMapping(db, CertificateMapping{ID: "subject:CN=partner,O=Acme", CustomerID: "cus_789"})
+			So(err, ShouldBeNil)
+			identity, err := authenticator.Authenticate(db, req)
+			So(err, ShouldBeNil)
+			So(identity.CustomerID, ShouldEqual, "cus_789")
+		})
+
+		Convey("Success - mappings file", func() {
+			viper.AutomaticEnv()
+			os.Setenv("MTLS_MAPPINGS_PATH", "testdata/mtls.json")
+			defer os.Setenv("MTLS_MAPPINGS_PATH", "")
+			fileCert, _ := newTestCertificate(pkix.Name{CommonName: "file-partner", Organization: []string{"Acme"}}, "", ca, caKey)
+			req.TLS = verifiedState(fileCert, ca)
+			identity, err := authenticator.Authenticate(db, req)
+			So(err, ShouldBeNil)
+			So(identity.CustomerID, ShouldEqual, "cus_file")
+		})
+
+		Convey("Failure - unmapped certificate", func() {
+			_, err := authenticator.Authenticate(db, req)
+			So(err, ShouldBeError)
+		})
+
+		Convey("Failure - certificate of another CA", func() {
+			otherCA, otherKey := newTestCertificate(pkix.Name{CommonName: "Other CA"}, "", nil, nil)
+			other, _ := newTestCertificate(pkix.Name{CommonName: "partner", Organization: []string{"Acme"}}, "", otherCA, otherKey)
+			err := SetCertificateMapping(db, CertificateMapping{ID: "subject:CN=partner,O=Acme", CustomerID: "cus_789"})
+			So(err, ShouldBeNil)
+			req.TLS = verifiedState(other, ca)
+			_, err = authenticator.Authenticate(db, req)
+			So(err, ShouldBeError)
+		})
+
+		Convey("Failure - no client certificate", func() {
+			req.TLS = nil
+			_, err := authenticator.Authenticate(db, req)
+			So(err, ShouldEqual, errNoCredentials)
+		})
+	})
+}
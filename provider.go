@@ -0,0 +1,274 @@
+package apibillme
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jws"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/gjson"
+)
+
+// how long a discovery document is cached in buntdb
+const discoveryTTL = time.Hour
+
+// for stubbing
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// Provider - identity provider that validates the access_token of a request
+type Provider interface {
+	// Validate - validate the access_token of the request and return it
+	Validate(db *buntdb.DB, req *http.Request) (*jwt.Token, error)
+	// Email - get the email address of the user from the access_token
+	Email(token *jwt.Token) (string, error)
+}
+
+// OIDCProvider - generic OpenID Connect provider (Keycloak, Okta, Dex, Cognito, etc.)
+type OIDCProvider struct {
+	// Issuer - the iss of the tokens - the discovery document is read from here when DiscoveryURL is empty
+	Issuer string
+	// Audience - the aud of the tokens
+	Audience string
+	// DiscoveryURL - the full URL of the /.well-known/openid-configuration document
+	DiscoveryURL string
+	// JWKURL - the JWKS URI - when set discovery is skipped
+	JWKURL string
+	// EmailClaim - the gjson path of the email claim (defaults to email)
+	EmailClaim string
+}
+
+// Auth0Provider - Auth0 preset of the generic OIDC provider (email is the <audience>email custom claim)
+type Auth0Provider struct {
+	OIDCProvider
+}
+
+// NewAuth0Provider - create an Auth0 provider - jwkURL defaults to the JWKS of the issuer
+func NewAuth0Provider(jwkURL string, audience string, issuer string) *Auth0Provider {
+	if jwkURL == "" {
+		jwkURL = strings.TrimSuffix(issuer, "/") + "/.well-known/jwks.json"
+	}
+	return &Auth0Provider{OIDCProvider{
+		Issuer:   issuer,
+		Audience: audience,
+		JWKURL:   jwkURL,
+	}}
+}
+
+// Email - get email as the <audience>email custom claim from the access_token
+func (p *Auth0Provider) Email(token *jwt.Token) (string, error) {
+	return auth0GetEmail(token, p.Audience)
+}
+
+// Validate - validate the access_token against the JWKS of the provider
+func (p *OIDCProvider) Validate(db *buntdb.DB, req *http.Request) (*jwt.Token, error) {
+	jwkURL, issuer, err := p.keys(req.Context(), db)
+	if err != nil {
+		return nil, err
+	}
+	return jwtValidateNet(db, jwkURL, p.Audience, issuer, req)
+}
+
+// Email - get email from the email claim of the access_token
+func (p *OIDCProvider) Email(token *jwt.Token) (string, error) {
+	claim := p.EmailClaim
+	if claim == "" {
+		claim = "email"
+	}
+	return getClaim(token, claim)
+}
+
+// keys - get the JWKS URI and issuer (from discovery if no JWKS URI is set)
+func (p *OIDCProvider) keys(ctx context.Context, db *buntdb.DB) (string, string, error) {
+	if p.JWKURL != "" {
+		return p.JWKURL, p.Issuer, nil
+	}
+	doc, err := discover(ctx, db, p.discoveryURL())
+	if err != nil {
+		return "", "", err
+	}
+	issuer := doc.Get("issuer").String()
+	jwkURL := doc.Get("jwks_uri").String()
+	if jwkURL == "" {
+		return "", "", errors.New("discovery document has no jwks_uri")
+	}
+	// the discovered issuer must be the configured one (if any)
+	if p.Issuer != "" && strings.TrimSuffix(p.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+		return "", "", errors.New("discovery document issuer does not match")
+	}
+	return jwkURL, issuer, nil
+}
+
+func (p *OIDCProvider) discoveryURL() string {
+	if p.DiscoveryURL != "" {
+		return p.DiscoveryURL
+	}
+	if p.Issuer == "" {
+		return ""
+	}
+	return strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+}
+
+func discover(ctx context.Context, db *buntdb.DB, discoveryURL string) (gjson.Result, error) {
+	if discoveryURL == "" {
+		return gjson.Result{}, errors.New("no OIDC issuer or discovery url set")
+	}
+	key := "apibillme:oidc:" + discoveryURL
+
+	// check if the discovery document is in db
+	var doc string
+	err := db.View(func(tx *buntdb.Tx) error {
+		val, err := tx.Get(key)
+		doc = val
+		return err
+	})
+	if err == nil {
+		return gjson.Parse(doc), nil
+	}
+
+	// if not then fetch it and save it in db
+	jsonBytes, err := fetch(ctx, discoveryURL)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	if !gjson.ValidBytes(jsonBytes) {
+		return gjson.Result{}, errors.New("discovery document is not valid JSON")
+	}
+	err = db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(key, string(jsonBytes), &buntdb.SetOptions{Expires: true, TTL: discoveryTTL})
+		return err
+	})
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	return gjson.ParseBytes(jsonBytes), nil
+}
+
+// fetch - GET the URL with the trace context of ctx
+func fetch(ctx context.Context, URL string) ([]byte, error) {
+	req, err := http.NewRequest("GET", URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	spanFromContext(ctx).Inject(req.Header)
+	res, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New("failed to fetch " + URL + " (status " + res.Status + ")")
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+// validateNet - validate the Authorization: Bearer access_token against the JWKS (tokens in the token cache are only verified)
+func validateNet(db *buntdb.DB, jwkURL string, audience string, issuer string, req *http.Request) (*jwt.Token, error) {
+	raw := extractToken(req, defaultTokenSources)
+	if raw == "" {
+		return nil, errors.New("Authorization header must have a Bearer token")
+	}
+	if tokenCached(db, raw) {
+		return verifyJWT(raw)
+	}
+	set, err := fetchJWKS(req.Context(), jwkURL)
+	if err != nil {
+		return nil, err
+	}
+	signed := false
+	for _, key := range set.Keys {
+		if _, err := jws.VerifyWithJWK([]byte(raw), key); err == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return nil, errors.New("access_token is not signed by a key of the JWKS")
+	}
+	token, err := verifyJWT(raw)
+	if err != nil {
+		return nil, err
+	}
+	if token.Audience() != audience {
+		return nil, errors.New("audience is not valid")
+	}
+	if token.Issuer() != issuer {
+		return nil, errors.New("issuer is not valid")
+	}
+	// the raw token is the key of the token cache
+	err = db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(raw, raw, nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// verifyJWT - parse the access_token and verify its claims (exp, nbf and iat)
+func verifyJWT(raw string) (*jwt.Token, error) {
+	token, err := jwt.ParseString(raw)
+	if err != nil {
+		return nil, err
+	}
+	err = token.Verify()
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// fetchJWKS - GET the JWKS in a jwks span (a child of the span of ctx) with its trace context (counted in the metrics of ctx)
+func fetchJWKS(ctx context.Context, jwkURL string) (*jwk.Set, error) {
+	metricsFromContext(ctx).jwksFetched()
+	ctx, span := startSpan(tracerFromContext(ctx), ctx, "apibillme.jwks")
+	jsonBytes, err := fetch(ctx, jwkURL)
+	var set *jwk.Set
+	if err == nil {
+		set, err = jwk.Parse(jsonBytes)
+	}
+	endStage(span, err)
+	return set, err
+}
+
+func getClaim(token *jwt.Token, path string) (string, error) {
+	jsonBytes, err := token.MarshalJSON()
+	if err != nil {
+		return "", err
+	}
+	return claimValue(string(jsonBytes), path)
+}
+
+// claimValue - get the claim at the gjson path of JSON claims
+func claimValue(claims string, path string) (string, error) {
+	value := gjson.Get(claims, path).String()
+	if value == "" {
+		return "", errors.New("there is no " + path + " claim")
+	}
+	return value, nil
+}
+
+func providerFromConfig() Provider {
+	if strings.ToLower(cast.ToString(viper.Get("identity_provider"))) == "oidc" {
+		return &OIDCProvider{
+			Issuer:       cast.ToString(viper.Get("oidc_issuer")),
+			Audience:     cast.ToString(viper.Get("oidc_audience")),
+			DiscoveryURL: cast.ToString(viper.Get("oidc_discovery_url")),
+			JWKURL:       cast.ToString(viper.Get("oidc_jwk")),
+			EmailClaim:   cast.ToString(viper.Get("oidc_email_claim")),
+		}
+	}
+	return NewAuth0Provider(
+		cast.ToString(viper.Get("auth0_jwk")),
+		cast.ToString(viper.Get("auth0_audience")),
+		cast.ToString(viper.Get("auth0_issuer")),
+	)
+}
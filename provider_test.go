@@ -0,0 +1,127 @@
+package apibillme
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/apibillme/stubby"
+	"github.com/lestrrat-go/jwx/jwt"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+)
+
+func TestProvider(t *testing.T) {
+
+	Convey("OIDCProvider", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		// local discovery/JWKS stand-in
+		fetches := 0
+		mux := http.NewServeMux()
+		server := httptest.NewServer(mux)
+		defer server.Close()
+		mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+			fetches++
+			w.Write([]byte(`{"issuer":"` + server.URL + `","jwks_uri":"` + server.URL + `/keys"}`))
+		})
+
+		var jwkURL, issuer string
+		stub1 := stubby.Stub(&jwtValidateNet, func(db *buntdb.DB, jwk string, audience string, iss string, req *http.Request) (*jwt.Token, error) {
+			jwkURL = jwk
+			issuer = iss
+			return jwt.New(), nil
+		})
+		defer stub1.Reset()
+
+		req, err := http.NewRequest("GET", "/users/12", nil)
+		So(err, ShouldBeNil)
+
+		Convey("Success - reads the JWKS URI and issuer from discovery", func() {
+			provider := &OIDCProvider{Issuer: server.URL + "/", Audience: "api"}
+			_, err := provider.Validate(db, req)
+			So(err, ShouldBeNil)
+			So(jwkURL, ShouldEqual, server.URL+"/keys")
+			So(issuer, ShouldEqual, server.URL)
+
+			Convey("and caches the discovery document", func() {
+				_, err := provider.Validate(db, req)
+				So(err, ShouldBeNil)
+				So(fetches, ShouldEqual, 1)
+			})
+		})
+
+		Convey("Success - JWKS URI skips discovery", func() {
+			provider := &OIDCProvider{Issuer: "https://issuer/", JWKURL: "https://issuer/jwks"}
+			_, err := provider.Validate(db, req)
+			So(err, ShouldBeNil)
+			So(jwkURL, ShouldEqual, "https://issuer/jwks")
+			So(fetches, ShouldEqual, 0)
+		})
+
+		Convey("Failure - issuer does not match discovery", func() {
+			provider := &OIDCProvider{Issuer: "https://foobar/", DiscoveryURL: server.URL + "/.well-known/openid-configuration"}
+			_, err := provider.Validate(db, req)
+			So(err, ShouldBeError)
+		})
+
+		Convey("Failure - cannot fetch discovery", func() {
+			provider := &OIDCProvider{DiscoveryURL: server.URL + "/foobar"}
+			_, err := provider.Validate(db, req)
+			So(err, ShouldBeError)
+		})
+
+		Convey("Failure - no issuer or discovery url", func() {
+			provider := &OIDCProvider{}
+			_, err := provider.Validate(db, req)
+			So(err, ShouldBeError)
+		})
+
+		Convey("Email - reads the email claim", func() {
+			token := jwt.New()
+			token.Set("email", "test@example.com")
+			email, err := (&OIDCProvider{}).Email(token)
+			So(err, ShouldBeNil)
+			So(email, ShouldEqual, "test@example.com")
+
+			_, err = (&OIDCProvider{EmailClaim: "foobar"}).Email(token)
+			So(err, ShouldBeError)
+		})
+	})
+
+	Convey("Auth0Provider", t, func() {
+
+		Convey("JWKS defaults to the issuer JWKS", func() {
+			provider := NewAuth0Provider("", "https://httpbin.org/", "https://bevanhunt.auth0.com/")
+			So(provider.JWKURL, ShouldEqual, "https://bevanhunt.auth0.com/.well-known/jwks.json")
+		})
+
+		Convey("Email - uses the <audience>email custom claim", func() {
+			stub1 := stubby.StubFunc(&auth0GetEmail, "", errors.New("foobar"))
+			defer stub1.Reset()
+			_, err := NewAuth0Provider("", "https://httpbin.org/", "").Email(jwt.New())
+			So(err, ShouldBeError)
+		})
+
+		Convey("providerFromConfig - Auth0 is the default", func() {
+			viper.AutomaticEnv()
+			os.Setenv("IDENTITY_PROVIDER", "")
+			_, ok := providerFromConfig().(*Auth0Provider)
+			So(ok, ShouldBeTrue)
+
+			os.Setenv("IDENTITY_PROVIDER", "oidc")
+			defer os.Setenv("IDENTITY_PROVIDER", "")
+			_, ok = providerFromConfig().(*OIDCProvider)
+			So(ok, ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,229 @@
+package apibillme
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/tidwall/buntdb"
+)
+
+// quota periods
+const (
+	QuotaDay   = "day"
+	QuotaWeek  = "week"
+	QuotaMonth = "month"
+)
+
+// Quota - Limit calls per billing period - a hard quota rejects calls over the limit and a soft one only flags them
+type Quota struct {
+	Limit int64 `json:"limit"`
+	// Period - day, week or month (defaults to month)
+	Period string `json:"period,omitempty"`
+	// Anchor - the start of a billing period in RFC 3339 (defaults to 2006-01-01T00:00:00Z - the 1st of the month UTC)
+	Anchor string `json:"anchor,omitempty"`
+	// Soft - let calls over the limit through with a Quota-Exceeded header
+	Soft bool `json:"soft,omitempty"`
+	// Status - the status of calls over a hard limit - 402 (default) or 429
+	Status int `json:"status,omitempty"`
+	// scoped - the quota is of a scope (counted per scope) and not of a plan (counted for all scopes)
+	scoped bool
+}
+
+// quotaResult - the usage of a quota in the current period
+type quotaResult struct {
+	allowed     bool
+	limit       int64
+	used        int64
+	remaining   int64
+	reset       time.Duration
+	periodStart time.Time
+	periodEnd   time.Time
+}
+
+// default anchor of billing periods
+var quotaAnchor = time.Date(2006, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// period - the start and end of the billing period of now
+func (q *Quota) period(now time.Time) (time.Time, time.Time, error) {
+	anchor := quotaAnchor
+	if q.Anchor != "" {
+		var err error
+		anchor, err = time.Parse(time.RFC3339, q.Anchor)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+	switch q.Period {
+	case QuotaDay, QuotaWeek:
+		length := 24 * time.Hour
+		if q.Period == QuotaWeek {
+			length *= 7
+		}
+		start := anchor.Add(time.Duration(math.Floor(float64(now.Sub(anchor))/float64(length))) * length)
+		return start, start.Add(length), nil
+	case QuotaMonth, "":
+		months := (now.Year()-anchor.Year())*12 + int(now.Month()) - int(anchor.Month())
+		start := addMonths(anchor, months)
+		if start.After(now) {
+			months--
+		} else if !addMonths(anchor, months+1).After(now) {
+			months++
+		}
+		return addMonths(anchor, months), addMonths(anchor, months+1), nil
+	}
+	return time.Time{}, time.Time{}, errors.New("quota period must be day, week or month")
+}
+
+// addMonths - the anchor months later (the day is the last day of shorter months - e.g. the 31st is the 30th in April)
+func addMonths(anchor time.Time, months int) time.Time {
+	first := time.Date(anchor.Year(), anchor.Month()+time.Month(months), 1, anchor.Hour(), anchor.Minute(), anchor.Second(), anchor.Nanosecond(), anchor.Location())
+	day := anchor.Day()
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+// quotaKey - the usage counter of the caller (customer or else subject) in the period
+func quotaKey(identity *Identity, scope string, start time.Time) string {
+	owner := "sub:" + identity.Subject
+	if identity.CustomerID != "" {
+		owner = "customer:" + identity.CustomerID
+	}
+	return "apibillme:quota:" + owner + ":" + scope + ":" + strconv.FormatInt(start.Unix(), 10)
+}
+
+// scope - the scope counted by the quota (* for all the billable scopes)
+func (q *Quota) scope(serverMethod string, serverBaseURL string) string {
+	if q.scoped {
+		return serverMethod + ":" + serverBaseURL
+	}
+	return "*"
+}
+
+// use - count a call on the quota unless it is over a hard limit
+func (q *Quota) use(db *buntdb.DB, identity *Identity, serverMethod string, serverBaseURL string, now time.Time) (quotaResult, error) {
+	start, end, err := q.period(now)
+	if err != nil {
+		return quotaResult{}, err
+	}
+	if q.Limit <= 0 {
+		return quotaResult{}, errors.New("quota must have a limit")
+	}
+	key := quotaKey(identity, q.scope(serverMethod, serverBaseURL), start)
+	result := quotaResult{limit: q.Limit, reset: end.Sub(now), periodStart: start, periodEnd: end}
+	err = db.Update(func(tx *buntdb.Tx) error {
+		val, err := tx.Get(key)
+		if err == nil {
+			result.used = cast.ToInt64(val)
+		}
+		result.allowed = result.used < q.Limit
+		if !result.allowed && !q.Soft {
+			return nil
+		}
+		result.used++
+		// counters are kept a day after the period for reporting
+		_, _, err = tx.Set(key, strconv.FormatInt(result.used, 10), &buntdb.SetOptions{Expires: true, TTL: end.Sub(now) + 24*time.Hour})
+		return err
+	})
+	result.remaining = int64(math.Max(0, float64(q.Limit-result.used)))
+	return result, err
+}
+
+// unuse - give back a call counted on the quota in the period that starts at start
+func (q *Quota) unuse(db *buntdb.DB, identity *Identity, serverMethod string, serverBaseURL string, start time.Time) error {
+	key := quotaKey(identity, q.scope(serverMethod, serverBaseURL), start)
+	return db.Update(func(tx *buntdb.Tx) error {
+		val, err := tx.Get(key)
+		if err != nil {
+			return err
+		}
+		ttl, err := tx.TTL(key)
+		if err != nil {
+			return err
+		}
+		used := int64(math.Max(0, float64(cast.ToInt64(val)-1)))
+		_, _, err = tx.Set(key, strconv.FormatInt(used, 10), &buntdb.SetOptions{Expires: ttl > 0, TTL: ttl})
+		return err
+	})
+}
+
+// QuotaUsage - the calls counted in the current period for a customer (scope is method:baseURL or * for plan quotas)
+func QuotaUsage(db *buntdb.DB, customerID string, scope string, quota *Quota) (int64, error) {
+	start, _, err := quota.period(time.Now())
+	if err != nil {
+		return 0, err
+	}
+	var used int64
+	err = db.View(func(tx *buntdb.Tx) error {
+		val, err := tx.Get(quotaKey(&Identity{CustomerID: customerID}, scope, start))
+		used = cast.ToInt64(val)
+		return err
+	})
+	if err == buntdb.ErrNotFound {
+		return 0, nil
+	}
+	return used, err
+}
+
+// quotaHeaders - Quota-Limit, Quota-Remaining, Quota-Reset (and Quota-Exceeded over a soft limit)
+func quotaHeaders(headers http.Header, result quotaResult) {
+	headers.Set("Quota-Limit", strconv.FormatInt(result.limit, 10))
+	headers.Set("Quota-Remaining", strconv.FormatInt(result.remaining, 10))
+	headers.Set("Quota-Reset", strconv.FormatInt(int64(math.Ceil(result.reset.Seconds())), 10))
+	if !result.allowed {
+		headers.Set("Quota-Exceeded", "true")
+	}
+}
+
+// checkQuota - count the call on the quota of the caller - 402 (or the quota status) over a hard limit
+func checkQuota(db *buntdb.DB, d *decision, quota *Quota) error {
+	result, err := quota.use(db, d.identity, d.serverMethod, d.serverBaseURL, time.Now())
+	if err != nil {
+		return newStatusError(http.StatusInternalServerError, "Quota is misconfigured - contact your admin")
+	}
+	quotaHeaders(d.headers, result)
+	// the call is counted until a later stage denies it (see settleQuota)
+	if result.allowed || quota.Soft {
+		d.quota = quota
+		d.quotaResult = &result
+	}
+	if result.allowed {
+		return nil
+	}
+	if quota.Soft {
+		d.quotaExceeded = true
+		return nil
+	}
+	status := quota.Status
+	if status != http.StatusTooManyRequests {
+		status = http.StatusPaymentRequired
+	}
+	return newStatusError(status, "Quota Exceeded - the quota of your plan is used up until "+result.periodEnd.UTC().Format(time.RFC3339))
+}
+
+// settleQuota - give back the call counted on the quota when a later stage denied it (or else send the quota alerts)
+func (d *decision) settleQuota(err error) {
+	if d.quotaResult == nil {
+		return
+	}
+	result := *d.quotaResult
+	if err == nil {
+		if d.alerts {
+			d.alertQuota(d.quota, result)
+		}
+		return
+	}
+	if d.quota.unuse(d.db, d.identity, d.serverMethod, d.serverBaseURL, result.periodStart) != nil {
+		return
+	}
+	result.used--
+	result.remaining = int64(math.Max(0, float64(result.limit-result.used)))
+	result.allowed = result.used < result.limit
+	d.headers.Del("Quota-Exceeded")
+	quotaHeaders(d.headers, result)
+}
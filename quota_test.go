@@ -0,0 +1,227 @@
+package apibillme
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+)
+
+func TestQuota(t *testing.T) {
+
+	Convey("Quota.period", t, func() {
+
+		now := time.Date(2019, 3, 20, 12, 0, 0, 0, time.UTC)
+
+		Convey("Success - the 1st of the month by default", func() {
+			start, end, err := (&Quota{Limit: 1}).period(now)
+			So(err, ShouldBeNil)
+			So(start, ShouldResemble, time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC))
+			So(end, ShouldResemble, time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC))
+		})
+
+		Convey("Success - monthly from the anchor", func() {
+			quota := &Quota{Limit: 1, Period: QuotaMonth, Anchor: "2018-06-25T00:00:00Z"}
+			start, end, err := quota.period(now)
+			So(err, ShouldBeNil)
+			So(start, ShouldResemble, time.Date(2019, 2, 25, 0, 0, 0, 0, time.UTC))
+			So(end, ShouldResemble, time.Date(2019, 3, 25, 0, 0, 0, 0, time.UTC))
+		})
+
+		Convey("Success - monthly from the end of a month", func() {
+			quota := &Quota{Limit: 1, Period: QuotaMonth, Anchor: "2019-01-31T00:00:00Z"}
+			start, end, err := quota.period(time.Date(2019, 2, 15, 0, 0, 0, 0, time.UTC))
+			So(err, ShouldBeNil)
+			So(start, ShouldResemble, time.Date(2019, 1, 31, 0, 0, 0, 0, time.UTC))
+			So(end, ShouldResemble, time.Date(2019, 2, 28, 0, 0, 0, 0, time.UTC))
+			start, end, _ = quota.period(now)
+			So(start, ShouldResemble, time.Date(2019, 2, 28, 0, 0, 0, 0, time.UTC))
+			So(end, ShouldResemble, time.Date(2019, 3, 31, 0, 0, 0, 0, time.UTC))
+			start, end, _ = quota.period(time.Date(2019, 4, 10, 0, 0, 0, 0, time.UTC))
+			So(start, ShouldResemble, time.Date(2019, 3, 31, 0, 0, 0, 0, time.UTC))
+			So(end, ShouldResemble, time.Date(2019, 4, 30, 0, 0, 0, 0, time.UTC))
+		})
+
+		Convey("Success - weekly from the anchor", func() {
+			quota := &Quota{Limit: 1, Period: QuotaWeek, Anchor: "2019-03-04T00:00:00Z"}
+			start, _, err := quota.period(now)
+			So(err, ShouldBeNil)
+			So(start, ShouldResemble, time.Date(2019, 3, 18, 0, 0, 0, 0, time.UTC))
+		})
+
+		Convey("Failure - unknown period or anchor", func() {
+			_, _, err := (&Quota{Limit: 1, Period: "year"}).period(now)
+			So(err, ShouldBeError)
+			_, _, err = (&Quota{Limit: 1, Anchor: "foobar"}).period(now)
+			So(err, ShouldBeError)
+		})
+	})
+
+	Convey("Quota.use", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		identity := &Identity{Subject: "github|1", CustomerID: "cus_123"}
+		now := time.Now()
+
+		Convey("Success - hard quotas stop counting at the limit", func() {
+			quota := &Quota{Limit: 1}
+			result, err := quota.use(db, identity, "get", "users", now)
+			So(err, ShouldBeNil)
+			So(result.allowed, ShouldBeTrue)
+			So(result.remaining, ShouldEqual, 0)
+			result, _ = quota.use(db, identity, "get", "users", now)
+			So(result.allowed, ShouldBeFalse)
+			used, err := QuotaUsage(db, "cus_123", "*", quota)
+			So(err, ShouldBeNil)
+			So(used, ShouldEqual, 1)
+		})
+
+		Convey("Success - soft quotas keep counting", func() {
+			quota := &Quota{Limit: 1, Soft: true, scoped: true}
+			quota.use(db, identity, "get", "users", now)
+			result, _ := quota.use(db, identity, "get", "users", now)
+			So(result.allowed, ShouldBeFalse)
+			used, _ := QuotaUsage(db, "cus_123", "get:users", quota)
+			So(used, ShouldEqual, 2)
+		})
+
+		Convey("Success - no usage", func() {
+			used, err := QuotaUsage(db, "cus_456", "*", &Quota{Limit: 1})
+			So(err, ShouldBeNil)
+			So(used, ShouldEqual, 0)
+		})
+	})
+
+	Convey("Run - quota", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		viper.AutomaticEnv()
+		os.Setenv("QUOTA", "true")
+		os.Setenv("RBAC_VALIDATE", "false")
+		os.Setenv("STRIPE_VALIDATE", "false")
+		os.Setenv("STRIPE_JSON_PATH", "testdata/catalog.json")
+		defer os.Setenv("QUOTA", "")
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		identity := &Identity{Method: MethodAPIKey, Subject: "apikey|1", CustomerID: "cus_123"}
+		router.Use(Run(db, WithAuthenticator(&stubAuthenticator{identity: identity})))
+		router.GET("/users/:id", func(c *gin.Context) {
+			c.String(http.StatusOK, "ok")
+		})
+		router.GET("/health", func(c *gin.Context) {
+			c.String(http.StatusOK, "ok")
+		})
+		router.GET("/orders", func(c *gin.Context) {
+			c.String(http.StatusOK, "ok")
+		})
+
+		request := func() *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/users/12", nil)
+			router.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		Convey("Success - 402 over a hard quota", func() {
+			recorder := request()
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(recorder.Header().Get("Quota-Limit"), ShouldEqual, "3")
+			So(recorder.Header().Get("Quota-Remaining"), ShouldEqual, "2")
+			request()
+			request()
+			recorder = request()
+			So(recorder.Code, ShouldEqual, http.StatusPaymentRequired)
+			So(recorder.Header().Get("Quota-Exceeded"), ShouldEqual, "true")
+		})
+
+		Convey("Success - the quota of the plan only counts the billable scopes", func() {
+			for _, path := range []string{"/health", "/orders"} {
+				recorder := httptest.NewRecorder()
+				req, _ := http.NewRequest("GET", path, nil)
+				router.ServeHTTP(recorder, req)
+				So(recorder.Code, ShouldEqual, http.StatusOK)
+				So(recorder.Header().Get("Quota-Limit"), ShouldBeEmpty)
+			}
+			So(request().Header().Get("Quota-Remaining"), ShouldEqual, "2")
+		})
+
+		Convey("Success - soft quotas only flag calls", func() {
+			err := SetCustomerPlan(db, "cus_123", "pro")
+			So(err, ShouldBeNil)
+			So(request().Code, ShouldEqual, http.StatusOK)
+			recorder := request()
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(recorder.Header().Get("Quota-Exceeded"), ShouldEqual, "true")
+		})
+	})
+	Convey("Run - quota of denied calls", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		viper.AutomaticEnv()
+		os.Setenv("QUOTA", "true")
+		os.Setenv("CONCURRENCY_LIMIT", "true")
+		os.Setenv("RBAC_VALIDATE", "false")
+		os.Setenv("STRIPE_VALIDATE", "false")
+		os.Setenv("STRIPE_JSON_PATH", "testdata/catalog.json")
+		defer os.Setenv("QUOTA", "")
+		defer os.Setenv("CONCURRENCY_LIMIT", "")
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		identity := &Identity{Method: MethodAPIKey, Subject: "apikey|1", CustomerID: "cus_123"}
+		router.Use(Run(db, WithAuthenticator(&stubAuthenticator{identity: identity})))
+		started := make(chan bool)
+		finish := make(chan bool)
+		router.POST("/users", func(c *gin.Context) {
+			started <- true
+			<-finish
+			c.String(http.StatusOK, "ok")
+		})
+		request := func() *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/users", nil)
+			router.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		Convey("Success - a call denied by the concurrency limit is given back", func() {
+			done := make(chan *httptest.ResponseRecorder)
+			go func() {
+				done <- request()
+			}()
+			<-started
+			recorder := request()
+			So(recorder.Code, ShouldEqual, http.StatusTooManyRequests)
+			So(recorder.Header().Get("Quota-Remaining"), ShouldEqual, "2")
+			finish <- true
+			So((<-done).Code, ShouldEqual, http.StatusOK)
+
+			used, err := QuotaUsage(db, "cus_123", "*", &Quota{Limit: 3})
+			So(err, ShouldBeNil)
+			So(used, ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,212 @@
+package apibillme
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+)
+
+// RateLimit - a token bucket of Limit calls per Period (e.g. 1m) - Burst is the bucket size (defaults to Limit)
+type RateLimit struct {
+	Limit  int64  `json:"limit"`
+	Period string `json:"period"`
+	Burst  int64  `json:"burst,omitempty"`
+}
+
+// bucket - the state of a token bucket
+type bucket struct {
+	Tokens  float64 `json:"tokens"`
+	Updated int64   `json:"updated"`
+}
+
+// rateLimitResult - the outcome of taking a token
+type rateLimitResult struct {
+	allowed    bool
+	limit      int64
+	remaining  int64
+	reset      time.Duration
+	retryAfter time.Duration
+}
+
+// bucketStore - where token buckets are kept (buntdb or memory)
+type bucketStore interface {
+	take(key string, rateLimit *RateLimit, now time.Time) (rateLimitResult, error)
+}
+
+// rate - the size of the bucket and its refill rate in tokens per second
+func (r *RateLimit) rate() (float64, float64, error) {
+	period, err := time.ParseDuration(r.Period)
+	if err != nil || period <= 0 || r.Limit <= 0 {
+		return 0, 0, errors.New("rate limit must have a limit and a period")
+	}
+	size := float64(r.Limit)
+	if r.Burst > 0 {
+		size = float64(r.Burst)
+	}
+	return size, float64(r.Limit) / period.Seconds(), nil
+}
+
+// take - refill the bucket since its last update and take a token
+func (r *RateLimit) take(b *bucket, now time.Time) (rateLimitResult, error) {
+	size, perSecond, err := r.rate()
+	if err != nil {
+		return rateLimitResult{}, err
+	}
+	if b.Updated == 0 {
+		b.Tokens = size
+	} else {
+		elapsed := time.Duration(now.UnixNano() - b.Updated).Seconds()
+		b.Tokens = math.Min(size, b.Tokens+math.Max(0, elapsed)*perSecond)
+	}
+	b.Updated = now.UnixNano()
+
+	result := rateLimitResult{limit: int64(size)}
+	if b.Tokens >= 1 {
+		b.Tokens--
+		result.allowed = true
+	} else {
+		result.retryAfter = seconds((1 - b.Tokens) / perSecond)
+	}
+	result.remaining = int64(b.Tokens)
+	result.reset = seconds((size - b.Tokens) / perSecond)
+	return result, nil
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// buntdbBuckets - token buckets in buntdb (shared by everything using the same db)
+type buntdbBuckets struct {
+	db *buntdb.DB
+}
+
+func (s *buntdbBuckets) take(key string, rateLimit *RateLimit, now time.Time) (rateLimitResult, error) {
+	var result rateLimitResult
+	err := s.db.Update(func(tx *buntdb.Tx) error {
+		var b bucket
+		if val, err := tx.Get(key); err == nil {
+			json.Unmarshal([]byte(val), &b)
+		}
+		var err error
+		result, err = rateLimit.take(&b, now)
+		if err != nil {
+			return err
+		}
+		jsonBytes, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		// a bucket that is full again is the same as no bucket
+		ttl := result.reset + time.Second
+		_, _, err = tx.Set(key, string(jsonBytes), &buntdb.SetOptions{Expires: true, TTL: ttl})
+		return err
+	})
+	return result, err
+}
+
+// memoryBuckets - token buckets in the memory of this process
+type memoryBuckets struct {
+	sync.Mutex
+	buckets map[string]*memoryBucket
+	// swept - when the full buckets were last evicted
+	swept time.Time
+}
+
+// memoryBucket - a token bucket and when it is full again (like the TTL of a buntdb bucket)
+type memoryBucket struct {
+	bucket
+	expires time.Time
+}
+
+// how often the full buckets are evicted
+const bucketSweepInterval = time.Minute
+
+// buckets of rate_limit_store memory (per process)
+var rateLimitMemory = &memoryBuckets{buckets: map[string]*memoryBucket{}}
+
+func (s *memoryBuckets) take(key string, rateLimit *RateLimit, now time.Time) (rateLimitResult, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.sweep(now)
+	b, ok := s.buckets[key]
+	if !ok || !now.Before(b.expires) {
+		// a bucket that is full again is the same as no bucket
+		b = &memoryBucket{}
+		s.buckets[key] = b
+	}
+	result, err := rateLimit.take(&b.bucket, now)
+	if err != nil {
+		delete(s.buckets, key)
+		return result, err
+	}
+	b.expires = now.Add(result.reset + time.Second)
+	return result, nil
+}
+
+// sweep - evict the buckets that are full again (at most every bucketSweepInterval - the buckets must be locked)
+func (s *memoryBuckets) sweep(now time.Time) {
+	if now.Sub(s.swept) < bucketSweepInterval {
+		return
+	}
+	s.swept = now
+	for key, b := range s.buckets {
+		if !now.Before(b.expires) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// rateLimitKey - the bucket of the caller (subject or customer) and optionally the scope
+func rateLimitKey(identity *Identity, serverMethod string, serverBaseURL string) string {
+	key := "apibillme:ratelimit:"
+	if strings.ToLower(cast.ToString(viper.Get("rate_limit_by"))) == "customer" && identity.CustomerID != "" {
+		key += "customer:" + identity.CustomerID
+	} else {
+		key += "sub:" + identity.Subject
+	}
+	if cast.ToBool(viper.Get("rate_limit_per_scope")) {
+		key += ":" + serverMethod + ":" + serverBaseURL
+	}
+	return key
+}
+
+func bucketStoreFromConfig(db *buntdb.DB) bucketStore {
+	if strings.ToLower(cast.ToString(viper.Get("rate_limit_store"))) == "memory" {
+		return rateLimitMemory
+	}
+	return &buntdbBuckets{db: db}
+}
+
+// rateLimitHeaders - RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset (and Retry-After when limited)
+func rateLimitHeaders(headers http.Header, result rateLimitResult) {
+	headers.Set("RateLimit-Limit", strconv.FormatInt(result.limit, 10))
+	headers.Set("RateLimit-Remaining", strconv.FormatInt(result.remaining, 10))
+	headers.Set("RateLimit-Reset", strconv.FormatInt(int64(math.Ceil(result.reset.Seconds())), 10))
+	if !result.allowed {
+		headers.Set("Retry-After", strconv.FormatInt(int64(math.Ceil(result.retryAfter.Seconds())), 10))
+	}
+}
+
+// checkRateLimit - take a token from the bucket of the caller - 429 when it is empty
+func checkRateLimit(store bucketStore, d *decision, rateLimit *RateLimit) error {
+	key := rateLimitKey(d.identity, d.serverMethod, d.serverBaseURL)
+	result, err := store.take(key, rateLimit, time.Now())
+	if err != nil {
+		return newStatusError(http.StatusInternalServerError, "Rate limit is misconfigured - contact your admin")
+	}
+	rateLimitHeaders(d.headers, result)
+	if !result.allowed {
+		return newStatusError(http.StatusTooManyRequests, "Too Many Requests - rate limit exceeded")
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package apibillme
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/apibillme/stubby"
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+)
+
+func TestRateLimit(t *testing.T) {
+
+	Convey("RateLimit", t, func() {
+
+		now := time.Now()
+		rateLimit := &RateLimit{Limit: 2, Period: "1m"}
+
+		Convey("Success - the bucket starts full and refills over the period", func() {
+			var b bucket
+			result, err := rateLimit.take(&b, now)
+			So(err, ShouldBeNil)
+			So(result.allowed, ShouldBeTrue)
+			So(result.remaining, ShouldEqual, 1)
+			result, _ = rateLimit.take(&b, now)
+			So(result.allowed, ShouldBeTrue)
+			result, _ = rateLimit.take(&b, now)
+			So(result.allowed, ShouldBeFalse)
+			So(result.retryAfter, ShouldEqual, 30*time.Second)
+			result, _ = rateLimit.take(&b, now.Add(30*time.Second))
+			So(result.allowed, ShouldBeTrue)
+		})
+
+		Convey("Success - burst is the bucket size", func() {
+			var b bucket
+			burst := &RateLimit{Limit: 1, Period: "1m", Burst: 3}
+			for i := 0; i < 3; i++ {
+				result, _ := burst.take(&b, now)
+				So(result.allowed, ShouldBeTrue)
+			}
+			result, _ := burst.take(&b, now)
+			So(result.allowed, ShouldBeFalse)
+			So(result.limit, ShouldEqual, 3)
+		})
+
+		Convey("Failure - misconfigured", func() {
+			var b bucket
+			_, err := (&RateLimit{Limit: 2, Period: "foobar"}).take(&b, now)
+			So(err, ShouldBeError)
+			_, err = (&RateLimit{Period: "1m"}).take(&b, now)
+			So(err, ShouldBeError)
+		})
+	})
+
+	Convey("bucketStore", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		rateLimit := &RateLimit{Limit: 1, Period: "1m"}
+
+		Convey("buntdb - buckets are kept in db", func() {
+			store := &buntdbBuckets{db: db}
+			result, err := store.take("apibillme:ratelimit:sub:a", rateLimit, time.Now())
+			So(err, ShouldBeNil)
+			So(result.allowed, ShouldBeTrue)
+			result, _ = store.take("apibillme:ratelimit:sub:a", rateLimit, time.Now())
+			So(result.allowed, ShouldBeFalse)
+			result, _ = store.take("apibillme:ratelimit:sub:b", rateLimit, time.Now())
+			So(result.allowed, ShouldBeTrue)
+		})
+
+		Convey("memory - buckets are kept in the process", func() {
+			store := &memoryBuckets{buckets: map[string]*memoryBucket{}}
+			result, _ := store.take("apibillme:ratelimit:sub:a", rateLimit, time.Now())
+			So(result.allowed, ShouldBeTrue)
+			result, _ = store.take("apibillme:ratelimit:sub:a", rateLimit, time.Now())
+			So(result.allowed, ShouldBeFalse)
+		})
+
+		Convey("memory - buckets that are full again are evicted", func() {
+			store := &memoryBuckets{buckets: map[string]*memoryBucket{}}
+			now := time.Now()
+			store.take("apibillme:ratelimit:sub:a", rateLimit, now)
+			store.take("apibillme:ratelimit:sub:b", &RateLimit{Limit: 1, Period: "1h"}, now)
+			So(store.buckets, ShouldHaveLength, 2)
+
+			// sub:a is full again after a minute (and a second) - sub:b after an hour
+			later := now.Add(2 * time.Minute)
+			result, _ := store.take("apibillme:ratelimit:sub:c", rateLimit, later)
+			So(result.allowed, ShouldBeTrue)
+			So(store.buckets, ShouldHaveLength, 2)
+			So(store.buckets["apibillme:ratelimit:sub:a"], ShouldBeNil)
+			So(store.buckets["apibillme:ratelimit:sub:b"], ShouldNotBeNil)
+		})
+	})
+
+	Convey("rateLimitKey", t, func() {
+
+		viper.AutomaticEnv()
+		identity := &Identity{Subject: "github|1", CustomerID: "cus_123"}
+
+		Convey("Success - by subject", func() {
+			So(rateLimitKey(identity, "get", "users"), ShouldEqual, "apibillme:ratelimit:sub:github|1")
+		})
+
+		Convey("Success - by customer and scope", func() {
+			os.Setenv("RATE_LIMIT_BY", "customer")
+			os.Setenv("RATE_LIMIT_PER_SCOPE", "true")
+			defer os.Setenv("RATE_LIMIT_BY", "")
+			defer os.Setenv("RATE_LIMIT_PER_SCOPE", "")
+			So(rateLimitKey(identity, "get", "users"), ShouldEqual, "apibillme:ratelimit:customer:cus_123:get:users")
+		})
+	})
+
+	Convey("Run - rate limited", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		viper.AutomaticEnv()
+		os.Setenv("RATE_LIMIT", "true")
+		os.Setenv("RBAC_VALIDATE", "false")
+		os.Setenv("STRIPE_VALIDATE", "false")
+		os.Setenv("STRIPE_JSON_PATH", "testdata/catalog.json")
+		defer os.Setenv("RATE_LIMIT", "")
+
+		stub := stubby.StubFunc(&restlyPostJSON, nil, nil)
+		defer stub.Reset()
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		identity := &Identity{Method: MethodAPIKey, Subject: "apikey|1", CustomerID: "cus_123"}
+		router.Use(Run(db, WithAuthenticator(&stubAuthenticator{identity: identity})))
+		router.GET("/users/:id", func(c *gin.Context) {
+			c.String(http.StatusOK, "ok")
+		})
+
+		request := func() *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/users/12", nil)
+			router.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		Convey("Success - RateLimit headers and 429 with Retry-After", func() {
+			recorder := request()
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(recorder.Header().Get("RateLimit-Limit"), ShouldEqual, "2")
+			So(recorder.Header().Get("RateLimit-Remaining"), ShouldEqual, "1")
+			So(request().Code, ShouldEqual, http.StatusOK)
+			recorder = request()
+			So(recorder.Code, ShouldEqual, http.StatusTooManyRequests)
+			So(recorder.Header().Get("Retry-After"), ShouldEqual, "30")
+			So(recorder.Header().Get("RateLimit-Remaining"), ShouldEqual, "0")
+		})
+
+		Convey("Success - the plan of the customer", func() {
+			err := SetCustomerPlan(db, "cus_123", "pro")
+			So(err, ShouldBeNil)
+			for i := 0; i < 3; i++ {
+				So(request().Code, ShouldEqual, http.StatusOK)
+			}
+			So(request().Header().Get("RateLimit-Limit"), ShouldEqual, "20")
+		})
+	})
+}
@@ -0,0 +1,229 @@
+package apibillme
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+// LedgerCorrection - status of a corrective charge made by Reconcile
+const LedgerCorrection = "correction"
+
+// UsageSource - the usage the billing backend reports per customer and scope (Calls can be 0 when unknown)
+type UsageSource interface {
+	Usage(from time.Time, to time.Time) ([]LedgerTotal, error)
+}
+
+// FileUsageSource - billed usage from a JSON array or JSONL file of totals (an export of the billing backend for the period)
+type FileUsageSource struct {
+	Path string
+}
+
+// Usage - the totals of the file
+func (s *FileUsageSource) Usage(from time.Time, to time.Time) ([]LedgerTotal, error) {
+	body, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	return parseUsage(body)
+}
+
+// HTTPUsageSource - billed usage from GET <URL>?from=<RFC 3339>&to=<RFC 3339> returning a JSON array of totals
+type HTTPUsageSource struct {
+	URL string
+	// Header - e.g. the Authorization of the billing backend
+	Header http.Header
+}
+
+// Usage - the totals of the billing backend for the period
+func (s *HTTPUsageSource) Usage(from time.Time, to time.Time) ([]LedgerTotal, error) {
+	query := url.Values{"from": {from.UTC().Format(time.RFC3339)}, "to": {to.UTC().Format(time.RFC3339)}}
+	separator := "?"
+	if strings.Contains(s.URL, "?") {
+		separator = "&"
+	}
+	req, err := http.NewRequest("GET", s.URL+separator+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range s.Header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New("failed to get usage (status " + res.Status + ")")
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	return parseUsage(body)
+}
+
+// parseUsage - a JSON array or JSONL of totals
+func parseUsage(body []byte) ([]LedgerTotal, error) {
+	var totals []LedgerTotal
+	body = bytes.TrimSpace(body)
+	if bytes.HasPrefix(body, []byte("[")) {
+		err := json.Unmarshal(body, &totals)
+		return totals, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var total LedgerTotal
+		err := json.Unmarshal(line, &total)
+		if err != nil {
+			return nil, err
+		}
+		totals = append(totals, total)
+	}
+	return totals, scanner.Err()
+}
+
+// Discrepancy - units recorded locally that differ from the units billed
+type Discrepancy struct {
+	CustomerID string `json:"customerID"`
+	Scope      string `json:"scope"`
+	Local      int64  `json:"local"`
+	Billed     int64  `json:"billed"`
+	// Corrections - the units charged by earlier corrections of the period
+	Corrections int64 `json:"corrections,omitempty"`
+	// Difference - local minus billed and the corrections (positive is lost usage and negative is duplicated usage)
+	Difference int64 `json:"difference"`
+	// Corrected - the missing units were charged
+	Corrected bool `json:"corrected,omitempty"`
+	// Error - why the correction failed
+	Error string `json:"error,omitempty"`
+}
+
+// ReconciliationReport - the discrepancies between the ledger and the billing backend in a period
+type ReconciliationReport struct {
+	From          time.Time     `json:"from"`
+	To            time.Time     `json:"to"`
+	Checked       int           `json:"checked"`
+	Discrepancies []Discrepancy `json:"discrepancies"`
+}
+
+// ReconcileOptions - what to reconcile and whether to correct it
+type ReconcileOptions struct {
+	// CustomerID - only reconcile a customer
+	CustomerID string
+	// Correct - charge the missing units of lost usage once per period (duplicated usage is only reported)
+	Correct bool
+	// StripeKey - the key of the corrective charges
+	StripeKey string
+}
+
+// Reconcile - compare the ledger with the usage of the billing backend per customer and scope in [from, to)
+func Reconcile(db *buntdb.DB, source UsageSource, from time.Time, to time.Time, opts ReconcileOptions) (*ReconciliationReport, error) {
+	entries, err := LedgerEntries(db, LedgerQuery{CustomerID: opts.CustomerID, From: from, To: to})
+	if err != nil {
+		return nil, err
+	}
+	billed, err := source.Usage(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	// local units per customer and scope - the served calls (shadow charges and denied calls are not usage)
+	type units struct {
+		customerID, scope          string
+		local, billed, corrections int64
+	}
+	byKey := map[string]*units{}
+	get := func(customerID string, scope string) *units {
+		key := customerID + " " + scope
+		u, ok := byKey[key]
+		if !ok {
+			u = &units{customerID: customerID, scope: scope}
+			byKey[key] = u
+		}
+		return u
+	}
+	for _, entry := range entries {
+		if entry.Status == LedgerCharged || entry.Status == LedgerFailed && entry.Served {
+			get(entry.CustomerID, entry.Scope).local += entry.Units
+		}
+		// the lost usage that was already charged (e.g. reconciled before the export has it)
+		if entry.Status == LedgerCorrection {
+			get(entry.CustomerID, entry.Scope).corrections += entry.Units
+		}
+	}
+	for _, total := range billed {
+		if opts.CustomerID == "" || total.CustomerID == opts.CustomerID {
+			get(total.CustomerID, total.Scope).billed += total.Units
+		}
+	}
+
+	report := &ReconciliationReport{From: from, To: to, Checked: len(byKey), Discrepancies: []Discrepancy{}}
+	for _, u := range byKey {
+		difference := u.local - u.billed - u.corrections
+		if difference == 0 {
+			continue
+		}
+		discrepancy := Discrepancy{
+			CustomerID:  u.customerID,
+			Scope:       u.scope,
+			Local:       u.local,
+			Billed:      u.billed,
+			Corrections: u.corrections,
+			Difference:  difference,
+		}
+		if opts.Correct && discrepancy.Difference > 0 {
+			err := correct(db, opts.StripeKey, discrepancy, from)
+			if err != nil {
+				discrepancy.Error = err.Error()
+			} else {
+				discrepancy.Corrected = true
+			}
+		}
+		report.Discrepancies = append(report.Discrepancies, discrepancy)
+	}
+	sort.Slice(report.Discrepancies, func(i, j int) bool {
+		a, b := report.Discrepancies[i], report.Discrepancies[j]
+		if a.CustomerID != b.CustomerID {
+			return a.CustomerID < b.CustomerID
+		}
+		return a.Scope < b.Scope
+	})
+	return report, nil
+}
+
+// correct - charge the missing units and record the correction in the ledger (both at the start of the period it reconciles)
+func correct(db *buntdb.DB, stripeKey string, discrepancy Discrepancy, period time.Time) error {
+	parts := strings.SplitN(discrepancy.Scope, ":", 2)
+	if len(parts) != 2 {
+		return errors.New("scope must be method:baseURL")
+	}
+	event := usageEvent{
+		ServerMethod:  parts[0],
+		ServerBaseURL: parts[1],
+		CustomerID:    discrepancy.CustomerID,
+		Units:         discrepancy.Difference,
+		Timestamp:     period.Unix(),
+	}
+	err := charge(stripeKey, event, nil)
+	if err != nil {
+		return err
+	}
+	_, err = recordUsage(db, event, LedgerCorrection, true, period)
+	return err
+}
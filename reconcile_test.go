@@ -0,0 +1,184 @@
+package apibillme
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/apibillme/stubby"
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/gjson"
+	"github.com/valyala/fasthttp"
+)
+
+func TestReconcile(t *testing.T) {
+
+	Convey("Reconcile", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		from := time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)
+		to := from.AddDate(0, 1, 0)
+		day := from.AddDate(0, 0, 10)
+		// cus_123 get:users - 2 local (1 failed and served) and 1 billed - post:reports 10 local and 20 billed (duplicated)
+		recordUsage(db, usageEvent{ServerMethod: "get", ServerBaseURL: "users", CustomerID: "cus_123", Units: 1}, LedgerCharged, true, day)
+		recordUsage(db, usageEvent{ServerMethod: "get", ServerBaseURL: "users", CustomerID: "cus_123", Units: 1}, LedgerFailed, true, day)
+		recordUsage(db, usageEvent{ServerMethod: "post", ServerBaseURL: "reports", CustomerID: "cus_123", Units: 10}, LedgerCharged, true, day)
+		recordUsage(db, usageEvent{ServerMethod: "get", ServerBaseURL: "users", CustomerID: "cus_456", Units: 1}, LedgerCharged, true, day)
+		// outside of the period
+		recordUsage(db, usageEvent{ServerMethod: "get", ServerBaseURL: "users", CustomerID: "cus_456", Units: 1}, LedgerCharged, true, to)
+
+		source := &FileUsageSource{Path: "testdata/billed.jsonl"}
+
+		Convey("Success - report of lost and duplicated usage", func() {
+			report, err := Reconcile(db, source, from, to, ReconcileOptions{})
+			So(err, ShouldBeNil)
+			So(report.Checked, ShouldEqual, 3)
+			So(report.Discrepancies, ShouldResemble, []Discrepancy{
+				{CustomerID: "cus_123", Scope: "get:users", Local: 2, Billed: 1, Difference: 1},
+				{CustomerID: "cus_123", Scope: "post:reports", Local: 10, Billed: 20, Difference: -10},
+			})
+		})
+
+		Convey("Success - only a customer", func() {
+			report, err := Reconcile(db, source, from, to, ReconcileOptions{CustomerID: "cus_456"})
+			So(err, ShouldBeNil)
+			So(report.Checked, ShouldEqual, 1)
+			So(report.Discrepancies, ShouldBeEmpty)
+		})
+
+		Convey("Success - lost usage is charged and recorded as a correction", func() {
+			stub := stubby.StubFunc(&restlyPostJSON, nil, nil)
+			defer stub.Reset()
+			report, err := Reconcile(db, source, from, to, ReconcileOptions{Correct: true, StripeKey: "sk_test"})
+			So(err, ShouldBeNil)
+			So(report.Discrepancies[0].Corrected, ShouldBeTrue)
+			So(report.Discrepancies[1].Corrected, ShouldBeFalse)
+			entries, err := LedgerEntries(db, LedgerQuery{Status: LedgerCorrection})
+			So(err, ShouldBeNil)
+			So(entries, ShouldHaveLength, 1)
+			So(entries[0].Units, ShouldEqual, 1)
+		})
+
+		Convey("Success - the lost usage is corrected once in the period it reconciles", func() {
+			var charges []string
+			stub := stubby.Stub(&restlyPostJSON, func(req *fasthttp.Request, uri string, body string) (gjson.Result, error) {
+				charges = append(charges, body)
+				return gjson.Result{}, nil
+			})
+			defer stub.Reset()
+			for i := 0; i < 2; i++ {
+				_, err := Reconcile(db, source, from, to, ReconcileOptions{Correct: true, StripeKey: "sk_test"})
+				So(err, ShouldBeNil)
+			}
+			So(charges, ShouldHaveLength, 1)
+			So(gjson.Get(charges[0], "units").Int(), ShouldEqual, 1)
+			So(gjson.Get(charges[0], "timestamp").Int(), ShouldEqual, from.Unix())
+
+			entries, _ := LedgerEntries(db, LedgerQuery{Status: LedgerCorrection})
+			So(entries, ShouldHaveLength, 1)
+			So(entries[0].Time, ShouldEqual, from)
+			report, _ := Reconcile(db, source, from, to, ReconcileOptions{})
+			So(report.Discrepancies, ShouldResemble, []Discrepancy{
+				{CustomerID: "cus_123", Scope: "post:reports", Local: 10, Billed: 20, Difference: -10},
+			})
+		})
+
+		Convey("Failure - the correction cannot be charged", func() {
+			stub := stubby.StubFunc(&restlyPostJSON, nil, errors.New("foobar"))
+			defer stub.Reset()
+			report, err := Reconcile(db, source, from, to, ReconcileOptions{Correct: true})
+			So(err, ShouldBeNil)
+			So(report.Discrepancies[0].Corrected, ShouldBeFalse)
+			So(report.Discrepancies[0].Error, ShouldEqual, "foobar")
+		})
+
+		Convey("Success - HTTP usage source", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != "Bearer secret" || r.URL.Query().Get("from") != "2019-03-01T00:00:00Z" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				w.Write([]byte(`[{"customerID":"cus_456","scope":"get:users","units":1}]`))
+			}))
+			defer server.Close()
+			header := http.Header{}
+			header.Set("Authorization", "Bearer secret")
+			report, err := Reconcile(db, &HTTPUsageSource{URL: server.URL, Header: header}, from, to, ReconcileOptions{CustomerID: "cus_456"})
+			So(err, ShouldBeNil)
+			So(report.Discrepancies, ShouldBeEmpty)
+
+			_, err = Reconcile(db, &HTTPUsageSource{URL: server.URL}, from, to, ReconcileOptions{})
+			So(err, ShouldBeError)
+		})
+
+		Convey("Failure - no billed usage", func() {
+			_, err := Reconcile(db, &FileUsageSource{Path: "testdata/foobar.json"}, from, to, ReconcileOptions{})
+			So(err, ShouldBeError)
+		})
+	})
+	Convey("Reconcile - denied calls are not usage", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		viper.AutomaticEnv()
+		os.Setenv("LEDGER", "true")
+		os.Setenv("RBAC_VALIDATE", "false")
+		os.Setenv("STRIPE_VALIDATE", "true")
+		os.Setenv("STRIPE_JSON_PATH", "testdata/metering.json")
+		defer os.Setenv("LEDGER", "")
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		identity := &Identity{Method: MethodAPIKey, Subject: "apikey|1", CustomerID: "cus_789"}
+		router.Use(Run(db, WithAuthenticator(&stubAuthenticator{identity: identity})))
+		router.POST("/reports", func(c *gin.Context) {
+			c.String(http.StatusOK, "ok")
+		})
+		// nothing was billed
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`[]`))
+		}))
+		defer server.Close()
+		from := time.Now().Add(-time.Hour)
+		to := time.Now().Add(time.Hour)
+
+		Convey("Success - a failed charge of a scope that fails closed is not corrected", func() {
+			stub := stubby.StubFunc(&restlyPostJSON, nil, errors.New("foobar"))
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/reports", nil)
+			router.ServeHTTP(recorder, req)
+			stub.Reset()
+			So(recorder.Code, ShouldEqual, http.StatusUnauthorized)
+
+			entries, err := LedgerEntries(db, LedgerQuery{CustomerID: "cus_789"})
+			So(err, ShouldBeNil)
+			So(entries, ShouldHaveLength, 1)
+			So(entries[0].Status, ShouldEqual, LedgerFailed)
+			So(entries[0].Served, ShouldBeFalse)
+
+			stub = stubby.StubFunc(&restlyPostJSON, nil, nil)
+			defer stub.Reset()
+			report, err := Reconcile(db, &HTTPUsageSource{URL: server.URL}, from, to, ReconcileOptions{Correct: true})
+			So(err, ShouldBeNil)
+			So(report.Discrepancies, ShouldBeEmpty)
+			entries, _ = LedgerEntries(db, LedgerQuery{Status: LedgerCorrection})
+			So(entries, ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,178 @@
+package apibillme
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+)
+
+// revocation types
+const (
+	RevokeJTI      = "jti"
+	RevokeSubject  = "sub"
+	RevokeEmail    = "email"
+	RevokeCustomer = "customer"
+)
+
+// Revocation - a revoked token (jti), subject, email or customer ID
+type Revocation struct {
+	// Type - jti, sub, email or customer
+	Type string `json:"type"`
+	// Value - the revoked jti, subject, email or customer ID
+	Value string `json:"value"`
+	// Expires - when the revocation is lifted (zero never expires)
+	Expires time.Time `json:"expires"`
+}
+
+func revocationKey(kind string, value string) string {
+	return "apibillme:revoked:" + kind + ":" + value
+}
+
+// Revoke - revoke a token (jti), subject, email or customer ID - expires is optional
+func Revoke(db *buntdb.DB, revocation Revocation) error {
+	switch revocation.Type {
+	case RevokeJTI, RevokeSubject, RevokeEmail, RevokeCustomer:
+	default:
+		return errors.New("revocation type must be jti, sub, email or customer")
+	}
+	if revocation.Value == "" {
+		return errors.New("revocation value is required")
+	}
+	var opts *buntdb.SetOptions
+	if !revocation.Expires.IsZero() {
+		ttl := time.Until(revocation.Expires)
+		if ttl <= 0 {
+			return errors.New("revocation has already expired")
+		}
+		opts = &buntdb.SetOptions{Expires: true, TTL: ttl}
+	}
+	jsonBytes, err := json.Marshal(revocation)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(revocationKey(revocation.Type, revocation.Value), string(jsonBytes), opts)
+		return err
+	})
+}
+
+// Unrevoke - lift a revocation
+func Unrevoke(db *buntdb.DB, kind string, value string) error {
+	return db.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete(revocationKey(kind, value))
+		return err
+	})
+}
+
+// Revocations - list the active revocations
+func Revocations(db *buntdb.DB) ([]Revocation, error) {
+	revocations := []Revocation{}
+	err := db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendKeys("apibillme:revoked:*", func(key, val string) bool {
+			var revocation Revocation
+			if json.Unmarshal([]byte(val), &revocation) == nil {
+				revocations = append(revocations, revocation)
+			}
+			return true
+		})
+	})
+	return revocations, err
+}
+
+// ImportRevocations - bulk import revocations from a file ({"revocations": [...]}) and return how many were added
+func ImportRevocations(db *buntdb.DB, path string) (int, error) {
+	jsonBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var file struct {
+		Revocations []Revocation `json:"revocations"`
+	}
+	err = json.Unmarshal(jsonBytes, &file)
+	if err != nil {
+		return 0, err
+	}
+	for i, revocation := range file.Revocations {
+		err := Revoke(db, revocation)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(file.Revocations), nil
+}
+
+// isRevoked - check the jti, subject, email and customer ID of the identity
+func isRevoked(db *buntdb.DB, identity *Identity) bool {
+	values := map[string]string{
+		RevokeSubject:  identity.Subject,
+		RevokeEmail:    identity.Email,
+		RevokeCustomer: identity.CustomerID,
+	}
+	if identity.Token != nil {
+		values[RevokeJTI] = identity.Token.JwtID()
+	}
+	revoked := false
+	db.View(func(tx *buntdb.Tx) error {
+		for kind, value := range values {
+			// skip unknown values (e.g. tokens without a jti)
+			if value == "" {
+				continue
+			}
+			if _, err := tx.Get(revocationKey(kind, value)); err == nil {
+				revoked = true
+			}
+		}
+		return nil
+	})
+	return revoked
+}
+
+// revocationAdminScope - the scope of the revocation admin API (revocation_admin_scope ENV VAR - defaults to admin:revocations)
+func revocationAdminScope() string {
+	scope := strings.ToLower(cast.ToString(viper.Get("revocation_admin_scope")))
+	if scope == "" {
+		scope = "admin:revocations"
+	}
+	return scope
+}
+
+// MountRevocationAdmin - mount GET/POST /revocations and DELETE /revocations/:type/:value on routes - every route requires the revocation admin scope (revocation_admin_scope ENV VAR)
+func MountRevocationAdmin(routes gin.IRoutes, db *buntdb.DB, opts ...Option) {
+	admin := requireAdmin(db, opts, revocationAdminScope)
+	routes.GET("/revocations", admin, func(c *gin.Context) {
+		revocations, err := Revocations(db)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"revocations": revocations})
+	})
+	routes.POST("/revocations", admin, func(c *gin.Context) {
+		var revocation Revocation
+		err := json.NewDecoder(c.Request.Body).Decode(&revocation)
+		if err == nil {
+			err = Revoke(db, revocation)
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, revocation)
+	})
+	routes.DELETE("/revocations/:type/:value", admin, func(c *gin.Context) {
+		err := Unrevoke(db, c.Param("type"), c.Param("value"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+}
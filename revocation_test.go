@@ -0,0 +1,145 @@
+package apibillme
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apibillme/stubby"
+	"github.com/gin-gonic/gin"
+	"github.com/lestrrat-go/jwx/jwt"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/tidwall/buntdb"
+)
+
+func TestRevocation(t *testing.T) {
+
+	Convey("isRevoked", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		token := jwt.New()
+		token.Set("jti", "token-1")
+		identity := &Identity{Subject: "github|892404", Email: "test@example.com", CustomerID: "cus_123", Token: token}
+
+		Convey("Success - not revoked", func() {
+			So(isRevoked(db, identity), ShouldBeFalse)
+		})
+
+		Convey("Success - revoked by jti, subject, email and customer", func() {
+			for kind, value := range map[string]string{RevokeJTI: "token-1", RevokeSubject: "github|892404", RevokeEmail: "test@example.com", RevokeCustomer: "cus_123"} {
+				err := Revoke(db, Revocation{Type: kind, Value: value})
+				So(err, ShouldBeNil)
+				So(isRevoked(db, identity), ShouldBeTrue)
+				err = Unrevoke(db, kind, value)
+				So(err, ShouldBeNil)
+				So(isRevoked(db, identity), ShouldBeFalse)
+			}
+		})
+
+		Convey("Success - revocation expires", func() {
+			err := Revoke(db, Revocation{Type: RevokeSubject, Value: "github|892404", Expires: time.Now().Add(time.Hour)})
+			So(err, ShouldBeNil)
+			So(isRevoked(db, identity), ShouldBeTrue)
+
+			err = Revoke(db, Revocation{Type: RevokeSubject, Value: "github|892404", Expires: time.Now().Add(-time.Hour)})
+			So(err, ShouldBeError)
+		})
+
+		Convey("Success - bulk import", func() {
+			count, err := ImportRevocations(db, "testdata/revocations.json")
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 2)
+			So(isRevoked(db, &Identity{Email: "blocked@example.com"}), ShouldBeTrue)
+			So(isRevoked(db, &Identity{CustomerID: "cus_unpaid"}), ShouldBeTrue)
+		})
+
+		Convey("Failure - invalid type", func() {
+			err := Revoke(db, Revocation{Type: "foobar", Value: "foobar"})
+			So(err, ShouldBeError)
+		})
+
+		Convey("processRequest - revoked subject is rejected", func() {
+			stub1 := stubby.StubFunc(&jwtValidateNet, token, nil)
+			defer stub1.Reset()
+			token.Set("sub", "github|892404")
+			err := Revoke(db, Revocation{Type: RevokeSubject, Value: "github|892404"})
+			So(err, ShouldBeNil)
+			req, err := http.NewRequest("GET", "/users/12", nil)
+			So(err, ShouldBeNil)
+			req.Header.Set("Authorization", "Bearer foobar")
+			_, err = processRequest(db, req)
+			So(err.Error(), ShouldEqual, "Unauthorized - Access Revoked")
+		})
+	})
+
+	Convey("MountRevocationAdmin", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		gin.SetMode(gin.TestMode)
+		r := gin.New()
+		admin := &stubAuthenticator{identity: &Identity{Method: MethodAPIKey, Subject: "admin|1", Scopes: []string{"admin:revocations"}}}
+		MountRevocationAdmin(r, db, WithAuthenticator(admin))
+
+		Convey("Success - add, list and remove", func() {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/revocations", strings.NewReader(`{"type":"sub","value":"github|892404"}`))
+			r.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, http.StatusCreated)
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("GET", "/revocations", nil)
+			r.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldContainSubstring, "github|892404")
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("DELETE", "/revocations/sub/github|892404", nil)
+			r.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+			So(isRevoked(db, &Identity{Subject: "github|892404"}), ShouldBeFalse)
+		})
+
+		Convey("Failure - the caller must be authenticated", func() {
+			admin.identity, admin.err = nil, errNoCredentials
+			for _, method := range []string{"GET", "POST"} {
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequest(method, "/revocations", strings.NewReader(`{"type":"sub","value":"github|892404"}`))
+				r.ServeHTTP(w, req)
+				So(w.Code, ShouldEqual, http.StatusUnauthorized)
+			}
+			So(isRevoked(db, &Identity{Subject: "github|892404"}), ShouldBeFalse)
+		})
+
+		Convey("Failure - the caller must have the revocation admin scope", func() {
+			err := Revoke(db, Revocation{Type: RevokeSubject, Value: "github|892404"})
+			So(err, ShouldBeNil)
+			admin.identity = &Identity{Method: MethodAPIKey, Subject: "apikey|1", Scopes: []string{"delete:revocations"}}
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("DELETE", "/revocations/sub/github|892404", nil)
+			r.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+			So(w.Body.String(), ShouldContainSubstring, "the admin:revocations scope is required")
+			So(isRevoked(db, &Identity{Subject: "github|892404"}), ShouldBeTrue)
+		})
+
+		Convey("Failure - invalid revocation", func() {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/revocations", strings.NewReader(`{"type":"foobar"}`))
+			r.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
@@ -0,0 +1,76 @@
+package apibillme
+
+import (
+	"strings"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// stages that can run in shadow mode
+const (
+	ShadowRBAC    = "rbac"
+	ShadowBilling = "billing"
+)
+
+// ShadowCharged - the decision of a billing stage in shadow mode that would have charged
+const ShadowCharged = "charged"
+
+// ShadowDecision - what a stage in shadow mode would have done (the request is let through and nothing is charged)
+type ShadowDecision struct {
+	Stage string `json:"stage"`
+	// Decision - the reason code of a denial (e.g. insufficient_scope) or charged
+	Decision string `json:"decision"`
+	Units    int64  `json:"units,omitempty"`
+}
+
+// inShadow - whether the stage runs in shadow mode for the scope
+// the ENV VAR is true (every scope) or a comma separated list of scopes (e.g. get:users,post:reports)
+func inShadow(envVar string, serverMethod string, serverBaseURL string) bool {
+	value := strings.TrimSpace(cast.ToString(viper.Get(envVar)))
+	if value == "" {
+		return false
+	}
+	if shadow, err := cast.ToBoolE(value); err == nil {
+		return shadow
+	}
+	scope := serverMethod + ":" + serverBaseURL
+	for _, s := range strings.Split(value, ",") {
+		if strings.ToLower(strings.TrimSpace(s)) == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// shadowConfigured - whether the stage runs in shadow mode for some scope
+func shadowConfigured(envVar string) bool {
+	value := strings.TrimSpace(cast.ToString(viper.Get(envVar)))
+	shadow, err := cast.ToBoolE(value)
+	return value != "" && (err != nil || shadow)
+}
+
+// shadow - record what the stage would have done
+func (d *decision) shadow(stage string, decision string, units int64) {
+	d.shadowDecisions = append(d.shadowDecisions, ShadowDecision{Stage: stage, Decision: decision, Units: units})
+	d.metrics.shadowed(d, stage, decision, units)
+}
+
+// shadowDenied - whether a stage in shadow mode would have denied the request
+func (d *decision) shadowDenied() bool {
+	for _, shadow := range d.shadowDecisions {
+		if shadow.Decision != ShadowCharged {
+			return true
+		}
+	}
+	return false
+}
+
+// shadowSummary - the shadow decisions as stage:decision (e.g. rbac:insufficient_scope,billing:charged)
+func (d *decision) shadowSummary() string {
+	var summary []string
+	for _, shadow := range d.shadowDecisions {
+		summary = append(summary, shadow.Stage+":"+shadow.Decision)
+	}
+	return strings.Join(summary, ",")
+}
@@ -0,0 +1,135 @@
+package apibillme
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/apibillme/stubby"
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/gjson"
+	"github.com/valyala/fasthttp"
+)
+
+func TestShadow(t *testing.T) {
+
+	Convey("inShadow", t, func() {
+		viper.AutomaticEnv()
+		defer os.Setenv("RBAC_SHADOW", "")
+
+		os.Setenv("RBAC_SHADOW", "true")
+		So(inShadow("rbac_shadow", "get", "users"), ShouldBeTrue)
+		So(shadowConfigured("rbac_shadow"), ShouldBeTrue)
+
+		os.Setenv("RBAC_SHADOW", "get:users, POST:reports")
+		So(inShadow("rbac_shadow", "get", "users"), ShouldBeTrue)
+		So(inShadow("rbac_shadow", "post", "reports"), ShouldBeTrue)
+		So(inShadow("rbac_shadow", "post", "users"), ShouldBeFalse)
+
+		os.Setenv("RBAC_SHADOW", "false")
+		So(inShadow("rbac_shadow", "get", "users"), ShouldBeFalse)
+		So(shadowConfigured("rbac_shadow"), ShouldBeFalse)
+	})
+
+	Convey("Run - shadow mode", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		viper.AutomaticEnv()
+		os.Setenv("LEDGER", "true")
+		os.Setenv("RBAC_VALIDATE", "false")
+		os.Setenv("STRIPE_VALIDATE", "false")
+		os.Setenv("STRIPE_JSON_PATH", "testdata/metering.json")
+		defer os.Setenv("LEDGER", "")
+		defer os.Setenv("RBAC_SHADOW", "")
+		defer os.Setenv("STRIPE_SHADOW", "")
+
+		var charges []string
+		stub := stubby.Stub(&restlyPostJSON, func(req *fasthttp.Request, uri string, b string) (gjson.Result, error) {
+			charges = append(charges, b)
+			return gjson.Result{}, nil
+		})
+		defer stub.Reset()
+
+		metrics := NewMetrics()
+		logger := &memoryLogger{}
+		tracer := NewMemoryTracer()
+		identity := &Identity{Method: MethodAPIKey, Subject: "apikey|1", CustomerID: "cus_123", Scopes: []string{"get:users"}}
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		router.Use(Run(db, WithAuthenticator(&stubAuthenticator{identity: identity}), WithMetrics(metrics), WithLogger(logger), WithTracer(tracer)))
+		router.POST("/reports", func(c *gin.Context) {
+			c.String(http.StatusOK, "ok")
+		})
+		request := func() *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/reports", nil)
+			router.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		Convey("Success - RBAC denials are recorded and let through", func() {
+			os.Setenv("RBAC_SHADOW", "post:reports")
+			recorder := request()
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(logger.events, ShouldHaveLength, 1)
+			So(logger.events[0].Decision, ShouldEqual, "allowed")
+			So(logger.events[0].Shadow, ShouldResemble, []ShadowDecision{{Stage: ShadowRBAC, Decision: DecisionInsufficientScope}})
+			So(tracer.Span("apibillme.request").Attributes[AttributeShadow], ShouldEqual, "rbac:insufficient_scope")
+
+			scraped := httptest.NewRecorder()
+			metrics.ServeHTTP(scraped, nil)
+			// no stage needs the catalog so the scope is not looked up in it
+			So(scraped.Body.String(), ShouldContainSubstring, `apibillme_shadow_decisions_total{stage="rbac",decision="insufficient_scope",scope="other"} 1`)
+		})
+
+		Convey("Failure - RBAC is enforced on the other scopes", func() {
+			os.Setenv("RBAC_VALIDATE", "true")
+			defer os.Setenv("RBAC_VALIDATE", "false")
+			os.Setenv("RBAC_SHADOW", "get:reports")
+			So(request().Code, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("Success - charges are recorded but not made", func() {
+			os.Setenv("STRIPE_SHADOW", "true")
+			So(request().Code, ShouldEqual, http.StatusOK)
+			So(charges, ShouldBeEmpty)
+
+			entries, err := LedgerEntries(db, LedgerQuery{CustomerID: "cus_123"})
+			So(err, ShouldBeNil)
+			So(entries, ShouldHaveLength, 1)
+			So(entries[0].Status, ShouldEqual, LedgerShadow)
+			So(entries[0].Units, ShouldEqual, 10)
+
+			scraped := httptest.NewRecorder()
+			metrics.ServeHTTP(scraped, nil)
+			So(scraped.Body.String(), ShouldContainSubstring, `apibillme_shadow_units_total{scope="post:reports"} 10`)
+			So(strings.Contains(scraped.Body.String(), `apibillme_billing_duration_seconds_count{scope="post:reports"}`), ShouldBeFalse)
+		})
+
+		Convey("Success - a missing subscription is recorded and let through", func() {
+			os.Setenv("STRIPE_SHADOW", "true")
+			router := gin.New()
+			router.Use(Run(db, WithAuthenticator(&stubAuthenticator{identity: &Identity{Method: MethodAPIKey, Subject: "apikey|2"}}), WithLogger(logger)))
+			router.POST("/reports", func(c *gin.Context) {
+				c.String(http.StatusOK, "ok")
+			})
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/reports", nil)
+			router.ServeHTTP(recorder, req)
+			So(recorder.Code, ShouldEqual, http.StatusOK)
+			So(logger.events[0].Shadow[0].Decision, ShouldEqual, DecisionNoSubscription)
+			So(charges, ShouldBeEmpty)
+		})
+	})
+}
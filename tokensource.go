@@ -0,0 +1,126 @@
+package apibillme
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// token source kinds
+const (
+	SourceAuthorization = "authorization"
+	SourceHeader        = "header"
+	SourceCookie        = "cookie"
+	SourceQuery         = "query"
+)
+
+// TokenSource - where to find the access_token of a request
+type TokenSource struct {
+	// Kind - authorization (Authorization: Bearer), header, cookie or query
+	Kind string
+	// Name - the header, cookie or query parameter name (unused for authorization)
+	Name string
+}
+
+// defaultTokenSources - Authorization: Bearer <token> only
+var defaultTokenSources = []TokenSource{{Kind: SourceAuthorization}}
+
+// ParseTokenSources - parse a list like authorization,cookie:access_token,query:access_token,header:X-Forwarded-Access-Token
+func ParseTokenSources(list string) []TokenSource {
+	var sources []TokenSource
+	for _, item := range strings.Split(list, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), ":", 2)
+		source := TokenSource{Kind: strings.ToLower(parts[0])}
+		if len(parts) == 2 {
+			source.Name = parts[1]
+		}
+		if source.Kind != "" {
+			sources = append(sources, source)
+		}
+	}
+	return sources
+}
+
+// extractBearerToken - get the token of Authorization: Bearer <token> (the scheme is case-insensitive)
+func extractBearerToken(req *http.Request) string {
+	tokenParts := strings.Fields(req.Header.Get("Authorization"))
+	if len(tokenParts) != 2 || !strings.EqualFold(tokenParts[0], "Bearer") {
+		return ""
+	}
+	return tokenParts[1]
+}
+
+// trimScheme - strip a case-insensitive Bearer scheme - "" if there is another scheme
+func trimScheme(value string) string {
+	parts := strings.Fields(value)
+	switch {
+	case len(parts) == 1:
+		return parts[0]
+	case len(parts) == 2 && strings.EqualFold(parts[0], "Bearer"):
+		return parts[1]
+	}
+	return ""
+}
+
+// extract - get the access_token from the source ("" when there is none)
+func (s TokenSource) extract(req *http.Request) string {
+	switch s.Kind {
+	case SourceAuthorization:
+		return extractBearerToken(req)
+	case SourceHeader:
+		return trimScheme(req.Header.Get(s.Name))
+	case SourceCookie:
+		cookie, err := req.Cookie(s.Name)
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	case SourceQuery:
+		return req.URL.Query().Get(s.Name)
+	}
+	return ""
+}
+
+// extractToken - get the access_token from the first source that has one
+func extractToken(req *http.Request, sources []TokenSource) string {
+	for _, source := range sources {
+		token := source.extract(req)
+		if token != "" {
+			return token
+		}
+	}
+	return ""
+}
+
+// withBearer - copy of the request with the token as Authorization: Bearer <token>
+func withBearer(req *http.Request, token string) *http.Request {
+	bearerReq := req.Clone(req.Context())
+	bearerReq.Header.Set("Authorization", "Bearer "+token)
+	return bearerReq
+}
+
+// stripQueryTokens - remove query parameter tokens from the URL so they do not reach logs or handlers
+func stripQueryTokens(req *http.Request, sources []TokenSource) {
+	query := req.URL.Query()
+	stripped := false
+	for _, source := range sources {
+		if source.Kind == SourceQuery && query.Get(source.Name) != "" {
+			query.Del(source.Name)
+			stripped = true
+		}
+	}
+	if stripped {
+		req.URL.RawQuery = query.Encode()
+		req.RequestURI = req.URL.RequestURI()
+	}
+}
+
+func tokenSourcesFromConfig() []TokenSource {
+	sources := ParseTokenSources(cast.ToString(viper.Get("token_sources")))
+	if len(sources) == 0 {
+		return defaultTokenSources
+	}
+	return sources
+}
@@ -0,0 +1,147 @@
+package apibillme
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/apibillme/stubby"
+	"github.com/gin-gonic/gin"
+	"github.com/lestrrat-go/jwx/jwt"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+	"github.com/tidwall/buntdb"
+)
+
+func TestTokenSource(t *testing.T) {
+
+	Convey("extractToken", t, func() {
+
+		req, err := http.NewRequest("GET", "/events?access_token=query-token&foo=bar", nil)
+		So(err, ShouldBeNil)
+		sources := ParseTokenSources("authorization, cookie:access_token, query:access_token, header:X-Forwarded-Access-Token")
+		So(len(sources), ShouldEqual, 4)
+
+		Convey("Success - Authorization scheme is case-insensitive", func() {
+			req.Header.Set("Authorization", "bearer header-token")
+			So(extractToken(req, sources), ShouldEqual, "header-token")
+		})
+
+		Convey("Success - other schemes are ignored", func() {
+			req.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+			req.URL.RawQuery = ""
+			So(extractToken(req, sources), ShouldEqual, "")
+		})
+
+		Convey("Success - cookie before query", func() {
+			req.AddCookie(&http.Cookie{Name: "access_token", Value: "cookie-token"})
+			So(extractToken(req, sources), ShouldEqual, "cookie-token")
+		})
+
+		Convey("Success - query parameter", func() {
+			So(extractToken(req, sources), ShouldEqual, "query-token")
+		})
+
+		Convey("Success - forwarded header with or without scheme", func() {
+			req.URL.RawQuery = ""
+			req.Header.Set("X-Forwarded-Access-Token", "forwarded-token")
+			So(extractToken(req, sources), ShouldEqual, "forwarded-token")
+			req.Header.Set("X-Forwarded-Access-Token", "BEARER forwarded-token")
+			So(extractToken(req, sources), ShouldEqual, "forwarded-token")
+		})
+
+		Convey("Success - query tokens are stripped from the URL", func() {
+			stripQueryTokens(req, sources)
+			So(req.URL.String(), ShouldEqual, "/events?foo=bar")
+			So(req.URL.Query().Get("access_token"), ShouldBeEmpty)
+		})
+
+		Convey("Success - default is Authorization only", func() {
+			So(extractToken(req, defaultTokenSources), ShouldEqual, "")
+		})
+	})
+
+	Convey("JWTAuthenticator", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		var authorization string
+		stub1 := stubby.Stub(&jwtValidateNet, func(db *buntdb.DB, jwk string, audience string, iss string, req *http.Request) (*jwt.Token, error) {
+			authorization = req.Header.Get("Authorization")
+			return jwt.New(), nil
+		})
+		defer stub1.Reset()
+
+		Convey("Success - token from a cookie is validated as a Bearer token", func() {
+			req, err := http.NewRequest("GET", "/events", nil)
+			So(err, ShouldBeNil)
+			req.AddCookie(&http.Cookie{Name: "session", Value: "cookie-token"})
+			authenticator := &JWTAuthenticator{Provider: NewAuth0Provider("", "", ""), Sources: []TokenSource{{Kind: SourceCookie, Name: "session"}}}
+			_, err = authenticator.Authenticate(db, req)
+			So(err, ShouldBeNil)
+			So(authorization, ShouldEqual, "Bearer cookie-token")
+			So(req.Header.Get("Authorization"), ShouldBeEmpty)
+		})
+
+		Convey("Failure - the Authorization header is not read unless it is a source", func() {
+			req, err := http.NewRequest("GET", "/events", nil)
+			So(err, ShouldBeNil)
+			req.Header.Set("Authorization", "Bearer header-token")
+			authenticator := &JWTAuthenticator{Provider: NewAuth0Provider("", "", ""), Sources: []TokenSource{{Kind: SourceCookie, Name: "session"}}}
+			_, err = authenticator.Authenticate(db, req)
+			So(err, ShouldEqual, errNoCredentials)
+			So(authorization, ShouldBeEmpty)
+		})
+	})
+
+	Convey("Run - token sources", t, func() {
+
+		db, err := buntdb.Open(":memory:")
+		if err != nil {
+			log.Panic(err)
+		}
+		defer db.Close()
+
+		viper.AutomaticEnv()
+		os.Setenv("TOKEN_SOURCES", "cookie:session")
+		defer os.Setenv("TOKEN_SOURCES", "")
+		validated := 0
+		stub1 := stubby.Stub(&jwtValidateNet, func(db *buntdb.DB, jwk string, audience string, iss string, req *http.Request) (*jwt.Token, error) {
+			validated++
+			return jwt.New(), nil
+		})
+		defer stub1.Reset()
+
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		router.Use(Run(db))
+		router.GET("/events", func(c *gin.Context) {
+			c.String(http.StatusOK, "ok")
+		})
+
+		Convey("Failure - a token in the Authorization header only is not validated", func() {
+			req, _ := http.NewRequest("GET", "/events", nil)
+			req.Header.Set("Authorization", "Bearer header-token")
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+			So(recorder.Code, ShouldEqual, http.StatusUnauthorized)
+			So(validated, ShouldEqual, 0)
+		})
+
+		Convey("Success - the sources are parsed when the middleware is built", func() {
+			os.Setenv("TOKEN_SOURCES", "authorization")
+			req, _ := http.NewRequest("GET", "/events", nil)
+			req.Header.Set("Authorization", "Bearer header-token")
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+			So(recorder.Code, ShouldEqual, http.StatusUnauthorized)
+			So(validated, ShouldEqual, 0)
+		})
+	})
+}
@@ -0,0 +1,157 @@
+package apibillme
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Tracer - starts the spans of the middleware stages (adapt OpenTelemetry to it or use the MemoryTracer in tests)
+type Tracer interface {
+	// Start - start a span (a child of the span of ctx if it has one)
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span - a stage of a request
+type Span interface {
+	SetAttribute(key string, value interface{})
+	SetError(err error)
+	// Inject - set the W3C trace context (traceparent) of the span on the headers of an outgoing request
+	Inject(header http.Header)
+	End()
+}
+
+// span attributes
+const (
+	AttributeScope          = "apibillme.scope"
+	AttributeDecision       = "apibillme.decision"
+	AttributeAuthMethod     = "apibillme.auth_method"
+	AttributeTokenCacheHit  = "apibillme.token_cache_hit"
+	AttributeCatalogPath    = "apibillme.catalog_path"
+	AttributeBillingBackend = "apibillme.billing_backend"
+	AttributeUnits          = "apibillme.units"
+	AttributeShadow         = "apibillme.shadow"
+)
+
+type noopTracer struct{}
+
+type noopSpan struct{}
+
+func (noopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) SetError(err error)                         {}
+func (noopSpan) Inject(header http.Header)                  {}
+func (noopSpan) End()                                       {}
+
+type spanKey struct{}
+
+type tracerKey struct{}
+
+// contextWithSpan - make the span the current span of ctx (used to inject the trace context of outgoing requests)
+func contextWithSpan(ctx context.Context, span Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// spanFromContext - the current span of ctx (a no-op span if there is none)
+func spanFromContext(ctx context.Context) Span {
+	if span, ok := ctx.Value(spanKey{}).(Span); ok {
+		return span
+	}
+	return noopSpan{}
+}
+
+// tracerFromContext - the tracer of the current span of ctx (a no-op tracer if there is none)
+func tracerFromContext(ctx context.Context) Tracer {
+	if tracer, ok := ctx.Value(tracerKey{}).(Tracer); ok {
+		return tracer
+	}
+	return noopTracer{}
+}
+
+// startSpan - start a span as the current span of the context (the tracer is kept for the spans of outgoing requests)
+func startSpan(tracer Tracer, ctx context.Context, name string) (context.Context, Span) {
+	ctx, span := tracer.Start(ctx, name)
+	ctx = context.WithValue(ctx, tracerKey{}, tracer)
+	return contextWithSpan(ctx, span), span
+}
+
+// MemorySpan - a span recorded by the MemoryTracer
+type MemorySpan struct {
+	Name       string
+	TraceID    string
+	SpanID     string
+	ParentID   string
+	Attributes map[string]interface{}
+	Err        error
+	StartTime  time.Time
+	EndTime    time.Time
+	tracer     *MemoryTracer
+}
+
+// MemoryTracer - records the ended spans in memory (an in-memory exporter for tests)
+type MemoryTracer struct {
+	sync.Mutex
+	spans []MemorySpan
+}
+
+// NewMemoryTracer - a tracer that records spans in memory
+func NewMemoryTracer() *MemoryTracer {
+	return &MemoryTracer{}
+}
+
+// Start - start a span (a child of the MemorySpan of ctx if it has one)
+func (t *MemoryTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := &MemorySpan{Name: name, Attributes: map[string]interface{}{}, StartTime: time.Now(), tracer: t}
+	span.SpanID, _ = randomHex(8)
+	if parent, ok := ctx.Value(spanKey{}).(*MemorySpan); ok {
+		span.TraceID = parent.TraceID
+		span.ParentID = parent.SpanID
+	} else {
+		span.TraceID, _ = randomHex(16)
+	}
+	return ctx, span
+}
+
+// Spans - the ended spans in the order they ended
+func (t *MemoryTracer) Spans() []MemorySpan {
+	t.Lock()
+	defer t.Unlock()
+	return append([]MemorySpan{}, t.spans...)
+}
+
+// Span - the first ended span with the name (nil if there is none)
+func (t *MemoryTracer) Span(name string) *MemorySpan {
+	for _, span := range t.Spans() {
+		if span.Name == name {
+			return &span
+		}
+	}
+	return nil
+}
+
+// SetAttribute - set an attribute of the span
+func (s *MemorySpan) SetAttribute(key string, value interface{}) {
+	s.Attributes[key] = value
+}
+
+// SetError - set the error of the span
+func (s *MemorySpan) SetError(err error) {
+	s.Err = err
+}
+
+// Inject - set the traceparent header of the span
+func (s *MemorySpan) Inject(header http.Header) {
+	header.Set("traceparent", "00-"+s.TraceID+"-"+s.SpanID+"-01")
+}
+
+// End - record the span
+func (s *MemorySpan) End() {
+	s.EndTime = time.Now()
+	s.tracer.Lock()
+	defer s.tracer.Unlock()
+	s.tracer.spans = append(s.tracer.spans, *s)
+}